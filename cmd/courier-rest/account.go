@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"github.com/david-wiles/groupme-clone/internal"
 	"github.com/google/uuid"
@@ -9,8 +10,12 @@ import (
 	log "github.com/sirupsen/logrus"
 	"net/http"
 	"strings"
+	"time"
 )
 
+// emailTimeout is how long sending an email in the background may take
+const emailTimeout = time.Minute
+
 type CreateAccountRequest struct {
 	Username string `json:"username"`
 	Email    string `json:"email"`
@@ -31,6 +36,16 @@ func HandleCreateAccount(w http.ResponseWriter, r *http.Request, _ httprouter.Pa
 		return
 	}
 
+	if err := internal.ValidateUsername(req.Username); err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	if err := internal.ValidatePassword(req.Password); err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
 	pass, err := internal.HashPassword(req.Password)
 	if err != nil {
 		w.WriteHeader(500)
@@ -39,10 +54,28 @@ func HandleCreateAccount(w http.ResponseWriter, r *http.Request, _ httprouter.Pa
 
 	account, err := accountQueryEngine.CreateAccount(req.Username, req.Email, pass)
 	if err != nil {
+		if err == internal.AccountExistsError {
+			w.WriteHeader(409)
+			return
+		}
 		w.WriteHeader(500)
 		return
 	}
 
+	// The email is sent after responding, so that signing up doesn't wait for the mail server. The account
+	// can still be used if the email fails, and the user can ask for it to be sent again
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), emailTimeout)
+		defer cancel()
+
+		if err := emailVerifier.SendVerification(ctx, account); err != nil {
+			log.WithFields(log.Fields{
+				"err":       err,
+				"accountID": account.ID,
+			}).Warnln("unable to send verification email")
+		}
+	}()
+
 	token, err := internal.GenerateJWT(account, jwtSecret)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -138,8 +171,20 @@ func HandleLogin(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	internal.SerializeResponse(w, &LoginResponse{token, account.ID.String()})
 }
 
+// HandleGetUser returns the requesting user's account if the id is theirs or "me", and otherwise the
+// profile of the account with the id
 func HandleGetUser(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	claims, ok := GetClaimsFromRequest(r)
+	if !ok {
+		log.WithFields(log.Fields{}).Errorln("unable to read claims from request")
+		w.WriteHeader(500)
+		return
+	}
+
 	id := p.ByName("id")
+	if id == "me" {
+		id = claims.ID
+	}
 
 	parsedId, err := uuid.Parse(id)
 	if err != nil {
@@ -157,14 +202,244 @@ func HandleGetUser(w http.ResponseWriter, r *http.Request, p httprouter.Params)
 		return
 	}
 
+	if account.ID.String() != claims.ID {
+		internal.SerializeResponse(w, account.Profile())
+		return
+	}
+	internal.SerializeResponse(w, account)
+}
+
+// HandleAccountUpdate changes the requesting user's profile. Fields missing from the request are left
+// unchanged
+func HandleAccountUpdate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	update := internal.ProfileUpdate{}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warnln("cannot decode request")
+		w.WriteHeader(400)
+		return
+	}
+
+	claims, ok := GetClaimsFromRequest(r)
+	if !ok {
+		log.WithFields(log.Fields{}).Errorln("unable to read claims from request")
+		w.WriteHeader(500)
+		return
+	}
+
+	userID, err := uuid.Parse(claims.ID)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	account, err := profileUpdater.Update(r.Context(), userID, update)
+	if err != nil {
+		switch err {
+		case internal.InvalidUsernameError, internal.InvalidDisplayNameError, internal.InvalidBioError,
+			internal.InvalidStatusError, internal.InvalidAvatarError:
+			w.WriteHeader(400)
+		case internal.UsernameTakenError:
+			w.WriteHeader(409)
+		case internal.NoMatchingUserError:
+			w.WriteHeader(404)
+		default:
+			w.WriteHeader(500)
+		}
+		return
+	}
+
 	internal.SerializeResponse(w, account)
 }
 
+type PasswordChangeRequest struct {
+	OldPassword string `json:"oldPassword"`
+	NewPassword string `json:"newPassword"`
+}
+
+// HandlePasswordChange replaces the requesting user's password, which requires their current password
+func HandlePasswordChange(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	req := &PasswordChangeRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warnln("cannot decode request")
+		w.WriteHeader(400)
+		return
+	}
+
+	claims, ok := GetClaimsFromRequest(r)
+	if !ok {
+		log.WithFields(log.Fields{}).Errorln("unable to read claims from request")
+		w.WriteHeader(500)
+		return
+	}
+
+	userID, err := uuid.Parse(claims.ID)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	if err := accountQueryEngine.ChangePassword(userID, req.OldPassword, req.NewPassword); err != nil {
+		switch err {
+		case internal.WeakPasswordError:
+			w.WriteHeader(400)
+		case internal.IncorrectPasswordError:
+			w.WriteHeader(403)
+		case internal.NoMatchingUserError:
+			w.WriteHeader(404)
+		default:
+			w.WriteHeader(500)
+		}
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+type PasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+// HandlePasswordResetRequest emails a password reset token to the account with the email. The response is
+// the same whether or not there is such an account
+func HandlePasswordResetRequest(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	req := &PasswordResetRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil || req.Email == "" {
+		w.WriteHeader(400)
+		return
+	}
+
+	// The email is sent after responding, since the time taken to send it would tell whether the email
+	// has an account
+	go func(email string) {
+		ctx, cancel := context.WithTimeout(context.Background(), emailTimeout)
+		defer cancel()
+
+		if err := passwordResetter.RequestReset(ctx, email); err != nil {
+			if err == internal.RateLimitedError {
+				log.Warnln("too many password resets requested for an email")
+				return
+			}
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Errorln("unable to request password reset")
+		}
+	}(req.Email)
+
+	w.WriteHeader(202)
+}
+
+type PasswordResetConfirmRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"newPassword"`
+}
+
+// HandlePasswordResetConfirm sets a new password using a token sent by HandlePasswordResetRequest
+func HandlePasswordResetConfirm(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	req := &PasswordResetConfirmRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil || req.Token == "" {
+		w.WriteHeader(400)
+		return
+	}
+
+	if err := passwordResetter.Reset(req.Token, req.NewPassword); err != nil {
+		switch err {
+		case internal.WeakPasswordError, internal.InvalidResetTokenError:
+			w.WriteHeader(400)
+		default:
+			w.WriteHeader(500)
+		}
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// HandleVerificationResend emails a new verification link to the requesting user, unless they are
+// already verified
+func HandleVerificationResend(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	claims, ok := GetClaimsFromRequest(r)
+	if !ok {
+		log.WithFields(log.Fields{}).Errorln("unable to read claims from request")
+		w.WriteHeader(500)
+		return
+	}
+
+	userID, err := uuid.Parse(claims.ID)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	account, err := accountQueryEngine.GetAccount(userID)
+	if err != nil {
+		if err == internal.NoMatchingUserError {
+			w.WriteHeader(404)
+		} else {
+			w.WriteHeader(500)
+		}
+		return
+	}
+
+	if err := emailVerifier.SendVerification(r.Context(), account); err != nil {
+		if err == internal.AlreadyVerifiedError {
+			w.WriteHeader(409)
+		} else {
+			w.WriteHeader(500)
+		}
+		return
+	}
+
+	w.WriteHeader(202)
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+// HandleVerifyEmail verifies the account a verification token was sent to
+func HandleVerifyEmail(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	req := &VerifyEmailRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil || req.Token == "" {
+		w.WriteHeader(400)
+		return
+	}
+
+	if _, err := emailVerifier.Verify(req.Token); err != nil {
+		if err == internal.InvalidVerificationTokenError {
+			w.WriteHeader(400)
+		} else {
+			w.WriteHeader(500)
+		}
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
 func AddAccountRoutes(prefix string, router *httprouter.Router) {
 	router.POST(prefix+"/account", HandleCreateAccount)
 	router.GET(prefix+"/account", JWTGuard(HandleAccountList))
 	router.POST(prefix+"/account/login", HandleLogin)
-	//router.GET("/account/", HandleGetSelf)
-	//router.PATCH("/account/me", HandleAccountUpdate)
+	router.PATCH(prefix+"/account/me", JWTGuard(HandleAccountUpdate))
+	router.POST(prefix+"/account/me/password", JWTGuard(HandlePasswordChange))
+	router.POST(prefix+"/account/password-reset", HandlePasswordResetRequest)
+	router.POST(prefix+"/account/password-reset/confirm", HandlePasswordResetConfirm)
+	router.POST(prefix+"/account/me/verification", JWTGuard(HandleVerificationResend))
+	router.POST(prefix+"/account/verify", HandleVerifyEmail)
+	// GET /account/me is handled by HandleGetUser, since httprouter can't match it alongside /account/:id
 	router.GET(prefix+"/account/:id", JWTGuard(HandleGetUser))
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"github.com/david-wiles/groupme-clone/internal"
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// multipartOverhead is the room left in upload requests for the multipart headers and boundaries
+const multipartOverhead = 1 << 20
+
+// HandleAttachmentUpload stores the file in the "file" field of a multipart form. The returned
+// attachment can then be referenced by the user's next message
+func HandleAttachmentUpload(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	r.Body = http.MaxBytesReader(w, r.Body, attachmentStore.Policy.MaxSize+multipartOverhead)
+	defer r.Body.Close()
+
+	claims, ok := GetClaimsFromRequest(r)
+	if !ok {
+		log.WithFields(log.Fields{}).Errorln("unable to read claims from request")
+		w.WriteHeader(500)
+		return
+	}
+
+	userID, err := uuid.Parse(claims.ID)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	// Only the headers and small fields are held in memory, files are spooled to disk
+	if err := r.ParseMultipartForm(multipartOverhead); err != nil {
+		if _, ok := err.(*http.MaxBytesError); ok {
+			w.WriteHeader(413)
+			return
+		}
+		w.WriteHeader(400)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	defer file.Close()
+
+	attachment, err := attachmentStore.Upload(r.Context(), userID, header.Filename, file, header.Size)
+	if err != nil {
+		switch err {
+		case internal.AttachmentTooLargeError:
+			w.WriteHeader(413)
+		case internal.UnsupportedContentTypeError:
+			w.WriteHeader(415)
+		default:
+			w.WriteHeader(500)
+		}
+		return
+	}
+
+	w.WriteHeader(201)
+	internal.SerializeResponse(w, attachment)
+}
+
+// HandleAttachmentGet returns the contents of an attachment, or of one of its variants if the variant
+// query parameter is set. Attachments can be read by the user who uploaded them, and by the members of
+// the room of the message they are part of
+func HandleAttachmentGet(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	claims, ok := GetClaimsFromRequest(r)
+	if !ok {
+		log.WithFields(log.Fields{}).Errorln("unable to read claims from request")
+		w.WriteHeader(500)
+		return
+	}
+
+	userID, err := uuid.Parse(claims.ID)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	id, err := uuid.Parse(p.ByName("id"))
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	attachment, err := attachmentQueryEngine.GetAttachment(id)
+	if err != nil {
+		if err == internal.NoMatchingAttachmentError {
+			w.WriteHeader(404)
+			return
+		}
+		w.WriteHeader(500)
+		return
+	}
+
+	if ok, err := canReadAttachment(attachment, userID); err != nil {
+		w.WriteHeader(500)
+		return
+	} else if !ok {
+		// Attachments the user can't read are indistinguishable from those which don't exist
+		w.WriteHeader(404)
+		return
+	}
+
+	var (
+		body        io.ReadCloser
+		contentType = attachment.ContentType
+		size        int64
+	)
+	if name := r.URL.Query().Get("variant"); name != "" {
+		var variant *internal.AttachmentVariant
+		body, variant, err = attachmentStore.OpenVariant(r.Context(), attachment, name)
+		if err == nil {
+			contentType, size = variant.ContentType, variant.Size
+		}
+	} else {
+		var info *internal.BlobInfo
+		body, info, err = attachmentStore.Open(r.Context(), attachment)
+		if err == nil {
+			size = info.Size
+		}
+	}
+	if err != nil {
+		if err == internal.NoMatchingBlobError {
+			w.WriteHeader(404)
+			return
+		}
+		log.WithFields(log.Fields{
+			"err": err,
+			"id":  id,
+		}).Errorln("unable to open attachment")
+		w.WriteHeader(500)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+			"id":  id,
+		}).Warnln("unable to write attachment")
+	}
+}
+
+// canReadAttachment returns true if userID uploaded the attachment or is a member of the room of its
+// message. Attachments of deleted messages can only be read by their uploader, while avatars can be read
+// by anyone
+func canReadAttachment(attachment *internal.Attachment, userID uuid.UUID) (bool, error) {
+	if attachment.UserID == userID {
+		return true, nil
+	}
+	if attachment.MessageID == nil {
+		uploader, err := accountQueryEngine.GetAccount(attachment.UserID)
+		if err != nil {
+			if err == internal.NoMatchingUserError {
+				return false, nil
+			}
+			return false, err
+		}
+		return uploader.AvatarAttachment != nil && *uploader.AvatarAttachment == attachment.ID, nil
+	}
+
+	message, err := messageQueryEngine.GetMessage(*attachment.MessageID)
+	if err != nil {
+		if err == internal.NoMatchingMessageError {
+			return false, nil
+		}
+		return false, err
+	}
+	if message.DeletedAt != nil {
+		return false, nil
+	}
+
+	members, err := roomQueryEngine.ListRoomMembers(message.RoomID)
+	if err != nil {
+		return false, err
+	}
+	return internal.ContainsUUID(members, userID), nil
+}
+
+func AddAttachmentRoutes(prefix string, router *httprouter.Router) {
+	router.POST(prefix+"/attachment", JWTGuard(HandleAttachmentUpload))
+	router.GET(prefix+"/attachment/:id", JWTGuard(HandleAttachmentGet))
+}
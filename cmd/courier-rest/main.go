@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"github.com/david-wiles/groupme-clone/internal"
 	"github.com/julienschmidt/httprouter"
@@ -9,19 +10,31 @@ import (
 	log "github.com/sirupsen/logrus"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 )
 
 var (
-	db                 *sql.DB
-	accountQueryEngine internal.AccountQueryEngine
-	roomQueryEngine    internal.RoomQueryEngine
-	messageQueryEngine internal.MessageQueryEngine
-	rdb                *redis.Client
-	jwtSecret          []byte
-	courierConns       *internal.CourierConns
+	db                    *sql.DB
+	accountQueryEngine    internal.AccountQueryEngine
+	roomQueryEngine       internal.RoomQueryEngine
+	messageQueryEngine    internal.MessageQueryEngine
+	attachmentQueryEngine internal.AttachmentQueryEngine
+	attachmentStore       internal.AttachmentStore
+	mediaProcessor        internal.MediaProcessor
+	profileUpdater        internal.ProfileUpdater
+	passwordResetter      internal.PasswordResetter
+	emailVerifier         internal.EmailVerifier
+	rdb                   *redis.Client
+	jwtSecret             []byte
+	courierConns          *internal.CourierConns
+	messagePoster         internal.MessagePoster
+	presenceEngine        internal.PresenceEngine
 
 	isDev = false
+
+	// requireVerified restricts creating rooms and posting to users who have verified their email address
+	requireVerified = false
 )
 
 func init() {
@@ -32,6 +45,11 @@ func init() {
 		TimestampFormat: time.RFC3339Nano,
 	})
 
+	// Set if local development
+	if _, ok := os.LookupEnv("DEV"); ok {
+		isDev = true
+	}
+
 	// Initiate postgres connection
 	connection := internal.MustGetEnv("POSTGRES_URI")
 
@@ -45,9 +63,10 @@ func init() {
 		panic(err)
 	}
 
-	accountQueryEngine = internal.AccountQueryEngine{db}
-	roomQueryEngine = internal.RoomQueryEngine{db}
-	messageQueryEngine = internal.MessageQueryEngine{db}
+	accountQueryEngine = internal.AccountQueryEngine{DB: db}
+	roomQueryEngine = internal.RoomQueryEngine{DB: db}
+	messageQueryEngine = internal.MessageQueryEngine{DB: db}
+	attachmentQueryEngine = internal.AttachmentQueryEngine{DB: db}
 
 	// Set JWT secret
 	secret := internal.MustGetEnv("JWT_SECRET")
@@ -63,9 +82,172 @@ func init() {
 
 	courierConns = internal.NewCourierConnCache(rdb)
 
-	// Set if local development
-	if _, ok := os.LookupEnv("DEV"); ok {
-		isDev = true
+	// Messages are queued for redelivery and buffered for resuming sessions here, before they are sent to
+	// the courier nodes, so DELIVERY_RETENTION and REPLAY_BUFFER_SIZE must match the courier's configuration
+	retention := internal.DefaultDeliveryRetention
+	if raw, ok := os.LookupEnv("DELIVERY_RETENTION"); ok {
+		if retention, err = time.ParseDuration(raw); err != nil {
+			panic(err)
+		}
+	}
+	replaySize := int64(internal.DefaultReplayBufferSize)
+	if raw, ok := os.LookupEnv("REPLAY_BUFFER_SIZE"); ok {
+		if replaySize, err = strconv.ParseInt(raw, 10, 64); err != nil {
+			panic(err)
+		}
+	}
+	courierConns.SetDeliveryQueue(
+		internal.RedisDeliveryQueue{Client: rdb, Retention: retention},
+		internal.RedisReplayBuffer{Client: rdb, Size: replaySize, Retention: retention},
+	)
+
+	messagePoster = internal.MessagePoster{
+		Rooms:       roomQueryEngine,
+		Messages:    messageQueryEngine,
+		Attachments: attachmentQueryEngine,
+		Conns:       courierConns,
+		Unfurler:    internal.NewUnfurler(rdb),
+		Accounts:    accountQueryEngine,
+	}
+
+	profileUpdater = internal.ProfileUpdater{
+		Accounts:    accountQueryEngine,
+		Attachments: attachmentQueryEngine,
+		Rooms:       roomQueryEngine,
+		Conns:       courierConns,
+	}
+
+	// Password reset and verification emails link to PASSWORD_RESET_URL and VERIFY_EMAIL_URL, or only
+	// contain the token if they aren't set
+	emailSender := mustGetEmailSender()
+	resetURL, _ := os.LookupEnv("PASSWORD_RESET_URL")
+	passwordResetter = internal.PasswordResetter{
+		Accounts: accountQueryEngine,
+		Sender:   emailSender,
+		Limiter: internal.RedisRateLimiter{
+			Client: rdb,
+			Prefix: "password-reset",
+			Limit:  internal.DefaultPasswordResetLimit,
+			Window: internal.DefaultPasswordResetWindow,
+		},
+		ResetURL: resetURL,
+	}
+	verifyURL, _ := os.LookupEnv("VERIFY_EMAIL_URL")
+	emailVerifier = internal.EmailVerifier{
+		Accounts:  accountQueryEngine,
+		Sender:    emailSender,
+		VerifyURL: verifyURL,
+	}
+
+	if raw, ok := os.LookupEnv("REQUIRE_VERIFIED_EMAIL"); ok {
+		if requireVerified, err = strconv.ParseBool(raw); err != nil {
+			panic(err)
+		}
+		messagePoster.RequireVerified = requireVerified
+	}
+
+	blobStore := mustGetBlobStore()
+	mediaQueue := &internal.MediaQueue{Client: rdb}
+
+	attachmentStore = internal.AttachmentStore{
+		Attachments: attachmentQueryEngine,
+		Blobs:       blobStore,
+		Policy:      internal.DefaultAttachmentPolicy,
+		Media:       mediaQueue,
+	}
+
+	// Attachments larger than ATTACHMENT_MAX_SIZE bytes are rejected
+	if raw, ok := os.LookupEnv("ATTACHMENT_MAX_SIZE"); ok {
+		maxSize, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			panic(err)
+		}
+		attachmentStore.Policy.MaxSize = maxSize
+	}
+
+	// Uploads are processed by MEDIA_WORKERS workers in each instance, which may be 0 to leave processing to
+	// other instances sharing the queue
+	mediaProcessor = internal.MediaProcessor{
+		Queue:   *mediaQueue,
+		Poster:  messagePoster,
+		Blobs:   blobStore,
+		Workers: internal.DefaultMediaWorkers,
+	}
+	if raw, ok := os.LookupEnv("MEDIA_WORKERS"); ok {
+		workers, err := strconv.Atoi(raw)
+		if err != nil || workers < 0 {
+			panic("invalid MEDIA_WORKERS " + raw)
+		}
+		mediaProcessor.Workers = workers
+	}
+
+	// Connections to courier nodes which fail for COURIER_EVICT_AFTER are closed
+	if raw, ok := os.LookupEnv("COURIER_EVICT_AFTER"); ok {
+		evictAfter, err := time.ParseDuration(raw)
+		if err != nil {
+			panic(err)
+		}
+		courierConns.SetEvictAfter(evictAfter)
+	}
+
+	// PRESENCE_IDLE_AFTER must match the courier's configuration
+	presenceEngine = internal.PresenceEngine{Client: rdb}
+	if raw, ok := os.LookupEnv("PRESENCE_IDLE_AFTER"); ok {
+		idleAfter, err := time.ParseDuration(raw)
+		if err != nil {
+			panic(err)
+		}
+		presenceEngine.IdleAfter = idleAfter
+	}
+
+}
+
+// mustGetBlobStore returns the BlobStore configured by BLOB_STORE, either "file" (the default) storing
+// blobs under BLOB_ROOT, or "s3" storing blobs in S3_BUCKET of the S3 compatible service at S3_ENDPOINT
+func mustGetBlobStore() internal.BlobStore {
+	switch kind, _ := os.LookupEnv("BLOB_STORE"); kind {
+	case "", "file":
+		root, ok := os.LookupEnv("BLOB_ROOT")
+		if !ok {
+			root = "blobs"
+		}
+		return internal.FileBlobStore{Root: root}
+	case "s3":
+		region, ok := os.LookupEnv("S3_REGION")
+		if !ok {
+			region = "us-east-1"
+		}
+		return internal.S3BlobStore{
+			Endpoint:  internal.MustGetEnv("S3_ENDPOINT"),
+			Bucket:    internal.MustGetEnv("S3_BUCKET"),
+			Region:    region,
+			AccessKey: internal.MustGetEnv("S3_ACCESS_KEY"),
+			SecretKey: internal.MustGetEnv("S3_SECRET_KEY"),
+		}
+	default:
+		panic("unsupported BLOB_STORE " + kind)
+	}
+}
+
+// mustGetEmailSender returns an SMTPSender for the server at SMTP_ADDR. SMTP_ADDR must be set unless DEV is,
+// in which case emails are kept in memory and never delivered
+func mustGetEmailSender() internal.EmailSender {
+	addr, ok := os.LookupEnv("SMTP_ADDR")
+	if !ok {
+		if !isDev {
+			panic("SMTP_ADDR is not set")
+		}
+		log.Warnln("SMTP_ADDR is not set, emails will not be delivered")
+		return &internal.MemoryEmailSender{}
+	}
+
+	username, _ := os.LookupEnv("SMTP_USERNAME")
+	password, _ := os.LookupEnv("SMTP_PASSWORD")
+	return internal.SMTPSender{
+		Addr:     addr,
+		From:     internal.MustGetEnv("SMTP_FROM"),
+		Username: username,
+		Password: password,
 	}
 }
 
@@ -123,8 +305,35 @@ func main() {
 	AddAccountRoutes("/api/"+apiVersion, router)
 	AddRoomRoutes("/api/"+apiVersion, router)
 	AddMessageRoutes("/api/"+apiVersion, router)
+	AddPresenceRoutes("/api/"+apiVersion, router)
+	AddAttachmentRoutes("/api/"+apiVersion, router)
 
-	if err := http.ListenAndServe(":9000", devHandler(loggingHandler(router))); err != nil {
-		panic(err)
+	// Status routes are served on ADMIN_LISTEN_ADDRESS, if it is set, which must not be reachable by clients
+	if addr, ok := os.LookupEnv("ADMIN_LISTEN_ADDRESS"); ok {
+		adminRouter := httprouter.New()
+		AddStatusRoutes("", adminRouter)
+		go func() {
+			if err := http.ListenAndServe(addr, loggingHandler(adminRouter)); err != nil {
+				log.WithFields(log.Fields{
+					"err":  err,
+					"addr": addr,
+				}).Errorln("admin server stopped")
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if mediaProcessor.Workers > 0 {
+		go mediaProcessor.Run(ctx)
 	}
+
+	err := http.ListenAndServe(":9000", devHandler(loggingHandler(router)))
+
+	// Stop the media workers and close the courier connections before exiting, which deferring them
+	// would skip since log.Fatalln exits immediately
+	cancel()
+	courierConns.Close()
+	log.WithFields(log.Fields{
+		"err": err,
+	}).Fatalln("server stopped")
 }
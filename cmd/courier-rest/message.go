@@ -2,17 +2,32 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/david-wiles/groupme-clone/internal"
 	"github.com/google/uuid"
 	"github.com/julienschmidt/httprouter"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 )
 
 type MessagePostRequest struct {
 	RoomID  string `json:"roomId"`
 	Message string `json:"message"`
+	ReplyTo string `json:"replyTo,omitempty"`
+
+	// Attachments are the IDs of attachments uploaded by the user
+	Attachments []string `json:"attachments,omitempty"`
+}
+
+// MessagePostResponse is the created message along with the result of delivering it to each of the
+// other room members, so that clients can tell which members did not receive it in real time
+type MessagePostResponse struct {
+	*internal.Message
+	Deliveries []internal.RecipientResult `json:"deliveries"`
 }
 
 func HandleMessagePost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -47,96 +62,521 @@ func HandleMessagePost(w http.ResponseWriter, r *http.Request, _ httprouter.Para
 		return
 	}
 
-	members, err := roomQueryEngine.ListRoomMembers(roomID)
+	draft := internal.MessageDraft{RoomID: roomID, Content: req.Message}
+	if req.ReplyTo != "" {
+		replyTo, err := uuid.Parse(req.ReplyTo)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		draft.ReplyTo = &replyTo
+	}
+
+	for _, raw := range req.Attachments {
+		attachmentID, err := uuid.Parse(raw)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		draft.Attachments = append(draft.Attachments, attachmentID)
+	}
+
+	message, deliveries, err := messagePoster.Post(r.Context(), userID, draft)
 	if err != nil {
-		if err == internal.NoMatchingRoomError {
+		if err == internal.NoMatchingRoomError || err == internal.InvalidReplyError || err == internal.InvalidMessageAttachmentError {
 			w.WriteHeader(400)
+		} else if err == internal.NotRoomMemberError || err == internal.UnverifiedAccountError {
+			w.WriteHeader(403)
 		} else {
 			w.WriteHeader(500)
 		}
 		return
 	}
 
-	now := time.Now()
-	id, err := messageQueryEngine.CreateNewMessage(roomID, userID, now, req.Message)
+	internal.SerializeResponse(w, &MessagePostResponse{message, deliveries})
+}
+
+type ListMessagesResponse struct {
+	Messages []internal.Message `json:"messages"`
+}
+
+// HandleMessageGet returns messages posted in a room the user has joined. If from is given, every message
+// between from and to is returned. Otherwise, a page of up to limit messages is returned, starting from the
+// newest message, the message given by before or after, or the cursor returned with a previous page
+func HandleMessageGet(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	query := r.URL.Query()
+	roomRaw := query.Get("room")
+
+	if roomRaw == "" {
+		w.WriteHeader(400)
+		return
+	}
+
+	room, err := uuid.Parse(roomRaw)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	claims, ok := GetClaimsFromRequest(r)
+	if !ok {
+		log.WithFields(log.Fields{}).Errorln("unable to read claims from request")
+		w.WriteHeader(500)
+		return
+	}
+
+	userID, err := uuid.Parse(claims.ID)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	members, err := roomQueryEngine.ListRoomMembers(room)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+
+	if !internal.ContainsUUID(members, userID) {
+		w.WriteHeader(403)
+		return
+	}
+
+	// Get optional query parameters from and to
+	if fromRaw := query.Get("from"); fromRaw != "" {
+		from, err := time.Parse(time.RFC3339Nano, fromRaw)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+
+		to, err := time.Parse(time.RFC3339Nano, query.Get("to"))
+		if err != nil {
+			to = time.Now()
+		}
+
+		messages, err := messageQueryEngine.QueryMessages(room, from, to)
+		if err != nil {
+			w.WriteHeader(500)
+			return
+		}
+
+		if err := attachMessageDetails(messages, userID); err != nil {
+			w.WriteHeader(500)
+			return
+		}
+
+		internal.SerializeResponse(w, &ListMessagesResponse{messages})
+		return
+	}
+
+	cursor, limit, err := parsePageParams(query, room)
+	if err != nil {
+		writePageError(w, err)
+		return
+	}
+
+	page, err := messageQueryEngine.QueryMessagePage(room, cursor, limit)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+
+	if err := attachMessageDetails(page.Messages, userID); err != nil {
+		w.WriteHeader(500)
+		return
+	}
+
+	internal.SerializeResponse(w, page)
+}
+
+// HandleMessageReplies returns a page of the replies to a message, oldest first. Pages are requested
+// with the same parameters as HandleMessageGet
+func HandleMessageReplies(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	messageID, err := uuid.Parse(p.ByName("id"))
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	claims, ok := GetClaimsFromRequest(r)
+	if !ok {
+		log.WithFields(log.Fields{}).Errorln("unable to read claims from request")
+		w.WriteHeader(500)
+		return
+	}
+
+	userID, err := uuid.Parse(claims.ID)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	parent, err := messageQueryEngine.GetMessage(messageID)
+	if err != nil {
+		writeMessageUpdateError(w, err)
+		return
+	}
+
+	members, err := roomQueryEngine.ListRoomMembers(parent.RoomID)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+
+	if !internal.ContainsUUID(members, userID) {
+		w.WriteHeader(403)
+		return
+	}
+
+	cursor, limit, err := parsePageParams(r.URL.Query(), parent.RoomID)
+	if err != nil {
+		writePageError(w, err)
+		return
+	}
+
+	page, err := messageQueryEngine.QueryReplyPage(messageID, cursor, limit)
 	if err != nil {
 		w.WriteHeader(500)
 		return
 	}
 
-	// Create possibly encrypted message payload
-	encoded, err := (&internal.Message{
-		ID:        id,
-		RoomID:    roomID,
-		UserID:    userID,
-		Timestamp: now,
-		Content:   req.Message,
-	}).Encode()
+	if err := attachMessageDetails(page.Messages, userID); err != nil {
+		w.WriteHeader(500)
+		return
+	}
+
+	internal.SerializeResponse(w, page)
+}
+
+var invalidLimitError = errors.New("invalid page limit")
+
+// parsePageParams reads the cursor and limit of a page of the room's messages from the query. The cursor
+// is nil if the page starts from the beginning
+func parsePageParams(query url.Values, room uuid.UUID) (*internal.MessageCursor, int, error) {
+	limit := internal.DefaultPageSize
+	if limitRaw := query.Get("limit"); limitRaw != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitRaw); err != nil || limit <= 0 {
+			return nil, 0, invalidLimitError
+		}
+	}
+
+	var (
+		cursor *internal.MessageCursor
+		err    error
+	)
+	switch {
+	case query.Get("cursor") != "":
+		cursor, err = internal.DecodeMessageCursor(query.Get("cursor"))
+	case query.Get("before") != "":
+		cursor, err = messageCursorAt(room, query.Get("before"), true)
+	case query.Get("after") != "":
+		cursor, err = messageCursorAt(room, query.Get("after"), false)
+	}
+
+	return cursor, limit, err
+}
+
+// writePageError writes the status code for an error returned by parsePageParams
+func writePageError(w http.ResponseWriter, err error) {
+	switch err {
+	case internal.NoMatchingMessageError:
+		w.WriteHeader(404)
+	case internal.InvalidCursorError, invalidLimitError:
+		w.WriteHeader(400)
+	default:
+		w.WriteHeader(500)
+	}
+}
+
+// messageCursorAt returns a cursor positioned at the message with the ID in raw, which must be in the room
+// unless room is uuid.Nil
+func messageCursorAt(room uuid.UUID, raw string, before bool) (*internal.MessageCursor, error) {
+	messageID, err := uuid.Parse(raw)
 	if err != nil {
+		return nil, internal.InvalidCursorError
+	}
+
+	if room == uuid.Nil {
+		message, err := messageQueryEngine.GetMessage(messageID)
+		if err != nil {
+			return nil, err
+		}
+		room = message.RoomID
+	}
+	return messageQueryEngine.CursorAt(room, messageID, before)
+}
+
+// attachMessageDetails sets the reactions, quotes, attachments and mentions of messages read for userID
+func attachMessageDetails(messages []internal.Message, userID uuid.UUID) error {
+	if err := messageQueryEngine.AttachReactions(messages, userID); err != nil {
+		return err
+	}
+	if err := messageQueryEngine.AttachQuotes(messages); err != nil {
+		return err
+	}
+	if err := attachmentQueryEngine.AttachAttachments(messages); err != nil {
+		return err
+	}
+	return messageQueryEngine.AttachMentions(messages)
+}
+
+// HandleMentionsGet returns a page of the messages mentioning the user in any room, newest first
+func HandleMentionsGet(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	claims, ok := GetClaimsFromRequest(r)
+	if !ok {
+		log.WithFields(log.Fields{}).Errorln("unable to read claims from request")
+		w.WriteHeader(500)
+		return
+	}
+
+	userID, err := uuid.Parse(claims.ID)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	cursor, limit, err := parsePageParams(r.URL.Query(), uuid.Nil)
+	if err != nil {
+		writePageError(w, err)
+		return
+	}
+
+	page, err := messageQueryEngine.QueryMentionPage(userID, cursor, limit)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+
+	if err := attachMessageDetails(page.Messages, userID); err != nil {
+		w.WriteHeader(500)
+		return
+	}
+
+	internal.SerializeResponse(w, page)
+}
+
+type MessageEditRequest struct {
+	Message string `json:"message"`
+}
+
+// writeMessageUpdateError writes the status code for an error returned when editing or deleting a message
+func writeMessageUpdateError(w http.ResponseWriter, err error) {
+	switch err {
+	case internal.NoMatchingMessageError:
+		w.WriteHeader(404)
+	case internal.MessageDeletedError:
+		w.WriteHeader(410)
+	case internal.NotMessageEditorError, internal.UnverifiedAccountError:
+		w.WriteHeader(403)
+	default:
+		w.WriteHeader(500)
+	}
+}
+
+// HandleMessageEdit replaces the content of a message. Only the author and the room's admins may edit it
+func HandleMessageEdit(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer r.Body.Close()
+
+	messageID, err := uuid.Parse(p.ByName("id"))
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	req := &MessageEditRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(req); err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
-		})
+		}).Warnln("unable to decode request body")
+		w.WriteHeader(400)
+		return
+	}
+
+	claims, ok := GetClaimsFromRequest(r)
+	if !ok {
+		log.WithFields(log.Fields{}).Errorln("unable to read claims from request")
 		w.WriteHeader(500)
 		return
 	}
 
-	if err := courierConns.BroadcastMessage(r.Context(), internal.FilterUUID(members, userID), encoded); err != nil {
-		log.WithFields(log.Fields{
-			"err":       err,
-			"messageID": id,
-			"userID":    userID,
-		}).Warnln("unable to broadcast message")
+	userID, err := uuid.Parse(claims.ID)
+	if err != nil {
+		w.WriteHeader(400)
+		return
 	}
-	_, _ = w.Write(encoded)
-}
 
-type ListMessagesResponse struct {
-	Messages []internal.Message `json:"messages"`
+	message, err := messagePoster.Edit(r.Context(), messageID, userID, req.Message)
+	if err != nil {
+		writeMessageUpdateError(w, err)
+		return
+	}
+
+	internal.SerializeResponse(w, message)
 }
 
-func HandleMessageGet(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	// Get required query parameters from and to
-	fromRaw := r.URL.Query().Get("from")
-	toRaw := r.URL.Query().Get("to")
-	roomRaw := r.URL.Query().Get("room")
+// HandleMessageDelete soft deletes a message. Only the author and the room's admins may delete it
+func HandleMessageDelete(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	messageID, err := uuid.Parse(p.ByName("id"))
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
 
-	if fromRaw == "" {
+	claims, ok := GetClaimsFromRequest(r)
+	if !ok {
+		log.WithFields(log.Fields{}).Errorln("unable to read claims from request")
+		w.WriteHeader(500)
+		return
+	}
+
+	userID, err := uuid.Parse(claims.ID)
+	if err != nil {
 		w.WriteHeader(400)
 		return
 	}
 
-	if roomRaw == "" {
+	message, err := messagePoster.Delete(r.Context(), messageID, userID)
+	if err != nil {
+		writeMessageUpdateError(w, err)
+		return
+	}
+
+	internal.SerializeResponse(w, message)
+}
+
+type ListMessageEditsResponse struct {
+	Edits []internal.MessageEdit `json:"edits"`
+}
+
+// HandleMessageEdits returns the previous versions of a message to members of its room
+func HandleMessageEdits(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	messageID, err := uuid.Parse(p.ByName("id"))
+	if err != nil {
 		w.WriteHeader(400)
 		return
 	}
 
-	from, err := time.Parse(time.RFC3339Nano, fromRaw)
+	claims, ok := GetClaimsFromRequest(r)
+	if !ok {
+		log.WithFields(log.Fields{}).Errorln("unable to read claims from request")
+		w.WriteHeader(500)
+		return
+	}
+
+	userID, err := uuid.Parse(claims.ID)
 	if err != nil {
 		w.WriteHeader(400)
 		return
 	}
 
-	to, err := time.Parse(time.RFC3339Nano, toRaw)
+	message, err := messageQueryEngine.GetMessage(messageID)
 	if err != nil {
-		to = time.Now()
+		writeMessageUpdateError(w, err)
+		return
 	}
 
-	room, err := uuid.Parse(roomRaw)
+	members, err := roomQueryEngine.ListRoomMembers(message.RoomID)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+
+	if !internal.ContainsUUID(members, userID) {
+		w.WriteHeader(403)
+		return
+	}
+
+	// The history of a deleted message is hidden along with its content
+	if message.DeletedAt != nil {
+		w.WriteHeader(410)
+		return
+	}
+
+	edits, err := messageQueryEngine.ListMessageEdits(messageID)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+
+	internal.SerializeResponse(w, &ListMessageEditsResponse{edits})
+}
+
+type ReactionRequest struct {
+	Reaction string `json:"reaction"`
+}
+
+// HandleReactionAdd adds the user's reaction to a message. A request without a reaction likes the message
+func HandleReactionAdd(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer r.Body.Close()
+
+	req := &ReactionRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(req); err != nil && err != io.EOF {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warnln("unable to decode request body")
+		w.WriteHeader(400)
+		return
+	}
+
+	handleReaction(w, r, p.ByName("id"), req.Reaction, true)
+}
+
+// HandleReactionRemove removes the user's reaction to a message
+func HandleReactionRemove(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	handleReaction(w, r, p.ByName("id"), p.ByName("reaction"), false)
+}
+
+func handleReaction(w http.ResponseWriter, r *http.Request, rawMessageID, rawReaction string, add bool) {
+	messageID, err := uuid.Parse(rawMessageID)
 	if err != nil {
 		w.WriteHeader(400)
 		return
 	}
 
-	messages, err := messageQueryEngine.QueryMessages(room, from, to)
+	reaction, err := internal.NormalizeReaction(rawReaction)
 	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	claims, ok := GetClaimsFromRequest(r)
+	if !ok {
+		log.WithFields(log.Fields{}).Errorln("unable to read claims from request")
 		w.WriteHeader(500)
 		return
 	}
 
-	internal.SerializeResponse(w, &ListMessagesResponse{messages})
+	userID, err := uuid.Parse(claims.ID)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	event, err := messagePoster.React(r.Context(), messageID, userID, reaction, add)
+	if err != nil {
+		if err == internal.NotRoomMemberError {
+			w.WriteHeader(403)
+		} else {
+			writeMessageUpdateError(w, err)
+		}
+		return
+	}
+
+	internal.SerializeResponse(w, event)
 }
 
 func AddMessageRoutes(prefix string, router *httprouter.Router) {
 	router.POST(prefix+"/message", JWTGuard(HandleMessagePost))
 	router.GET(prefix+"/message", JWTGuard(HandleMessageGet))
+	router.PATCH(prefix+"/message/:id", JWTGuard(HandleMessageEdit))
+	router.DELETE(prefix+"/message/:id", JWTGuard(HandleMessageDelete))
+	router.GET(prefix+"/message/:id/edits", JWTGuard(HandleMessageEdits))
+	router.GET(prefix+"/message/:id/replies", JWTGuard(HandleMessageReplies))
+	router.GET(prefix+"/mentions", JWTGuard(HandleMentionsGet))
+	router.POST(prefix+"/message/:id/reactions", JWTGuard(HandleReactionAdd))
+	router.DELETE(prefix+"/message/:id/reactions/:reaction", JWTGuard(HandleReactionRemove))
 }
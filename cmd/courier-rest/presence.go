@@ -0,0 +1,78 @@
+package main
+
+import (
+	"github.com/david-wiles/groupme-clone/internal"
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+)
+
+// maxPresenceUsers is the maximum number of users whose presence can be requested at once
+const maxPresenceUsers = 100
+
+type ListPresenceResponse struct {
+	Presence []internal.Presence `json:"presence"`
+}
+
+// HandlePresenceGet returns the presence of each user in the comma separated users query parameter. Only
+// the presence of the user's contacts, the users sharing a room with them, and their own can be requested
+func HandlePresenceGet(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	claims, ok := GetClaimsFromRequest(r)
+	if !ok {
+		log.WithFields(log.Fields{}).Errorln("unable to read claims from request")
+		w.WriteHeader(500)
+		return
+	}
+
+	userID, err := uuid.Parse(claims.ID)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+
+	usersRaw := r.URL.Query().Get("users")
+	if usersRaw == "" {
+		w.WriteHeader(400)
+		return
+	}
+
+	split := strings.Split(usersRaw, ",")
+	if len(split) > maxPresenceUsers {
+		w.WriteHeader(400)
+		return
+	}
+
+	contacts, err := roomQueryEngine.ListContacts(userID)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+
+	users := make([]uuid.UUID, len(split))
+	for i, raw := range split {
+		requested, err := uuid.Parse(strings.TrimSpace(raw))
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		if requested != userID && !internal.ContainsUUID(contacts, requested) {
+			w.WriteHeader(403)
+			return
+		}
+		users[i] = requested
+	}
+
+	presence, err := presenceEngine.GetPresence(r.Context(), users)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+
+	internal.SerializeResponse(w, &ListPresenceResponse{presence})
+}
+
+func AddPresenceRoutes(prefix string, router *httprouter.Router) {
+	router.GET(prefix+"/presence", JWTGuard(HandlePresenceGet))
+}
@@ -43,6 +43,17 @@ func HandleCreateRoom(w http.ResponseWriter, r *http.Request, _ httprouter.Param
 		return
 	}
 
+	if requireVerified {
+		if err := accountQueryEngine.RequireVerified(parsedUserID); err != nil {
+			if err == internal.UnverifiedAccountError {
+				w.WriteHeader(403)
+			} else {
+				w.WriteHeader(500)
+			}
+			return
+		}
+	}
+
 	var room *internal.Room
 	if req.IsDm && req.Recipient != "" {
 		recipientID, err := uuid.Parse(req.Recipient)
@@ -158,7 +169,7 @@ func HandleListRoomMembers(w http.ResponseWriter, r *http.Request, p httprouter.
 }
 
 type ListRoomsResponse struct {
-	Rooms []internal.Room `json:"rooms"`
+	Rooms []internal.JoinedRoom `json:"rooms"`
 }
 
 func HandleListRooms(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -175,7 +186,7 @@ func HandleListRooms(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 		return
 	}
 
-	rooms, err := roomQueryEngine.GetJoinedRooms(parsedUserID)
+	rooms, err := roomQueryEngine.GetJoinedRoomsWithUnread(parsedUserID)
 	if err != nil {
 		w.WriteHeader(500)
 		return
@@ -187,11 +198,117 @@ func HandleListRooms(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 	}
 }
 
+type MarkReadRequest struct {
+	MessageID string `json:"messageId"`
+}
+
+// HandleMarkRead marks the room read up to the message in the request, and returns the user's read receipt
+func HandleMarkRead(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer r.Body.Close()
+
+	roomID, err := uuid.Parse(p.ByName("id"))
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	req := &MarkReadRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(req); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warnln("unable to decode request body")
+		w.WriteHeader(400)
+		return
+	}
+
+	messageID, err := uuid.Parse(req.MessageID)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	claims, ok := GetClaimsFromRequest(r)
+	if !ok {
+		log.WithFields(log.Fields{}).Errorln("unable to read claims from request")
+		w.WriteHeader(500)
+		return
+	}
+
+	userID, err := uuid.Parse(claims.ID)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+
+	receipt, err := messagePoster.MarkRead(r.Context(), roomID, userID, messageID)
+	if err != nil {
+		switch err {
+		case internal.NoMatchingMessageError:
+			w.WriteHeader(404)
+		case internal.NotRoomMemberError:
+			w.WriteHeader(403)
+		default:
+			w.WriteHeader(500)
+		}
+		return
+	}
+
+	internal.SerializeResponse(w, receipt)
+}
+
+type ListReadReceiptsResponse struct {
+	Receipts []internal.ReadReceipt `json:"receipts"`
+}
+
+// HandleListReadReceipts returns the last message read by each member of the room
+func HandleListReadReceipts(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	roomID, err := uuid.Parse(p.ByName("id"))
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	claims, ok := GetClaimsFromRequest(r)
+	if !ok {
+		log.WithFields(log.Fields{}).Errorln("unable to read claims from request")
+		w.WriteHeader(500)
+		return
+	}
+
+	userID, err := uuid.Parse(claims.ID)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+
+	members, err := roomQueryEngine.ListRoomMembers(roomID)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+
+	if !internal.ContainsUUID(members, userID) {
+		w.WriteHeader(403)
+		return
+	}
+
+	receipts, err := roomQueryEngine.ListReadReceipts(roomID)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+
+	internal.SerializeResponse(w, &ListReadReceiptsResponse{receipts})
+}
+
 func AddRoomRoutes(prefix string, router *httprouter.Router) {
 	router.POST(prefix+"/room", JWTGuard(HandleCreateRoom))
 	//router.PATCH("/room/:id", HandleUpdateRoom)
 	router.GET(prefix+"/room/:id", JWTGuard(HandleGetRoom))
 	router.POST(prefix+"/room/:id/join", JWTGuard(HandleJoinRoom))
 	router.GET(prefix+"/room/:id/members", JWTGuard(HandleListRoomMembers))
+	router.POST(prefix+"/room/:id/read", JWTGuard(HandleMarkRead))
+	router.GET(prefix+"/room/:id/receipts", JWTGuard(HandleListReadReceipts))
 	router.GET(prefix+"/room", JWTGuard(HandleListRooms))
 }
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"github.com/david-wiles/groupme-clone/internal"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+)
+
+// HandleCourierStats returns the state of the pool of connections to courier nodes
+func HandleCourierStats(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	internal.SerializeResponse(w, courierConns.Stats())
+}
+
+// AddStatusRoutes adds the status routes, which are only served on the admin address since they describe
+// the service's internals
+func AddStatusRoutes(prefix string, router *httprouter.Router) {
+	router.GET(prefix+"/status/couriers", HandleCourierStats)
+}
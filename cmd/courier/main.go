@@ -2,16 +2,23 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"errors"
 	"github.com/david-wiles/groupme-clone/internal"
+	"github.com/david-wiles/groupme-clone/pkg"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	_ "github.com/lib/pq"
 	"github.com/redis/go-redis/v9"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -26,9 +33,34 @@ var (
 	// The address that the websocket server will be listening on
 	websocketListenAddress string
 
+	// The address that the admin server, which reports the hub's stats, will be listening on. The admin
+	// server isn't started if it isn't set, and must not be reachable by clients
+	adminListenAddress string
+
 	registrationEngine internal.RegistrationEngine
 
+	deliveryQueue internal.DeliveryQueue
+
+	replayBuffer internal.ReplayBuffer
+
+	presenceEngine internal.PresenceEngine
+
+	// messagePoster is used to post messages sent by clients over the websocket. Clients can only send
+	// messages and typing indicators over the websocket if POSTGRES_URI is configured
+	messagePoster *internal.MessagePoster
+
 	jwtSecret []byte
+
+	// How often connections are pinged and how long they may go without a pong before being closed
+	pingInterval = internal.DefaultPingInterval
+	pongWait     = internal.DefaultPongWait
+
+	// How often users whose webhooks expired are marked offline
+	presenceSweepInterval = internal.DefaultPresenceSweepInterval
+
+	// Flate level used for compressed messages, and the minimum message size in bytes to compress
+	compressionLevel     = internal.DefaultCompressionLevel
+	compressionThreshold = internal.DefaultCompressionThreshold
 )
 
 func init() {
@@ -42,6 +74,7 @@ func init() {
 	hostname = internal.MustGetEnv("HOSTNAME")
 	grpcListenAddress = internal.MustGetEnv("GRPC_LISTEN_ADDRESS")
 	websocketListenAddress = internal.MustGetEnv("WEBSOCKET_LISTEN_ADDRESS")
+	adminListenAddress, _ = os.LookupEnv("ADMIN_LISTEN_ADDRESS")
 	jwtSecret = []byte(internal.MustGetEnv("JWT_SECRET"))
 
 	// Initiate Redis connection
@@ -51,13 +84,131 @@ func init() {
 		Addr: redisAddr,
 	})
 
-	registrationEngine = internal.RegistrationEngine{rdb}
+	var err error
+
+	if raw, ok := os.LookupEnv("PING_INTERVAL"); ok {
+		if pingInterval, err = time.ParseDuration(raw); err != nil {
+			panic(err)
+		}
+	}
+	if raw, ok := os.LookupEnv("PONG_WAIT"); ok {
+		if pongWait, err = time.ParseDuration(raw); err != nil {
+			panic(err)
+		}
+	}
+	if pingInterval >= pongWait {
+		panic("PING_INTERVAL must be shorter than PONG_WAIT")
+	}
+
+	if raw, ok := os.LookupEnv("COMPRESSION_LEVEL"); ok {
+		if compressionLevel, err = strconv.Atoi(raw); err != nil {
+			panic(err)
+		}
+	}
+	if raw, ok := os.LookupEnv("COMPRESSION_THRESHOLD"); ok {
+		if compressionThreshold, err = strconv.Atoi(raw); err != nil {
+			panic(err)
+		}
+	}
+	if err := internal.ValidateCompression(compressionLevel, compressionThreshold); err != nil {
+		panic(err)
+	}
+
+	// Unacknowledged messages are kept for redelivery for DELIVERY_RETENTION
+	retention := internal.DefaultDeliveryRetention
+	if raw, ok := os.LookupEnv("DELIVERY_RETENTION"); ok {
+		if retention, err = time.ParseDuration(raw); err != nil {
+			panic(err)
+		}
+	}
+
+	deliveryQueue = internal.RedisDeliveryQueue{
+		Client:    rdb,
+		Retention: retention,
+	}
+
+	// The most recent REPLAY_BUFFER_SIZE messages sent to each user are kept for resuming sessions
+	replaySize := int64(internal.DefaultReplayBufferSize)
+	if raw, ok := os.LookupEnv("REPLAY_BUFFER_SIZE"); ok {
+		if replaySize, err = strconv.ParseInt(raw, 10, 64); err != nil {
+			panic(err)
+		}
+	}
+
+	replayBuffer = internal.RedisReplayBuffer{
+		Client:    rdb,
+		Size:      replaySize,
+		Retention: retention,
+	}
+
+	if raw, ok := os.LookupEnv("PRESENCE_SWEEP_INTERVAL"); ok {
+		if presenceSweepInterval, err = time.ParseDuration(raw); err != nil {
+			panic(err)
+		}
+	}
+
+	// Connected users without any activity for PRESENCE_IDLE_AFTER are idle
+	idleAfter := internal.DefaultIdleAfter
+	if raw, ok := os.LookupEnv("PRESENCE_IDLE_AFTER"); ok {
+		if idleAfter, err = time.ParseDuration(raw); err != nil {
+			panic(err)
+		}
+	}
+
+	presenceEngine = internal.PresenceEngine{
+		Client:    rdb,
+		IdleAfter: idleAfter,
+	}
+
+	if connection, ok := os.LookupEnv("POSTGRES_URI"); ok {
+		db, err := sql.Open("postgres", connection)
+		if err != nil {
+			panic(err)
+		}
+
+		if err = db.Ping(); err != nil {
+			panic(err)
+		}
+
+		conns := internal.NewCourierConnCache(rdb)
+		conns.SetDeliveryQueue(deliveryQueue, replayBuffer)
+
+		messagePoster = &internal.MessagePoster{
+			Rooms:       internal.RoomQueryEngine{DB: db},
+			Messages:    internal.MessageQueryEngine{DB: db},
+			Attachments: internal.AttachmentQueryEngine{DB: db},
+			Conns:       conns,
+			Unfurler:    internal.NewUnfurler(rdb),
+			Accounts:    internal.AccountQueryEngine{DB: db},
+		}
+
+		// REQUIRE_VERIFIED_EMAIL must match the REST service's configuration
+		if raw, ok := os.LookupEnv("REQUIRE_VERIFIED_EMAIL"); ok {
+			if messagePoster.RequireVerified, err = strconv.ParseBool(raw); err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	// Webhooks expire shortly after a connection stops responding to heartbeats
+	registrationEngine = internal.RegistrationEngine{
+		Client: rdb,
+		TTL:    2 * pongWait,
+	}
 }
 
 func main() {
 	upgrader := websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
+
+		// Subprotocols is left unset, since the upgrader would prefer the order of its own list over the
+		// client's. The negotiated subprotocol is set in the response header instead
+		Subprotocols: nil,
+
+		// Negotiate permessage-deflate, whether each message is compressed depends on its size
+		EnableCompression: true,
+
 		// Do not commit, just testing
 		CheckOrigin: func(r *http.Request) bool {
 			return true
@@ -65,14 +216,40 @@ func main() {
 	}
 
 	mux := http.NewServeMux()
-	hub := internal.NewHub(hostname, registrationEngine)
+	hub := internal.NewHub(hostname, registrationEngine, deliveryQueue, replayBuffer)
+	hub.PingInterval = pingInterval
+	hub.PongWait = pongWait
+	hub.CompressionLevel = compressionLevel
+	hub.CompressionThreshold = compressionThreshold
+
+	// Presence changes can only be pushed to contacts if the courier can read room memberships
+	if messagePoster != nil {
+		notifier := internal.PresenceNotifier{Rooms: messagePoster.Rooms, Conns: messagePoster.Conns}
+		hub.TrackPresence(presenceEngine, presenceSweepInterval, notifier.Notify)
+	} else {
+		hub.TrackPresence(presenceEngine, presenceSweepInterval, nil)
+	}
+
+	if messagePoster != nil {
+		hub.HandleFrame(pkg.FrameSendMessage, internal.SendMessageHandler(*messagePoster))
+		hub.HandleFrame(pkg.FrameReadReceipt, internal.ReadReceiptHandler(*messagePoster))
 
-	var opts []grpc.ServerOption
+		typing := internal.NewTypingIndicators(messagePoster.Rooms, messagePoster.Conns)
+		hub.HandleFrame(pkg.FrameTyping, internal.TypingHandler(typing))
+	}
+
+	// The REST service pings idle connections to notice nodes which died, which the server would otherwise
+	// reject as too frequent
+	opts := []grpc.ServerOption{
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             internal.CourierKeepaliveInterval / 2,
+			PermitWithoutStream: true,
+		}),
+	}
 	grpcServer := grpc.NewServer(opts...)
 	lis, err := net.Listen("tcp", grpcListenAddress)
 	if err != nil {
 		panic(err)
-		return
 	}
 
 	go func() {
@@ -86,7 +263,40 @@ func main() {
 	internal.RegisterCourierServer(grpcServer, &internal.CourierServerImpl{Hub: hub})
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		conn, err := upgrader.Upgrade(w, r, nil)
+		// Clients which request subprotocols must request at least one supported version, and are given the
+		// first one they requested which is supported. Only clients which don't request any may choose the
+		// encoding with ?encoding=protobuf
+		var (
+			serializer pkg.Serializer = pkg.JSONSerializer{}
+			header     http.Header
+		)
+		if requested := websocket.Subprotocols(r); len(requested) > 0 {
+			subprotocol, ok := internal.NegotiateSubprotocol(requested)
+			if !ok {
+				http.Error(w, "unsupported subprotocol, supported: "+strings.Join(internal.SupportedSubprotocols, ", "), 400)
+				return
+			}
+			serializer, _ = internal.SerializerForSubprotocol(subprotocol)
+			header = http.Header{"Sec-Websocket-Protocol": {subprotocol}}
+		} else {
+			switch r.URL.Query().Get("encoding") {
+			case "", "json":
+			case "protobuf":
+				serializer = internal.ProtobufSerializer{}
+			default:
+				http.Error(w, "unsupported encoding, supported: json, protobuf", 400)
+				return
+			}
+		}
+
+		connOpts, err := connectionOptions(r, hub.ConnectionOptions())
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		connOpts.Serializer = serializer
+
+		conn, err := upgrader.Upgrade(w, r, header)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"err": err,
@@ -97,6 +307,7 @@ func main() {
 		// Require JWT within 30 seconds of opening websocket
 		claims, err := awaitJWT(r.Context(), conn, 30*time.Second)
 		if err != nil {
+			_ = conn.Close()
 			return
 		}
 
@@ -106,42 +317,113 @@ func main() {
 				"err": err,
 				"id":  claims.ID,
 			}).Warnln("unable to parse UUID from claims")
+			_ = conn.Close()
+			return
+		}
+
+		// The client must say where to resume from before it starts receiving messages
+		resume, err := awaitResume(r.Context(), conn, serializer, 30*time.Second)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+				"id":  claims.ID,
+			}).Warnln("unable to read resume request")
+			_ = conn.Close()
 			return
 		}
 
-		ws := hub.RegisterConnection(id, conn)
+		ws := hub.RegisterConnection(id, conn, connOpts, resume.LastSeq)
 		log.WithFields(log.Fields{
-			"id": ws.ID,
+			"id":      ws.ID,
+			"lastSeq": resume.LastSeq,
 		}).Infoln("registering new websocket")
 	})
 
+	if adminListenAddress != "" {
+		go serveAdmin(hub)
+	}
+
+	// Connections count the bytes written to them so websockets can report their compression savings
+	wsLis, err := net.Listen("tcp", websocketListenAddress)
+	if err != nil {
+		panic(err)
+	}
+
 	log.Infoln("listening on 8080")
-	if err := http.ListenAndServe(websocketListenAddress, mux); err != nil {
+	if err := http.Serve(internal.CountingListener{Listener: wsLis}, mux); err != nil {
 		panic(err)
 	}
 
 	grpcServer.GracefulStop()
 }
 
+// connectionOptions applies the compression settings requested by the client to the hub's defaults.
+// Clients may set ?compressionThreshold to any size, and ?compressionLevel up to the hub's level so
+// that they can't make the courier spend more CPU on their connection than configured
+func connectionOptions(r *http.Request, defaults internal.ConnectionOptions) (internal.ConnectionOptions, error) {
+	opts := defaults
+	query := r.URL.Query()
+
+	if raw := query.Get("compressionLevel"); raw != "" {
+		level, err := strconv.Atoi(raw)
+		if err != nil || level > defaults.CompressionLevel {
+			return opts, internal.InvalidCompressionError
+		}
+		opts.CompressionLevel = level
+	}
+	if raw := query.Get("compressionThreshold"); raw != "" {
+		threshold, err := strconv.Atoi(raw)
+		if err != nil {
+			return opts, internal.InvalidCompressionError
+		}
+		opts.CompressionThreshold = threshold
+	}
+
+	return opts, internal.ValidateCompression(opts.CompressionLevel, opts.CompressionThreshold)
+}
+
+// serveAdmin serves the hub's stats on the admin address
+func serveAdmin(hub *internal.Hub) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(hub.Stats()); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Errorln("unable to write stats")
+		}
+	})
+
+	log.Infoln("admin listening on " + adminListenAddress)
+	if err := http.ListenAndServe(adminListenAddress, mux); err != nil {
+		panic(err)
+	}
+}
+
+// awaitJWT reads the client's JWT, which must be sent within timeout. The caller must close the connection
+// if an error is returned
 func awaitJWT(ctx context.Context, conn *websocket.Conn, timeout time.Duration) (c internal.ClaimData, err error) {
 	ctxWithTimeout, cancel := context.WithTimeout(ctx, timeout)
-	authorized := make(chan *internal.ClaimData)
+	authorized := make(chan *internal.ClaimData, 1)
 
 	defer cancel()
 
+	// The deadline stops the read if the client never sends anything, so the goroutine doesn't outlive
+	// the connection
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return c, err
+	}
+
 	go func() {
 		if _, bytes, err := conn.ReadMessage(); err == nil {
 			if token, err := internal.VerifyJWT(string(bytes), jwtSecret); err == nil {
-				claims, ok := internal.GetClaimsFromToken(token)
-				if ok {
+				if claims, ok := internal.GetClaimsFromToken(token); ok {
 					authorized <- &claims
-				} else {
-					authorized <- nil
+					return
 				}
 			}
 		}
 		authorized <- nil
-		close(authorized)
 	}()
 
 	select {
@@ -155,3 +437,38 @@ func awaitJWT(ctx context.Context, conn *websocket.Conn, timeout time.Duration)
 		}
 	}
 }
+
+// awaitResume reads the client's resume request, which must be sent within timeout. The caller must close
+// the connection if an error is returned
+func awaitResume(ctx context.Context, conn *websocket.Conn, serializer pkg.Serializer, timeout time.Duration) (r pkg.ClientResume, err error) {
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, timeout)
+	received := make(chan *pkg.ClientResume, 1)
+
+	defer cancel()
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return r, err
+	}
+
+	go func() {
+		if _, bytes, err := conn.ReadMessage(); err == nil {
+			resume := &pkg.ClientResume{}
+			if err := serializer.Deserialize(bytes, resume); err == nil {
+				received <- resume
+				return
+			}
+		}
+		received <- nil
+	}()
+
+	select {
+	case <-ctxWithTimeout.Done():
+		return r, ctxWithTimeout.Err()
+	case resume := <-received:
+		if resume != nil {
+			return *resume, nil
+		} else {
+			return r, errors.New("unable to read resume request")
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"errors"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -11,19 +12,61 @@ type Account struct {
 	ID       uuid.UUID `json:"id,omitempty"`
 	Username string    `json:"username,omitempty"`
 	Email    string    `json:"email,omitempty"`
+
+	// DisplayName is shown in place of the username if it is set
+	DisplayName string `json:"displayName,omitempty"`
+
+	// The avatar is either an image attachment uploaded by the user, or an external image
+	AvatarAttachment *uuid.UUID `json:"avatarAttachment,omitempty"`
+	AvatarURL        string     `json:"avatarUrl,omitempty"`
+
+	Bio    string `json:"bio,omitempty"`
+	Status string `json:"status,omitempty"`
+
+	// Verified is set once the user has confirmed they own the email address
+	Verified bool `json:"verified"`
+}
+
+// Profile is the part of an account which is shared with other users
+type Profile struct {
+	ID               uuid.UUID  `json:"id"`
+	Username         string     `json:"username"`
+	DisplayName      string     `json:"displayName,omitempty"`
+	AvatarAttachment *uuid.UUID `json:"avatarAttachment,omitempty"`
+	AvatarURL        string     `json:"avatarUrl,omitempty"`
+	Bio              string     `json:"bio,omitempty"`
+	Status           string     `json:"status,omitempty"`
+}
+
+func (account *Account) Profile() *Profile {
+	return &Profile{
+		ID:               account.ID,
+		Username:         account.Username,
+		DisplayName:      account.DisplayName,
+		AvatarAttachment: account.AvatarAttachment,
+		AvatarURL:        account.AvatarURL,
+		Bio:              account.Bio,
+		Status:           account.Status,
+	}
 }
 
 type AccountQueryEngine struct {
 	*sql.DB
 }
 
-var NoMatchingUserError = errors.New("no matching user account found")
+var (
+	NoMatchingUserError = errors.New("no matching user account found")
+	AccountExistsError  = errors.New("an account with the username or email already exists")
+)
 
 // CreateAccount makes a new account, saves into the database, and returns a struct representing the object
 func (db AccountQueryEngine) CreateAccount(username, email, pass string) (*Account, error) {
 	id := uuid.New()
 	stmt := `INSERT INTO "accounts" ("id", "username", "email", "hashed_pass") VALUES ($1, $2, $3, $4);`
 	if _, err := db.Exec(stmt, id, username, email, pass); err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == uniqueViolation {
+			return nil, AccountExistsError
+		}
 		log.WithFields(log.Fields{
 			"err":      err,
 			"username": username,
@@ -39,84 +82,50 @@ func (db AccountQueryEngine) CreateAccount(username, email, pass string) (*Accou
 	}, nil
 }
 
-func (db AccountQueryEngine) GetAccountByUsername(username string) (*Account, error) {
-	stmt := `SELECT "id", "username", "email", "hashed_pass" FROM "accounts" WHERE "username" = $1;`
-	if row := db.QueryRow(stmt, username); row != nil {
-		var (
-			id         string
-			username   string
-			email      string
-			hashedPass string
-		)
-
-		if err := row.Scan(&id, &username, &email, &hashedPass); err != nil {
-			if err != sql.ErrNoRows {
-				log.WithFields(log.Fields{
-					"err": err,
-				}).Errorln("unable to scan account row")
-				return nil, err
-			} else {
-				return nil, NoMatchingUserError
-			}
-		}
+// accountColumns are the columns of the accounts table read by scanAccount, in order
+const accountColumns = `"id", "username", "email", "display_name", "avatar_attachment", "avatar_url", "bio", "status_text", "email_verified_at" IS NOT NULL`
 
-		parsedID, err := uuid.Parse(id)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"err": err,
-				"id":  id,
-			}).Errorln("unable to parse uuid")
-			return nil, err
-		}
-
-		return &Account{
-			ID:       parsedID,
-			Username: username,
-			Email:    email,
-		}, nil
+func scanAccount(row rowScanner) (*Account, error) {
+	account := &Account{}
+	var (
+		displayName, avatarURL, bio, status sql.NullString
+		avatarAttachment                    uuid.NullUUID
+	)
+	if err := row.Scan(&account.ID, &account.Username, &account.Email, &displayName, &avatarAttachment, &avatarURL, &bio, &status, &account.Verified); err != nil {
+		return nil, err
 	}
 
-	return nil, NoMatchingUserError
+	account.DisplayName = displayName.String
+	account.AvatarURL = avatarURL.String
+	account.Bio = bio.String
+	account.Status = status.String
+	if avatarAttachment.Valid {
+		account.AvatarAttachment = &avatarAttachment.UUID
+	}
+	return account, nil
 }
 
-func (db AccountQueryEngine) GetAccount(id uuid.UUID) (*Account, error) {
-	stmt := `SELECT "id", "username", "email", "hashed_pass" FROM "accounts" WHERE "id" = $1;`
-	if row := db.QueryRow(stmt, id); row != nil {
-		var (
-			id         string
-			username   string
-			email      string
-			hashedPass string
-		)
-
-		if err := row.Scan(&id, &username, &email, &hashedPass); err != nil {
-			if err != sql.ErrNoRows {
-				log.WithFields(log.Fields{
-					"err": err,
-				}).Errorln("unable to scan account row")
-				return nil, err
-			} else {
-				return nil, NoMatchingUserError
-			}
-		}
-
-		parsedID, err := uuid.Parse(id)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"err": err,
-				"id":  id,
-			}).Errorln("unable to parse uuid")
-			return nil, err
+func (db AccountQueryEngine) getAccount(filter string, arg interface{}) (*Account, error) {
+	stmt := `SELECT ` + accountColumns + ` FROM "accounts" WHERE ` + filter + `;`
+	account, err := scanAccount(db.QueryRow(stmt, arg))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, NoMatchingUserError
 		}
-
-		return &Account{
-			ID:       parsedID,
-			Username: username,
-			Email:    email,
-		}, nil
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Errorln("unable to scan account row")
+		return nil, err
 	}
+	return account, nil
+}
 
-	return nil, NoMatchingUserError
+func (db AccountQueryEngine) GetAccountByUsername(username string) (*Account, error) {
+	return db.getAccount(`"username" = $1`, username)
+}
+
+func (db AccountQueryEngine) GetAccount(id uuid.UUID) (*Account, error) {
+	return db.getAccount(`"id" = $1`, id)
 }
 
 func (db AccountQueryEngine) VerifyPassword(username, password string) (bool, error) {
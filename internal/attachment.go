@@ -0,0 +1,422 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	NoMatchingAttachmentError     = errors.New("no matching attachment found")
+	AttachmentTooLargeError       = errors.New("attachment is too large")
+	UnsupportedContentTypeError   = errors.New("attachment content type is not supported")
+	InvalidMessageAttachmentError = errors.New("attachments must be uploaded by the author and not used by another message")
+)
+
+// Attachment is a file uploaded by a user, which is referenced by at most one message
+type Attachment struct {
+	ID          uuid.UUID  `json:"id"`
+	UserID      uuid.UUID  `json:"userId"`
+	MessageID   *uuid.UUID `json:"messageId,omitempty"`
+	Filename    string     `json:"filename,omitempty"`
+	ContentType string     `json:"contentType"`
+	Size        int64      `json:"size"`
+	Timestamp   time.Time  `json:"timestamp"`
+
+	// Width, Height, DurationMs and Variants are set by the MediaProcessor once ProcessedAt is set, for
+	// the media types it supports
+	Width       *int                `json:"width,omitempty"`
+	Height      *int                `json:"height,omitempty"`
+	DurationMs  *int64              `json:"durationMs,omitempty"`
+	Variants    []AttachmentVariant `json:"variants,omitempty"`
+	ProcessedAt *time.Time          `json:"processedAt,omitempty"`
+}
+
+// AttachmentVariant is a file derived from an attachment, such as a thumbnail, stored next to it
+type AttachmentVariant struct {
+	Name        string `json:"name"`
+	ContentType string `json:"contentType"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	Size        int64  `json:"size"`
+}
+
+// BlobKey is the key of the attachment's contents in the BlobStore
+func (attachment *Attachment) BlobKey() string {
+	return "attachments/" + attachment.ID.String()
+}
+
+// VariantKey is the key of one of the attachment's variants in the BlobStore
+func (attachment *Attachment) VariantKey(name string) string {
+	return attachment.BlobKey() + "-" + name
+}
+
+// Variant returns the attachment's variant with the name, or nil if there isn't one
+func (attachment *Attachment) Variant(name string) *AttachmentVariant {
+	for i := range attachment.Variants {
+		if attachment.Variants[i].Name == name {
+			return &attachment.Variants[i]
+		}
+	}
+	return nil
+}
+
+// AttachmentPolicy restricts the attachments users may upload
+type AttachmentPolicy struct {
+	// MaxSize is the largest attachment allowed, in bytes
+	MaxSize int64
+
+	// ContentTypes are the media types allowed
+	ContentTypes map[string]bool
+}
+
+// DefaultAttachmentPolicy allows common image, video and audio formats up to 25MB
+var DefaultAttachmentPolicy = AttachmentPolicy{
+	MaxSize: 25 << 20,
+	ContentTypes: map[string]bool{
+		"image/jpeg": true,
+		"image/png":  true,
+		"image/gif":  true,
+		"video/mp4":  true,
+		"video/webm": true,
+		"audio/mpeg": true,
+		"audio/ogg":  true,
+		"audio/wave": true,
+	},
+}
+
+// detectedContentTypes maps the types http.DetectContentType returns to the types of the policy, where
+// they differ. Ogg files are detected as application/ogg, and only Ogg audio is expected
+var detectedContentTypes = map[string]string{
+	"application/ogg": "audio/ogg",
+}
+
+// sniffLength is the number of bytes http.DetectContentType considers
+const sniffLength = 512
+
+// Validate checks the size of an upload and detects its content type from its contents, rather than
+// trusting the type declared by the client. The returned reader must be used in place of r, since the
+// start of the upload has been read
+func (policy AttachmentPolicy) Validate(r io.Reader, size int64) (contentType string, body io.Reader, err error) {
+	if size <= 0 || size > policy.MaxSize {
+		return "", nil, AttachmentTooLargeError
+	}
+
+	buffered := bufio.NewReaderSize(r, sniffLength)
+	head, err := buffered.Peek(sniffLength)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return "", nil, err
+	}
+
+	contentType, _, err = mime.ParseMediaType(http.DetectContentType(head))
+	if mapped, ok := detectedContentTypes[contentType]; ok {
+		contentType = mapped
+	}
+	if err != nil || !policy.ContentTypes[contentType] {
+		return "", nil, UnsupportedContentTypeError
+	}
+
+	// The upload may be longer than it claims, never store more than the declared size
+	return contentType, io.LimitReader(buffered, size), nil
+}
+
+// SanitizeFilename returns the base name of a client supplied filename, without any directories or
+// control characters
+func SanitizeFilename(filename string) string {
+	filename = path.Base(strings.ReplaceAll(filename, "\\", "/"))
+	filename = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, filename)
+
+	if filename == "." || filename == "/" {
+		return ""
+	}
+	if runes := []rune(filename); len(runes) > 255 {
+		filename = string(runes[:255])
+	}
+	return filename
+}
+
+type AttachmentQueryEngine struct {
+	*sql.DB
+}
+
+// attachmentColumns are the columns of the attachments table read by scanAttachment, in order
+const attachmentColumns = `"id", "account_id", "message_id", "filename", "content_type", "size", "ts", "width", "height", "duration_ms", "variants", "processed_at"`
+
+func scanAttachment(row rowScanner) (*Attachment, error) {
+	attachment := &Attachment{}
+	var (
+		messageID     uuid.NullUUID
+		width, height sql.NullInt32
+		durationMs    sql.NullInt64
+		variants      []byte
+		processedAt   sql.NullTime
+	)
+	if err := row.Scan(&attachment.ID, &attachment.UserID, &messageID, &attachment.Filename, &attachment.ContentType, &attachment.Size, &attachment.Timestamp,
+		&width, &height, &durationMs, &variants, &processedAt); err != nil {
+		return nil, err
+	}
+
+	if messageID.Valid {
+		attachment.MessageID = &messageID.UUID
+	}
+	if width.Valid && height.Valid {
+		w, h := int(width.Int32), int(height.Int32)
+		attachment.Width, attachment.Height = &w, &h
+	}
+	if durationMs.Valid {
+		attachment.DurationMs = &durationMs.Int64
+	}
+	if len(variants) > 0 {
+		if err := json.Unmarshal(variants, &attachment.Variants); err != nil {
+			return nil, err
+		}
+	}
+	if processedAt.Valid {
+		attachment.ProcessedAt = &processedAt.Time
+	}
+	return attachment, nil
+}
+
+// CreateAttachment records an uploaded attachment which isn't referenced by a message yet
+func (db AttachmentQueryEngine) CreateAttachment(attachment *Attachment) error {
+	stmt := `INSERT INTO "attachments" ("id", "account_id", "filename", "content_type", "size", "ts") VALUES ($1, $2, $3, $4, $5, $6);`
+	if _, err := db.Exec(stmt, attachment.ID, attachment.UserID, attachment.Filename, attachment.ContentType, attachment.Size, attachment.Timestamp); err != nil {
+		log.WithFields(log.Fields{
+			"err":    err,
+			"userID": attachment.UserID,
+		}).Errorln("unable to insert attachment into database")
+		return err
+	}
+	return nil
+}
+
+func (db AttachmentQueryEngine) GetAttachment(id uuid.UUID) (*Attachment, error) {
+	stmt := `SELECT ` + attachmentColumns + ` FROM "attachments" WHERE "id" = $1;`
+	attachment, err := scanAttachment(db.QueryRow(stmt, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, NoMatchingAttachmentError
+		}
+		log.WithFields(log.Fields{
+			"err": err,
+			"id":  id,
+		}).Errorln("unable to query attachment")
+		return nil, err
+	}
+	return attachment, nil
+}
+
+// LinkAttachments makes the attachments part of a message and returns them. Every attachment must have
+// been uploaded by userID and not be part of another message or the user's avatar, otherwise
+// InvalidMessageAttachmentError is returned and the transaction should be rolled back
+func (db AttachmentQueryEngine) LinkAttachments(tx *sql.Tx, messageID, userID uuid.UUID, ids []uuid.UUID) ([]Attachment, error) {
+	raw := make([]string, len(ids))
+	for i, id := range ids {
+		raw[i] = id.String()
+	}
+
+	stmt := `UPDATE "attachments" SET "message_id" = $1 WHERE "id" = ANY($2::uuid[]) AND "account_id" = $3 AND "message_id" IS NULL
+		AND NOT EXISTS (SELECT 1 FROM "accounts" WHERE "avatar_attachment" = "attachments"."id") RETURNING ` + attachmentColumns + `;`
+	rows, err := tx.Query(stmt, messageID, pq.Array(raw), userID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"messageID": messageID,
+		}).Errorln("unable to link attachments")
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := []Attachment{}
+	for rows.Next() {
+		attachment, err := scanAttachment(rows)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Errorln("unable to scan row")
+			return nil, err
+		}
+		attachments = append(attachments, *attachment)
+	}
+
+	if len(attachments) != len(ids) {
+		return nil, InvalidMessageAttachmentError
+	}
+	return attachments, nil
+}
+
+// AttachAttachments sets the attachments of each message. Attachments of deleted messages are not returned
+func (db AttachmentQueryEngine) AttachAttachments(messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(messages))
+	byID := make(map[uuid.UUID]*Message, len(messages))
+	for i := range messages {
+		ids[i] = messages[i].ID.String()
+		byID[messages[i].ID] = &messages[i]
+	}
+
+	stmt := `SELECT ` + attachmentColumns + ` FROM "attachments" WHERE "message_id" = ANY($1::uuid[]) ORDER BY "ts";`
+	rows, err := db.Query(stmt, pq.Array(ids))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Errorln("unable to query attachments")
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		attachment, err := scanAttachment(rows)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Errorln("unable to scan row")
+			return err
+		}
+
+		if message, ok := byID[*attachment.MessageID]; ok && message.DeletedAt == nil {
+			message.Attachments = append(message.Attachments, *attachment)
+		}
+	}
+
+	return nil
+}
+
+// AttachmentStore validates uploads and stores them in a BlobStore
+type AttachmentStore struct {
+	Attachments AttachmentQueryEngine
+	Blobs       BlobStore
+	Policy      AttachmentPolicy
+
+	// Media queues uploads for the MediaProcessor, if it is set
+	Media *MediaQueue
+}
+
+// Upload validates and stores an attachment uploaded by userID. size is the size of the upload claimed
+// by the client
+func (store AttachmentStore) Upload(ctx context.Context, userID uuid.UUID, filename string, r io.Reader, size int64) (*Attachment, error) {
+	contentType, body, err := store.Policy.Validate(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	attachment := &Attachment{
+		ID:          uuid.New(),
+		UserID:      userID,
+		Filename:    SanitizeFilename(filename),
+		ContentType: contentType,
+		Size:        size,
+		Timestamp:   time.Now(),
+	}
+
+	if err := store.Blobs.Put(ctx, attachment.BlobKey(), body, BlobInfo{ContentType: contentType, Size: size}); err != nil {
+		log.WithFields(log.Fields{
+			"err":    err,
+			"userID": userID,
+		}).Errorln("unable to store attachment")
+		return nil, err
+	}
+
+	if err := store.Attachments.CreateAttachment(attachment); err != nil {
+		_ = store.Blobs.Delete(ctx, attachment.BlobKey())
+		return nil, err
+	}
+
+	// The attachment can be used without its metadata, so failing to queue it isn't fatal
+	if store.Media != nil {
+		if err := store.Media.Enqueue(ctx, MediaJob{AttachmentID: attachment.ID}); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+				"id":  attachment.ID,
+			}).Warnln("unable to queue attachment for processing")
+		}
+	}
+
+	return attachment, nil
+}
+
+// Open returns the contents of an attachment
+func (store AttachmentStore) Open(ctx context.Context, attachment *Attachment) (io.ReadCloser, *BlobInfo, error) {
+	return store.Blobs.Get(ctx, attachment.BlobKey())
+}
+
+// OpenVariant returns the contents of one of an attachment's variants, or NoMatchingBlobError if it
+// doesn't have the variant
+func (store AttachmentStore) OpenVariant(ctx context.Context, attachment *Attachment, name string) (io.ReadCloser, *AttachmentVariant, error) {
+	variant := attachment.Variant(name)
+	if variant == nil {
+		return nil, nil, NoMatchingBlobError
+	}
+
+	body, _, err := store.Blobs.Get(ctx, attachment.VariantKey(name))
+	if err != nil {
+		return nil, nil, err
+	}
+	return body, variant, nil
+}
+
+// createWithAttachments inserts a message along with its attachments in a single transaction, so that a
+// message is never created with only some of its attachments
+func (poster MessagePoster) createWithAttachments(userID uuid.UUID, ts time.Time, draft MessageDraft) (uuid.UUID, []Attachment, error) {
+	ids := uniqueUUIDs(draft.Attachments)
+
+	tx, err := poster.Messages.Begin()
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+
+	id, err := createMessage(tx, draft.RoomID, userID, ts, draft.Content, draft.ReplyTo)
+	var attachments []Attachment
+	if err == nil {
+		attachments, err = poster.Attachments.LinkAttachments(tx, id, userID, ids)
+	}
+	if err != nil {
+		if err := tx.Rollback(); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Errorln("unable to rollback transaction")
+		}
+		return uuid.Nil, nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Errorln("unable to commit transaction")
+		return uuid.Nil, nil, err
+	}
+
+	return id, attachments, nil
+}
+
+// uniqueUUIDs returns ids without duplicates, in their original order
+func uniqueUUIDs(ids []uuid.UUID) []uuid.UUID {
+	seen := make(map[uuid.UUID]bool, len(ids))
+	unique := make([]uuid.UUID, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestAttachmentPolicyValidate(t *testing.T) {
+	wav := append([]byte("RIFF\x24\x00\x00\x00WAVEfmt "), make([]byte, 32)...)
+	mp4 := append([]byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"), make([]byte, 32)...)
+
+	tests := []struct {
+		name        string
+		data        []byte
+		size        int64
+		contentType string
+		err         error
+	}{
+		{"jpeg", []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00"), 0, "image/jpeg", nil},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), 0, "image/png", nil},
+		{"gif", []byte("GIF89a\x01\x00\x01\x00"), 0, "image/gif", nil},
+		{"mp4", mp4, 0, "video/mp4", nil},
+		{"webm", []byte("\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01"), 0, "video/webm", nil},
+		{"mp3", []byte("ID3\x03\x00\x00\x00\x00\x00\x00"), 0, "audio/mpeg", nil},
+		{"ogg is detected as application/ogg", []byte("OggS\x00\x02\x00\x00\x00\x00"), 0, "audio/ogg", nil},
+		{"wav", wav, 0, "audio/wave", nil},
+		{"text", []byte("just some text"), 0, "", UnsupportedContentTypeError},
+		{"html", []byte("<html><body>hi</body></html>"), 0, "", UnsupportedContentTypeError},
+		{"empty", []byte{}, 0, "", AttachmentTooLargeError},
+		{"too large", []byte("GIF89a"), DefaultAttachmentPolicy.MaxSize + 1, "", AttachmentTooLargeError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			size := test.size
+			if size == 0 {
+				size = int64(len(test.data))
+			}
+
+			contentType, body, err := DefaultAttachmentPolicy.Validate(bytes.NewReader(test.data), size)
+			if err != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if contentType != test.contentType {
+				t.Errorf("got content type %q, want %q", contentType, test.contentType)
+			}
+
+			read, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(read, test.data) {
+				t.Errorf("body was not read in full")
+			}
+		})
+	}
+}
+
+func TestAttachmentPolicyValidateLimitsBodyToSize(t *testing.T) {
+	data := []byte("GIF89a\x01\x00\x01\x00 and then some more")
+
+	_, body, err := DefaultAttachmentPolicy.Validate(bytes.NewReader(data), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 10 {
+		t.Errorf("read %d bytes, want the declared 10", len(read))
+	}
+}
@@ -2,11 +2,16 @@ package internal
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"github.com/golang-jwt/jwt"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/bcrypt"
 	"net/http"
+	"net/url"
 )
 
 func HashPassword(pass string) (string, error) {
@@ -23,7 +28,7 @@ func HashPassword(pass string) (string, error) {
 func ComparePasswordWithHash(hash, pass string) (bool, error) {
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass))
 	if err != nil {
-		if err != bcrypt.ErrMismatchedHashAndPassword {
+		if err == bcrypt.ErrMismatchedHashAndPassword {
 			return false, nil
 		}
 		return false, err
@@ -31,6 +36,42 @@ func ComparePasswordWithHash(hash, pass string) (bool, error) {
 	return true, nil
 }
 
+// secretTokenBytes is the number of random bytes in a token generated by newSecretToken
+const secretTokenBytes = 32
+
+// newSecretToken returns a random token which can be sent to a user to prove they received it, such as a
+// password reset token
+func newSecretToken() (string, error) {
+	raw := make([]byte, secretTokenBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// hashSecretToken returns the digest of a token which is stored in place of the token, so that tokens
+// can't be read from the database. Tokens are random, so a plain SHA-256 digest is enough
+func hashSecretToken(token string) string {
+	digest := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(digest[:])
+}
+
+// tokenLink returns the URL of a client page with the token as its token query parameter, or an empty
+// string if the page isn't set
+func tokenLink(page, token string) string {
+	if page == "" {
+		return ""
+	}
+	u, err := url.Parse(page)
+	if err != nil {
+		return ""
+	}
+	query := u.Query()
+	query.Set("token", token)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
 type ClaimData struct {
 	ID       string
 	Username string
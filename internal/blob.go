@@ -0,0 +1,320 @@
+package internal
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	NoMatchingBlobError = errors.New("no matching blob found")
+	InvalidBlobKeyError = errors.New("invalid blob key")
+)
+
+// BlobInfo describes a stored blob
+type BlobInfo struct {
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+}
+
+// BlobStore stores the contents of attachments and their derived files. Keys are slash separated paths
+type BlobStore interface {
+	// Put stores size bytes read from r under key, replacing any existing blob
+	Put(ctx context.Context, key string, r io.Reader, info BlobInfo) error
+
+	// Get returns a reader for the blob stored under key, which must be closed by the caller.
+	// NoMatchingBlobError is returned if there is no such blob
+	Get(ctx context.Context, key string) (io.ReadCloser, *BlobInfo, error)
+
+	// Delete removes the blob stored under key, if there is one
+	Delete(ctx context.Context, key string) error
+}
+
+// validBlobKey returns false for keys which could escape the store's root
+func validBlobKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// FileBlobStore stores blobs as files under Root. The BlobInfo of each blob is kept in a sidecar file
+// next to it
+type FileBlobStore struct {
+	Root string
+}
+
+const blobInfoSuffix = ".info.json"
+
+func (store FileBlobStore) path(key string) (string, error) {
+	if !validBlobKey(key) {
+		return "", InvalidBlobKeyError
+	}
+	return filepath.Join(store.Root, filepath.FromSlash(key)), nil
+}
+
+func (store FileBlobStore) Put(_ context.Context, key string, r io.Reader, info BlobInfo) error {
+	path, err := store.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	// Blobs are written to a temporary file first so that readers never see a partial blob
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	info.Size = written
+
+	encoded, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+blobInfoSuffix, encoded, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (store FileBlobStore) Get(_ context.Context, key string) (io.ReadCloser, *BlobInfo, error) {
+	path, err := store.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encoded, err := os.ReadFile(path + blobInfoSuffix)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, NoMatchingBlobError
+		}
+		return nil, nil, err
+	}
+
+	info := &BlobInfo{}
+	if err := json.Unmarshal(encoded, info); err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, NoMatchingBlobError
+		}
+		return nil, nil, err
+	}
+
+	return f, info, nil
+}
+
+func (store FileBlobStore) Delete(_ context.Context, key string) error {
+	path, err := store.path(key)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range []string{path, path + blobInfoSuffix} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// S3BlobStore stores blobs in a bucket of an S3 compatible service, such as MinIO. Requests use path
+// style addressing and are signed with AWS Signature Version 4, so Endpoint may be any host serving the
+// S3 api, including a local stand-in
+type S3BlobStore struct {
+	// Endpoint is the base URL of the service, e.g. https://s3.us-east-1.amazonaws.com
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+
+	// Client is used to send requests, http.DefaultClient is used if it is nil
+	Client *http.Client
+}
+
+func (store S3BlobStore) client() *http.Client {
+	if store.Client != nil {
+		return store.Client
+	}
+	return http.DefaultClient
+}
+
+// S3Error is returned for requests which the service responds to with an unexpected status
+type S3Error struct {
+	Status int
+	Body   string
+}
+
+func (err *S3Error) Error() string {
+	return fmt.Sprintf("s3 request failed with status %d: %s", err.Status, err.Body)
+}
+
+func (store S3BlobStore) Put(ctx context.Context, key string, r io.Reader, info BlobInfo) error {
+	res, err := store.do(ctx, http.MethodPut, key, r, info)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return readS3Error(res)
+	}
+	return nil
+}
+
+func (store S3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, *BlobInfo, error) {
+	res, err := store.do(ctx, http.MethodGet, key, nil, BlobInfo{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.Body, &BlobInfo{ContentType: res.Header.Get("Content-Type"), Size: res.ContentLength}, nil
+	case http.StatusNotFound:
+		res.Body.Close()
+		return nil, nil, NoMatchingBlobError
+	default:
+		defer res.Body.Close()
+		return nil, nil, readS3Error(res)
+	}
+}
+
+func (store S3BlobStore) Delete(ctx context.Context, key string) error {
+	res, err := store.do(ctx, http.MethodDelete, key, nil, BlobInfo{})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return readS3Error(res)
+	}
+	return nil
+}
+
+func readS3Error(res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	return &S3Error{Status: res.StatusCode, Body: string(body)}
+}
+
+// do sends a signed request for the object stored under key. The payload is not signed, so that uploads
+// can be streamed without buffering them
+func (store S3BlobStore) do(ctx context.Context, method, key string, body io.Reader, info BlobInfo) (*http.Response, error) {
+	if !validBlobKey(key) {
+		return nil, InvalidBlobKeyError
+	}
+
+	endpoint, err := url.Parse(store.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + "/" + store.Bucket + "/" + key
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	if method == http.MethodPut {
+		req.ContentLength = info.Size
+		req.Header.Set("Content-Type", info.ContentType)
+	}
+
+	store.sign(req, time.Now().UTC())
+	return store.client().Do(req)
+}
+
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// sign adds an AWS Signature Version 4 Authorization header to the request
+func (store S3BlobStore) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	headers := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	values := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": unsignedPayload,
+		"x-amz-date":           amzDate,
+	}
+	if contentType := req.Header.Get("Content-Type"); contentType != "" {
+		headers = []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+		values["content-type"] = contentType
+	}
+	if req.ContentLength > 0 {
+		headers = append([]string{"content-length"}, headers...)
+		values["content-length"] = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, header := range headers {
+		canonicalHeaders.WriteString(header + ":" + strings.TrimSpace(values[header]) + "\n")
+	}
+	signedHeaders := strings.Join(headers, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+
+	scope := date + "/" + store.Region + "/s3/aws4_request"
+	digest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	key := hmacSHA256([]byte("AWS4"+store.SecretKey), date)
+	key = hmacSHA256(key, store.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+store.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
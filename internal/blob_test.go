@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is an in-memory stand-in for the object api of an S3 compatible service
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]fakeS3Object
+}
+
+type fakeS3Object struct {
+	contentType string
+	data        []byte
+}
+
+func (s3 *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") ||
+		r.Header.Get("X-Amz-Date") == "" || r.Header.Get("X-Amz-Content-Sha256") != unsignedPayload {
+		http.Error(w, "unsigned request", http.StatusForbidden)
+		return
+	}
+
+	s3.mu.Lock()
+	defer s3.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil || int64(len(data)) != r.ContentLength {
+			http.Error(w, "short body", http.StatusBadRequest)
+			return
+		}
+		s3.objects[r.URL.Path] = fakeS3Object{r.Header.Get("Content-Type"), data}
+	case http.MethodGet:
+		object, ok := s3.objects[r.URL.Path]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", object.contentType)
+		_, _ = w.Write(object.data)
+	case http.MethodDelete:
+		delete(s3.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// testBlobStore runs Put, Get and Delete against a store
+func testBlobStore(t *testing.T, store BlobStore) {
+	ctx := context.Background()
+	data := "not really a png"
+
+	if err := store.Put(ctx, "user/blob", strings.NewReader(data), BlobInfo{ContentType: "image/png", Size: int64(len(data))}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	body, info, err := store.Get(ctx, "user/blob")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	read, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(read) != data {
+		t.Errorf("got %q, want %q", read, data)
+	}
+	if info.ContentType != "image/png" || info.Size != int64(len(data)) {
+		t.Errorf("got info %+v", info)
+	}
+
+	if err := store.Delete(ctx, "user/blob"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, _, err := store.Get(ctx, "user/blob"); err != NoMatchingBlobError {
+		t.Errorf("got %v after delete, want NoMatchingBlobError", err)
+	}
+
+	// Deleting a blob which doesn't exist is not an error
+	if err := store.Delete(ctx, "user/blob"); err != nil {
+		t.Errorf("delete of a missing blob: %v", err)
+	}
+
+	for _, key := range []string{"", "/abs", "../escape", "a/../b", "a//b", "a\\b"} {
+		if err := store.Put(ctx, key, strings.NewReader(data), BlobInfo{Size: int64(len(data))}); err != InvalidBlobKeyError {
+			t.Errorf("put %q: got %v, want InvalidBlobKeyError", key, err)
+		}
+	}
+}
+
+func TestFileBlobStore(t *testing.T) {
+	testBlobStore(t, FileBlobStore{Root: t.TempDir()})
+}
+
+func TestS3BlobStore(t *testing.T) {
+	s3 := &fakeS3{objects: make(map[string]fakeS3Object)}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	testBlobStore(t, S3BlobStore{
+		Endpoint:  server.URL,
+		Bucket:    "attachments",
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+		Client:    server.Client(),
+	})
+}
+
+func TestS3BlobStoreReportsErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "SlowDown", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	store := S3BlobStore{Endpoint: server.URL, Bucket: "attachments", Region: "us-east-1", Client: server.Client()}
+	err := store.Put(context.Background(), "key", strings.NewReader("data"), BlobInfo{Size: 4})
+
+	s3Err, ok := err.(*S3Error)
+	if !ok || s3Err.Status != http.StatusServiceUnavailable {
+		t.Fatalf("got %v, want an S3Error with status 503", err)
+	}
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"net"
+	"sync/atomic"
+)
+
+var InvalidCompressionError = errors.New("compression level must be between 0 and 9, and threshold at least 0")
+
+const (
+	// DefaultCompressionLevel is the flate compression level used for compressed messages
+	DefaultCompressionLevel = 1
+
+	// DefaultCompressionThreshold is the size in bytes below which messages are sent uncompressed,
+	// since compressing small messages costs CPU without saving much bandwidth
+	DefaultCompressionThreshold = 512
+)
+
+// CountingListener wraps a net.Listener so that every accepted connection counts the bytes written to
+// it. Websockets upgraded from these connections can report how many bytes were actually sent over the
+// wire, which is used to measure the savings of permessage-deflate compression.
+type CountingListener struct {
+	net.Listener
+}
+
+func (l CountingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	written atomic.Uint64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) bytesWritten() uint64 {
+	return c.written.Load()
+}
+
+// CompressionStats reports the bytes written to a websocket. Uncompressed is the total size of the
+// serialized messages, Wire is the number of bytes actually sent over the connection, including framing
+// and control frames such as pings, pongs and close frames
+type CompressionStats struct {
+	Uncompressed uint64 `json:"uncompressed"`
+	Wire         uint64 `json:"wire"`
+}
+
+// ValidateCompression returns InvalidCompressionError unless level is a flate level and threshold a
+// message size
+func ValidateCompression(level, threshold int) error {
+	if level < 0 || level > 9 || threshold < 0 {
+		return InvalidCompressionError
+	}
+	return nil
+}
+
+// ConnectionStats describes the compression of a single websocket
+type ConnectionStats struct {
+	ID                   uuid.UUID `json:"id"`
+	UserID               uuid.UUID `json:"userId"`
+	CompressionLevel     int       `json:"compressionLevel"`
+	CompressionThreshold int       `json:"compressionThreshold"`
+	CompressionStats
+}
+
+// HubStats describes the websockets connected to a hub. Closed totals the bytes written to websockets
+// which have since been closed, so that the savings of short-lived connections are still counted
+type HubStats struct {
+	Connections []ConnectionStats `json:"connections"`
+	Closed      CompressionStats  `json:"closed"`
+}
@@ -3,6 +3,11 @@ package internal
 import (
 	"context"
 	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"sync"
 )
 
 type CourierServerImpl struct {
@@ -19,8 +24,151 @@ func (courier *CourierServerImpl) SendMessage(ctx context.Context, request *Mess
 
 	err = courier.Hub.SendMessage(ctx, id, request.Payload)
 	if err != nil {
+		// A missing websocket is reported as NotFound so that callers know the webhook is stale
+		if err == WebsocketNotFoundError {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
 		return nil, err
 	}
 
 	return &MessageResponse{}, nil
 }
+
+// BroadcastMessage sends the payload to every websocket in the request concurrently, waiting for each
+// client to acknowledge the message, and reports the result of each delivery
+func (courier *CourierServerImpl) BroadcastMessage(ctx context.Context, request *BroadcastRequest) (*BroadcastResponse, error) {
+	results := make([]*DeliveryResult, len(request.Uuids))
+
+	var wg sync.WaitGroup
+	for i, raw := range request.Uuids {
+		wg.Add(1)
+		go func(i int, raw string) {
+			defer wg.Done()
+
+			result := &DeliveryResult{Uuid: raw, Status: DeliveryStatus_DELIVERED}
+			results[i] = result
+
+			id, err := uuid.Parse(raw)
+			if err != nil {
+				result.Status = DeliveryStatus_NOT_FOUND
+				result.Error = err.Error()
+				return
+			}
+
+			if err := courier.Hub.SendMessage(ctx, id, request.Payload); err != nil {
+				result.Status = DeliveryStatus_FAILED
+				if err == WebsocketNotFoundError {
+					result.Status = DeliveryStatus_NOT_FOUND
+				}
+				result.Error = err.Error()
+			}
+		}(i, raw)
+	}
+	wg.Wait()
+
+	return &BroadcastResponse{Results: results}, nil
+}
+
+// Deliver receives deliveries over a long-lived stream and sends the result of each recipient's delivery
+// back as an event once the client acknowledges it or the acknowledgement times out. Deliveries are sent
+// asynchronously, so many can be in flight on a single stream. When the caller closes its side of the
+// stream, the events of outstanding deliveries are sent before the stream is closed
+func (courier *CourierServerImpl) Deliver(stream Courier_DeliverServer) error {
+	ctx := stream.Context()
+
+	events := make(chan *DeliveryEvent, 256)
+	sent := make(chan struct{})
+
+	// Streams do not support concurrent sends, so events are sent from a single goroutine
+	go func() {
+		defer close(sent)
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				if err := stream.Send(event); err != nil {
+					log.WithFields(log.Fields{
+						"err": err,
+					}).Warnln("unable to send delivery event")
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	emit := func(event *DeliveryEvent) {
+		select {
+		case events <- event:
+		case <-ctx.Done():
+		}
+	}
+
+	var outstanding sync.WaitGroup
+	for {
+		delivery, err := stream.Recv()
+		if err == io.EOF {
+			outstanding.Wait()
+			close(events)
+			<-sent
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, recipient := range delivery.Recipients {
+			event := &DeliveryEvent{DeliveryId: delivery.Id, Uuid: recipient.Uuid, Status: DeliveryStatus_DELIVERED}
+
+			id, err := uuid.Parse(recipient.Uuid)
+			if err != nil {
+				event.Status = DeliveryStatus_NOT_FOUND
+				event.Error = err.Error()
+				emit(event)
+				continue
+			}
+
+			// Ephemeral deliveries are written to the websocket without waiting for an acknowledgement
+			if delivery.Ephemeral {
+				if err := courier.Hub.SendEvent(id, delivery.Type, delivery.Payload); err != nil {
+					event.Status = DeliveryStatus_FAILED
+					if err == WebsocketNotFoundError {
+						event.Status = DeliveryStatus_NOT_FOUND
+					}
+					event.Error = err.Error()
+				}
+				emit(event)
+				continue
+			}
+
+			// The message was queued for the user by the sender, so it is sent with the cid and sequence
+			// number it was queued with and a failure here is redelivered when the user reconnects
+			outstanding.Add(1)
+			_, err = courier.Hub.SendQueuedMessageAsync(ctx, id, PendingDelivery{
+				Cid:     recipient.Cid,
+				Seq:     recipient.Seq,
+				Type:    delivery.Type,
+				Payload: delivery.Payload,
+			}, func(err error) {
+				defer outstanding.Done()
+				if err != nil {
+					event.Status = DeliveryStatus_FAILED
+					event.Error = err.Error()
+				}
+				emit(event)
+			})
+			if err != nil {
+				outstanding.Done()
+				event.Status = DeliveryStatus_FAILED
+				if err == WebsocketNotFoundError {
+					event.Status = DeliveryStatus_NOT_FOUND
+				}
+				event.Error = err.Error()
+				emit(event)
+			}
+		}
+	}
+}
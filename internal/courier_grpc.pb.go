@@ -23,6 +23,8 @@ const _ = grpc.SupportPackageIsVersion7
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type CourierClient interface {
 	SendMessage(ctx context.Context, in *MessageRequest, opts ...grpc.CallOption) (*MessageResponse, error)
+	BroadcastMessage(ctx context.Context, in *BroadcastRequest, opts ...grpc.CallOption) (*BroadcastResponse, error)
+	Deliver(ctx context.Context, opts ...grpc.CallOption) (Courier_DeliverClient, error)
 }
 
 type courierClient struct {
@@ -42,11 +44,53 @@ func (c *courierClient) SendMessage(ctx context.Context, in *MessageRequest, opt
 	return out, nil
 }
 
+func (c *courierClient) BroadcastMessage(ctx context.Context, in *BroadcastRequest, opts ...grpc.CallOption) (*BroadcastResponse, error) {
+	out := new(BroadcastResponse)
+	err := c.cc.Invoke(ctx, "/internal.Courier/BroadcastMessage", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *courierClient) Deliver(ctx context.Context, opts ...grpc.CallOption) (Courier_DeliverClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Courier_ServiceDesc.Streams[0], "/internal.Courier/Deliver", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &courierDeliverClient{stream}
+	return x, nil
+}
+
+type Courier_DeliverClient interface {
+	Send(*Delivery) error
+	Recv() (*DeliveryEvent, error)
+	grpc.ClientStream
+}
+
+type courierDeliverClient struct {
+	grpc.ClientStream
+}
+
+func (x *courierDeliverClient) Send(m *Delivery) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *courierDeliverClient) Recv() (*DeliveryEvent, error) {
+	m := new(DeliveryEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // CourierServer is the server API for Courier service.
 // All implementations must embed UnimplementedCourierServer
 // for forward compatibility
 type CourierServer interface {
 	SendMessage(context.Context, *MessageRequest) (*MessageResponse, error)
+	BroadcastMessage(context.Context, *BroadcastRequest) (*BroadcastResponse, error)
+	Deliver(Courier_DeliverServer) error
 	mustEmbedUnimplementedCourierServer()
 }
 
@@ -57,6 +101,12 @@ type UnimplementedCourierServer struct {
 func (UnimplementedCourierServer) SendMessage(context.Context, *MessageRequest) (*MessageResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method SendMessage not implemented")
 }
+func (UnimplementedCourierServer) BroadcastMessage(context.Context, *BroadcastRequest) (*BroadcastResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BroadcastMessage not implemented")
+}
+func (UnimplementedCourierServer) Deliver(Courier_DeliverServer) error {
+	return status.Errorf(codes.Unimplemented, "method Deliver not implemented")
+}
 func (UnimplementedCourierServer) mustEmbedUnimplementedCourierServer() {}
 
 // UnsafeCourierServer may be embedded to opt out of forward compatibility for this service.
@@ -88,6 +138,50 @@ func _Courier_SendMessage_Handler(srv interface{}, ctx context.Context, dec func
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Courier_BroadcastMessage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BroadcastRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CourierServer).BroadcastMessage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/internal.Courier/BroadcastMessage",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CourierServer).BroadcastMessage(ctx, req.(*BroadcastRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Courier_Deliver_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(CourierServer).Deliver(&courierDeliverServer{stream})
+}
+
+type Courier_DeliverServer interface {
+	Send(*DeliveryEvent) error
+	Recv() (*Delivery, error)
+	grpc.ServerStream
+}
+
+type courierDeliverServer struct {
+	grpc.ServerStream
+}
+
+func (x *courierDeliverServer) Send(m *DeliveryEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *courierDeliverServer) Recv() (*Delivery, error) {
+	m := new(Delivery)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // Courier_ServiceDesc is the grpc.ServiceDesc for Courier service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -99,7 +193,18 @@ var Courier_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "SendMessage",
 			Handler:    _Courier_SendMessage_Handler,
 		},
+		{
+			MethodName: "BroadcastMessage",
+			Handler:    _Courier_BroadcastMessage_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Deliver",
+			Handler:       _Courier_Deliver_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "courier.proto",
 }
@@ -2,100 +2,333 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
 	log "github.com/sirupsen/logrus"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 	"strings"
+	"time"
 )
 
+var NoActiveWebhookError = errors.New("user has no active webhooks")
+
+// CourierConns sends messages to users through the courier nodes their websockets are connected to.
+// It is safe for concurrent use
 type CourierConns struct {
-	cache  map[string]CourierClient
+	pool   *CourierPool
 	client RegistrationEngine
+
+	// deliveries and replay queue and sequence every acknowledged message for each recipient before it
+	// is sent, so that users who aren't connected receive it when they reconnect
+	deliveries DeliveryQueue
+	replay     ReplayBuffer
 }
 
 func NewCourierConnCache(rdb *redis.Client) *CourierConns {
 	return &CourierConns{
-		cache:  make(map[string]CourierClient),
-		client: RegistrationEngine{rdb},
+		pool:       NewCourierPool(),
+		client:     RegistrationEngine{Client: rdb},
+		deliveries: RedisDeliveryQueue{Client: rdb},
+		replay:     RedisReplayBuffer{Client: rdb},
 	}
 }
 
+// SetDeliveryQueue sets where messages are queued for redelivery and buffered for resuming sessions.
+// They must be the same as the courier nodes', which read them when users connect
+func (conns *CourierConns) SetDeliveryQueue(deliveries DeliveryQueue, replay ReplayBuffer) {
+	conns.deliveries = deliveries
+	conns.replay = replay
+}
+
 func (conns *CourierConns) GetOrCreate(host string) (CourierClient, error) {
-	if conn, ok := conns.cache[host]; ok {
-		return conn, nil
+	return conns.pool.Get(host)
+}
+
+// SetEvictAfter sets how long a connection to a courier node may keep failing before it is evicted
+func (conns *CourierConns) SetEvictAfter(d time.Duration) {
+	conns.pool.SetEvictAfter(d)
+}
+
+// Stats returns the state of the connections to courier nodes
+func (conns *CourierConns) Stats() PoolStats {
+	return conns.pool.Stats()
+}
+
+// Close closes every connection to the courier nodes
+func (conns *CourierConns) Close() {
+	conns.pool.Close()
+}
+
+// RecipientResult is the outcome of broadcasting a message to one user. Delivered is true if at least
+// one of the user's devices acknowledged the message. Queued is true if the message was queued for the
+// user, in which case it is redelivered when they reconnect even if it wasn't delivered
+type RecipientResult struct {
+	UserID    uuid.UUID `json:"userId"`
+	Delivered bool      `json:"delivered"`
+	Queued    bool      `json:"queued"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// broadcastTarget is a single websocket of a user, reachable through a courier node
+type broadcastTarget struct {
+	userID  uuid.UUID
+	webhook string
+	wsID    string
+}
+
+// queue assigns the user a sequence number for the message, buffers it for resuming sessions and adds
+// it to the user's pending deliveries. The queued delivery is returned even if queueing fails, in which
+// case the message is only sent to the user's connected devices
+func (conns *CourierConns) queue(ctx context.Context, userID uuid.UUID, messageType string, message []byte) (PendingDelivery, bool) {
+	delivery := PendingDelivery{
+		Cid:       uuid.New().String(),
+		Type:      messageType,
+		Payload:   message,
+		Timestamp: time.Now(),
 	}
 
-	conn, err := grpc.Dial(host, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	seq, err := conns.replay.Next(ctx, userID)
 	if err != nil {
 		log.WithFields(log.Fields{
-			"err": err,
-		}).Errorln("unable to create GRPC connection")
-		return nil, err
+			"err":    err,
+			"userID": userID,
+		}).Errorln("unable to assign sequence number")
+	} else {
+		delivery.Seq = seq
+		if err := conns.replay.Append(ctx, userID, delivery); err != nil {
+			log.WithFields(log.Fields{
+				"err":    err,
+				"seq":    seq,
+				"userID": userID,
+			}).Errorln("unable to buffer message for replay")
+		}
 	}
 
-	client := NewCourierClient(conn)
-	conns.cache[host] = client
+	if err := conns.deliveries.Push(ctx, userID, delivery); err != nil {
+		log.WithFields(log.Fields{
+			"err":    err,
+			"userID": userID,
+		}).Errorln("unable to queue message for redelivery")
+		return delivery, false
+	}
+	return delivery, true
+}
 
-	return client, nil
+// BroadcastMessage sends message to every device of each user. The message is first queued for each user,
+// whether or not they are connected, so that it is redelivered until one of their devices acknowledges
+// it. Recipients are grouped by the courier node their websockets are connected to, and each node is sent
+// a single delivery over its Deliver stream. Webhooks which a node reports as not found are removed, and
+// the result of the broadcast is returned for each user
+func (conns *CourierConns) BroadcastMessage(ctx context.Context, users []uuid.UUID, message []byte) ([]RecipientResult, error) {
+	return conns.broadcast(ctx, users, &Delivery{Payload: message})
 }
 
-func (conns *CourierConns) SendMessageTo(ctx context.Context, webhook string, message []byte) (bool, error) {
-	splitWebhook := strings.Split(webhook, "/")
-	if len(splitWebhook) != 2 {
-		return false, nil
-	}
+// BroadcastTypedMessage is BroadcastMessage for a message of messageType, such as an edit to a previous
+// message. Like any other message, it is acknowledged by clients and redelivered until it is
+func (conns *CourierConns) BroadcastTypedMessage(ctx context.Context, users []uuid.UUID, messageType string, message []byte) ([]RecipientResult, error) {
+	return conns.broadcast(ctx, users, &Delivery{Payload: message, Type: messageType})
+}
 
-	if conn, err := conns.GetOrCreate(splitWebhook[0]); err == nil {
-		if _, err := conn.SendMessage(ctx, &MessageRequest{
-			Uuid:    splitWebhook[1],
-			Payload: message,
-		}); err != nil {
-			log.WithFields(log.Fields{
-				"err":        err,
-				"host":       splitWebhook[0],
-				"connection": splitWebhook[1],
-			}).Warnln("unable to send message")
-			return true, err
+// BroadcastEvent sends an ephemeral event of eventType to every device of each user. Events are not
+// acknowledged, queued for redelivery, or replayed, so they are only received by devices which are
+// connected when the event is sent. Delivered is true for a user if the event was written to one of
+// their websockets
+func (conns *CourierConns) BroadcastEvent(ctx context.Context, users []uuid.UUID, eventType string, payload []byte) ([]RecipientResult, error) {
+	return conns.broadcast(ctx, users, &Delivery{Payload: payload, Type: eventType, Ephemeral: true})
+}
+
+// broadcast sends a copy of the delivery to each courier node with the recipients connected to that node
+func (conns *CourierConns) broadcast(ctx context.Context, users []uuid.UUID, delivery *Delivery) ([]RecipientResult, error) {
+	// Messages are queued before looking for the users' websockets, so that users who are offline, or
+	// whose websockets can't be reached, still receive the message when they reconnect
+	results := make(map[uuid.UUID]*RecipientResult)
+	queued := make(map[uuid.UUID]PendingDelivery)
+	for _, userID := range users {
+		results[userID] = &RecipientResult{UserID: userID, Error: NoActiveWebhookError.Error()}
+		if !delivery.Ephemeral {
+			queued[userID], results[userID].Queued = conns.queue(ctx, userID, delivery.Type, delivery.Payload)
 		}
 	}
-	return true, nil
-}
 
-func (conns *CourierConns) BroadcastMessage(ctx context.Context, users []uuid.UUID, message []byte) error {
-	webhooks, err := conns.client.ListUsersWebhook(ctx, users)
+	webhooks, err := conns.client.ListUsersWebhooks(ctx, users)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err":   err,
 			"users": users,
 		}).Errorln("unable to list webhooks")
-		return err
+		return nil, err
+	}
+
+	hosts := make(map[string][]broadcastTarget)
+	for userID, userWebhooks := range webhooks {
+		for _, webhook := range userWebhooks {
+			splitWebhook := strings.Split(webhook, "/")
+			if len(splitWebhook) != 2 {
+				conns.removeStaleWebhook(ctx, userID, webhook)
+				continue
+			}
+
+			hosts[splitWebhook[0]] = append(hosts[splitWebhook[0]], broadcastTarget{
+				userID:  userID,
+				webhook: webhook,
+				wsID:    splitWebhook[1],
+			})
+		}
 	}
 
-	for _, webhook := range webhooks {
-		_, _ = conns.SendMessageTo(ctx, webhook, message)
+	// pendingHost is a delivery sent to one courier node which is waiting for its events
+	type pendingHost struct {
+		stream  *deliveryStream
+		id      string
+		events  <-chan *DeliveryEvent
+		targets map[string]broadcastTarget
 	}
-	return nil
+
+	var pending []*pendingHost
+	for host, targets := range hosts {
+		var recipients []*DeliveryRecipient
+		byID := make(map[string]broadcastTarget)
+		for _, target := range targets {
+			// Every device of a user receives the message with the cid and sequence number it was queued with
+			recipients = append(recipients, &DeliveryRecipient{
+				Uuid: target.wsID,
+				Cid:  queued[target.userID].Cid,
+				Seq:  queued[target.userID].Seq,
+			})
+			byID[target.wsID] = target
+		}
+
+		stream, err := conns.pool.Stream(host)
+		var (
+			id     string
+			events <-chan *DeliveryEvent
+		)
+		if err == nil {
+			id, events, err = stream.send(&Delivery{
+				Recipients: recipients,
+				Payload:    delivery.Payload,
+				Type:       delivery.Type,
+				Ephemeral:  delivery.Ephemeral,
+			})
+		}
+
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":  err,
+				"host": host,
+			}).Warnln("unable to broadcast message")
+
+			// The node may only be restarting or briefly unreachable, so its webhooks are left registered.
+			// They are removed once a reachable node reports them as not found, or when they expire
+			for _, target := range targets {
+				results[target.userID].Error = err.Error()
+			}
+			continue
+		}
+
+		pending = append(pending, &pendingHost{stream, id, events, byID})
+	}
+
+	// Events from every node are collected here, rather than holding a goroutine per node. A node whose
+	// connection silently died would never send its events, so the wait is bounded even if ctx isn't
+	waitCtx, cancel := context.WithTimeout(ctx, deliveryEventTimeout)
+	defer cancel()
+
+	for _, host := range pending {
+		for len(host.targets) > 0 {
+			var event *DeliveryEvent
+
+			select {
+			case event = <-host.events:
+			case <-waitCtx.Done():
+			}
+
+			if event == nil {
+				// The wait timed out or the stream closed before every event was received
+				errMsg := StreamClosedError.Error()
+				if waitCtx.Err() != nil {
+					errMsg = DeliveryTimeoutError.Error()
+				}
+				for _, target := range host.targets {
+					if !results[target.userID].Delivered {
+						results[target.userID].Error = errMsg
+					}
+				}
+				break
+			}
+
+			target, found := host.targets[event.Uuid]
+			if !found {
+				continue
+			}
+			delete(host.targets, event.Uuid)
+
+			result := results[target.userID]
+			if result.Delivered {
+				continue
+			}
+
+			switch event.Status {
+			case DeliveryStatus_DELIVERED:
+				result.Delivered = true
+				result.Error = ""
+			case DeliveryStatus_NOT_FOUND:
+				result.Error = event.Error
+				conns.removeStaleWebhook(ctx, target.userID, target.webhook)
+			case DeliveryStatus_DELIVERY_STATUS_UNSPECIFIED:
+				result.Error = UnspecifiedDeliveryStatusError.Error()
+			default:
+				result.Error = event.Error
+			}
+		}
+
+		host.stream.done(host.id)
+	}
+
+	list := make([]RecipientResult, 0, len(users))
+	for _, userID := range users {
+		list = append(list, *results[userID])
+	}
+
+	return list, nil
 }
 
+func (conns *CourierConns) removeStaleWebhook(ctx context.Context, userID uuid.UUID, webhook string) {
+	if err := conns.client.RemoveUserWebhook(ctx, userID, webhook); err != nil {
+		log.WithFields(log.Fields{
+			"err":     err,
+			"userID":  userID,
+			"webhook": webhook,
+		}).Warnln("unable to remove stale webhook")
+	}
+}
+
+// UnicastMessage sends message to every device of a single user. An error is returned if none of the
+// user's devices acknowledged the message, although the message is still redelivered if it was queued
 func (conns *CourierConns) UnicastMessage(ctx context.Context, userID uuid.UUID, message []byte) error {
-	webhook, err := conns.client.GetUserWebhook(ctx, userID)
+	return conns.UnicastTypedMessage(ctx, userID, "", message)
+}
+
+// UnicastTypedMessage is UnicastMessage for a message of messageType
+func (conns *CourierConns) UnicastTypedMessage(ctx context.Context, userID uuid.UUID, messageType string, message []byte) error {
+	results, err := conns.BroadcastTypedMessage(ctx, []uuid.UUID{userID}, messageType, message)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"err":    err,
-			"userID": userID,
-		}).Errorln("unable to get client webhook")
 		return err
 	}
 
-	ok, err := conns.SendMessageTo(ctx, webhook, message)
-	if err != nil {
-		if !ok {
-			_ = conns.client.RemoveUserWebhook(ctx, userID)
-		}
+	// BroadcastTypedMessage returns exactly one result per user
+	result := results[0]
+	if result.Delivered {
+		return nil
+	}
 
-		return err
+	if result.Error == NoActiveWebhookError.Error() {
+		return NoActiveWebhookError
 	}
-	return nil
+
+	log.WithFields(log.Fields{
+		"err":    result.Error,
+		"userID": userID,
+	}).Warnln("unable to deliver message to any of the user's devices")
+	return errors.New(result.Error)
 }
@@ -0,0 +1,275 @@
+package internal
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultEvictAfter is how long a connection to a courier node may keep failing before it is evicted
+	DefaultEvictAfter = 30 * time.Second
+
+	// poolCheckInterval is how often a connection's failure time is checked while its state is unchanged
+	poolCheckInterval = 5 * time.Second
+
+	// CourierKeepaliveInterval is how often an idle connection to a courier node is pinged, so that a node
+	// which died without closing the connection is noticed. Courier nodes must permit pings this often
+	CourierKeepaliveInterval = 15 * time.Second
+	courierKeepaliveTimeout  = 5 * time.Second
+)
+
+// CourierPool is a pool of GRPC connections to courier nodes which is safe for concurrent use. Each
+// connection's connectivity state is watched, and connections which stay in a failing state for longer
+// than the eviction timeout, such as connections to nodes removed during a scale-down, are closed and evicted.
+// A new connection is dialed the next time the host is requested.
+type CourierPool struct {
+	mu      sync.Mutex
+	entries map[string]*poolEntry
+
+	// evictions counts the connections evicted because their host stopped responding
+	evictions uint64
+
+	evictAfter time.Duration
+}
+
+// poolEntry is a connection to a single courier node, along with the Deliver stream open over it
+type poolEntry struct {
+	conn   *grpc.ClientConn
+	client CourierClient
+	stream *deliveryStream
+
+	// ctx is cancelled when the entry is removed from the pool, stopping its watcher
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// PoolStats describes the connections held by a CourierPool
+type PoolStats struct {
+	Hosts       int            `json:"hosts"`
+	States      map[string]int `json:"states"`
+	OpenStreams int            `json:"openStreams"`
+	Evictions   uint64         `json:"evictions"`
+}
+
+func NewCourierPool() *CourierPool {
+	return &CourierPool{
+		entries:    make(map[string]*poolEntry),
+		evictAfter: DefaultEvictAfter,
+	}
+}
+
+// SetEvictAfter sets how long a connection may keep failing before it is evicted
+func (pool *CourierPool) SetEvictAfter(d time.Duration) {
+	pool.mu.Lock()
+	pool.evictAfter = d
+	pool.mu.Unlock()
+}
+
+func (pool *CourierPool) getEvictAfter() time.Duration {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return pool.evictAfter
+}
+
+// Get returns a client for host, dialing a new connection if the pool does not have one
+func (pool *CourierPool) Get(host string) (CourierClient, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	entry, err := pool.getOrDial(host)
+	if err != nil {
+		return nil, err
+	}
+	return entry.client, nil
+}
+
+// Stream returns the open Deliver stream to host, opening a new one if there is none or the previous
+// stream has failed
+func (pool *CourierPool) Stream(host string) (*deliveryStream, error) {
+	pool.mu.Lock()
+	entry, err := pool.getOrDial(host)
+	if err != nil {
+		pool.mu.Unlock()
+		return nil, err
+	}
+
+	if entry.stream != nil && !entry.stream.isClosed() {
+		stream := entry.stream
+		pool.mu.Unlock()
+		return stream, nil
+	}
+	pool.mu.Unlock()
+
+	// Opening a stream waits for the connection to be established, so the pool is not locked meanwhile
+	stream, err := newDeliveryStream(entry.client)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"host": host,
+		}).Errorln("unable to open delivery stream")
+		return nil, err
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	// Another caller may have opened a stream at the same time, or the entry may have been evicted
+	if current, ok := pool.entries[host]; !ok || current != entry {
+		stream.close()
+		return nil, StreamClosedError
+	}
+	if entry.stream != nil && !entry.stream.isClosed() {
+		stream.close()
+		return entry.stream, nil
+	}
+
+	entry.stream = stream
+	return stream, nil
+}
+
+// getOrDial must be called with mu held
+func (pool *CourierPool) getOrDial(host string) (*poolEntry, error) {
+	if entry, ok := pool.entries[host]; ok {
+		return entry, nil
+	}
+
+	conn, err := grpc.Dial(host,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                CourierKeepaliveInterval,
+			Timeout:             courierKeepaliveTimeout,
+			PermitWithoutStream: true,
+		}),
+	)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Errorln("unable to create GRPC connection")
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	entry := &poolEntry{
+		conn:   conn,
+		client: NewCourierClient(conn),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	pool.entries[host] = entry
+
+	go pool.watch(host, entry)
+
+	return entry, nil
+}
+
+// watch follows the connectivity state of an entry's connection, evicting it if the connection does
+// not become ready within the eviction timeout of failing
+func (pool *CourierPool) watch(host string, entry *poolEntry) {
+	var failingSince time.Time
+
+	state := entry.conn.GetState()
+	for {
+		switch state {
+		case connectivity.Ready:
+			failingSince = time.Time{}
+		case connectivity.TransientFailure:
+			// The connection cycles between connecting and failing while it retries, so it is only
+			// considered healthy again once it is ready
+			if failingSince.IsZero() {
+				failingSince = time.Now()
+			}
+		case connectivity.Shutdown:
+			pool.evict(host, entry)
+			return
+		}
+
+		if !failingSince.IsZero() && time.Since(failingSince) > pool.getEvictAfter() {
+			log.WithFields(log.Fields{
+				"host":         host,
+				"failingSince": failingSince,
+			}).Warnln("evicting unresponsive courier connection")
+
+			pool.mu.Lock()
+			pool.evictions++
+			pool.mu.Unlock()
+
+			pool.evict(host, entry)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(entry.ctx, poolCheckInterval)
+		entry.conn.WaitForStateChange(ctx, state)
+		cancel()
+
+		if entry.ctx.Err() != nil {
+			return
+		}
+		state = entry.conn.GetState()
+	}
+}
+
+// evict removes the entry from the pool, if it is still the current entry for host, and closes its
+// stream and connection
+func (pool *CourierPool) evict(host string, entry *poolEntry) {
+	pool.mu.Lock()
+	if current, ok := pool.entries[host]; ok && current == entry {
+		delete(pool.entries, host)
+	}
+	stream := entry.stream
+	pool.mu.Unlock()
+
+	entry.close(stream)
+}
+
+// close stops the entry's watcher and closes its stream and connection
+func (entry *poolEntry) close(stream *deliveryStream) {
+	entry.cancel()
+	if stream != nil {
+		stream.close()
+	}
+	_ = entry.conn.Close()
+}
+
+// Stats returns the number of connections in the pool by connectivity state
+func (pool *CourierPool) Stats() PoolStats {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	stats := PoolStats{
+		Hosts:     len(pool.entries),
+		States:    make(map[string]int),
+		Evictions: pool.evictions,
+	}
+
+	for _, entry := range pool.entries {
+		stats.States[entry.conn.GetState().String()]++
+		if entry.stream != nil && !entry.stream.isClosed() {
+			stats.OpenStreams++
+		}
+	}
+
+	return stats
+}
+
+// Close closes every connection in the pool
+func (pool *CourierPool) Close() {
+	pool.mu.Lock()
+	entries := pool.entries
+	pool.entries = make(map[string]*poolEntry)
+
+	streams := make(map[*poolEntry]*deliveryStream)
+	for _, entry := range entries {
+		streams[entry] = entry.stream
+	}
+	pool.mu.Unlock()
+
+	for _, entry := range entries {
+		entry.close(streams[entry])
+	}
+}
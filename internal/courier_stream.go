@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+var (
+	StreamClosedError              = errors.New("delivery stream closed")
+	DeliveryTimeoutError           = errors.New("courier node did not report the delivery in time")
+	UnspecifiedDeliveryStatusError = errors.New("courier node did not report a delivery status")
+)
+
+// deliveryEventTimeout is how long to wait for the events of a delivery. Courier nodes report each
+// recipient within AckTimeout, so the margin only covers the round trip
+const deliveryEventTimeout = AckTimeout + 5*time.Second
+
+// deliveryStream is a long-lived Deliver stream to a single courier node. Deliveries are sent over the
+// stream and their events are routed back to the caller which sent them, so any number of deliveries
+// can share the stream without holding a request or goroutine each on the courier node
+type deliveryStream struct {
+	stream Courier_DeliverClient
+	cancel context.CancelFunc
+
+	// sendMu serializes sends, since streams do not support concurrent sends
+	sendMu sync.Mutex
+
+	// mu guards waiters and closed. waiters maps delivery IDs to the channel receiving their events
+	mu      sync.Mutex
+	waiters map[string]chan *DeliveryEvent
+	closed  bool
+}
+
+func newDeliveryStream(client CourierClient) (*deliveryStream, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stream, err := client.Deliver(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	ds := &deliveryStream{
+		stream:  stream,
+		cancel:  cancel,
+		waiters: make(map[string]chan *DeliveryEvent),
+	}
+
+	go ds.receive()
+
+	return ds, nil
+}
+
+// receive routes events to their waiters until the stream fails, at which point the stream is closed
+func (ds *deliveryStream) receive() {
+	for {
+		event, err := ds.stream.Recv()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Warnln("delivery stream closed")
+			ds.close()
+			return
+		}
+
+		ds.mu.Lock()
+		if events, ok := ds.waiters[event.DeliveryId]; ok {
+			select {
+			case events <- event:
+			default:
+				// The waiter only expects one event per recipient, ignore any extras
+			}
+		}
+		ds.mu.Unlock()
+	}
+}
+
+// send assigns the delivery an ID and sends it, returning a channel which receives one event per
+// recipient. The channel is closed if the stream fails before every event is received
+func (ds *deliveryStream) send(delivery *Delivery) (string, <-chan *DeliveryEvent, error) {
+	id := uuid.New().String()
+	delivery.Id = id
+	events := make(chan *DeliveryEvent, len(delivery.Recipients))
+
+	ds.mu.Lock()
+	if ds.closed {
+		ds.mu.Unlock()
+		return "", nil, StreamClosedError
+	}
+	ds.waiters[id] = events
+	ds.mu.Unlock()
+
+	ds.sendMu.Lock()
+	err := ds.stream.Send(delivery)
+	ds.sendMu.Unlock()
+
+	if err != nil {
+		ds.done(id)
+		ds.close()
+		return "", nil, err
+	}
+
+	return id, events, nil
+}
+
+// done stops routing events for the delivery
+func (ds *deliveryStream) done(id string) {
+	ds.mu.Lock()
+	delete(ds.waiters, id)
+	ds.mu.Unlock()
+}
+
+// isClosed returns true once the stream has failed and can no longer be used
+func (ds *deliveryStream) isClosed() bool {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.closed
+}
+
+// close cancels the stream and closes the channels of every waiting delivery
+func (ds *deliveryStream) close() {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if ds.closed {
+		return
+	}
+	ds.closed = true
+	ds.cancel()
+
+	for id, events := range ds.waiters {
+		close(events)
+		delete(ds.waiters, id)
+	}
+}
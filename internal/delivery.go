@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultDeliveryRetention is how long an unacknowledged message is kept for redelivery when no
+// retention window is configured
+const DefaultDeliveryRetention = 24 * time.Hour
+
+// PendingDelivery is a message which has been sent to a user but not yet acknowledged by any of
+// their clients
+type PendingDelivery struct {
+	Cid       string    `json:"cid"`
+	Seq       uint64    `json:"seq,omitempty"`
+	Type      string    `json:"type,omitempty"`
+	Payload   []byte    `json:"payload"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// DeliveryQueue retains messages sent to a user until a client acknowledges them, so that they can be
+// redelivered when the user reconnects. Deliveries older than the queue's retention window are dropped.
+type DeliveryQueue interface {
+	// Push adds a delivery to the end of the user's queue
+	Push(ctx context.Context, userID uuid.UUID, delivery PendingDelivery) error
+
+	// Ack removes the delivery identified by cid from the user's queue
+	Ack(ctx context.Context, userID uuid.UUID, cid string) error
+
+	// Pending returns the user's unexpired deliveries, oldest first
+	Pending(ctx context.Context, userID uuid.UUID) ([]PendingDelivery, error)
+}
+
+// RedisDeliveryQueue stores each user's queue as a sorted set of cids scored by the time they were
+// pushed. The deliveries themselves are stored in separate keys which expire after the retention window.
+type RedisDeliveryQueue struct {
+	*redis.Client
+
+	Retention time.Duration
+}
+
+func (rdb RedisDeliveryQueue) retention() time.Duration {
+	if rdb.Retention > 0 {
+		return rdb.Retention
+	}
+	return DefaultDeliveryRetention
+}
+
+func pendingKey(userID uuid.UUID) string {
+	return "pending:" + userID.String()
+}
+
+func deliveryKey(cid string) string {
+	return "delivery:" + cid
+}
+
+func (rdb RedisDeliveryQueue) Push(ctx context.Context, userID uuid.UUID, delivery PendingDelivery) error {
+	encoded, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	key := pendingKey(userID)
+	retention := rdb.retention()
+
+	pipe := rdb.TxPipeline()
+	pipe.Set(ctx, deliveryKey(delivery.Cid), encoded, retention)
+	pipe.ZAdd(ctx, key, redis.Z{Score: float64(delivery.Timestamp.UnixNano()), Member: delivery.Cid})
+	pipe.Expire(ctx, key, retention)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (rdb RedisDeliveryQueue) Ack(ctx context.Context, userID uuid.UUID, cid string) error {
+	pipe := rdb.TxPipeline()
+	pipe.ZRem(ctx, pendingKey(userID), cid)
+	pipe.Del(ctx, deliveryKey(cid))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (rdb RedisDeliveryQueue) Pending(ctx context.Context, userID uuid.UUID) ([]PendingDelivery, error) {
+	key := pendingKey(userID)
+	cutoff := strconv.FormatInt(time.Now().Add(-rdb.retention()).UnixNano(), 10)
+
+	if _, err := rdb.ZRemRangeByScore(ctx, key, "-inf", "("+cutoff).Result(); err != nil {
+		return nil, err
+	}
+
+	entries, err := rdb.ZRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		return []PendingDelivery{}, nil
+	}
+
+	keys := make([]string, len(entries))
+	for i, entry := range entries {
+		keys[i] = deliveryKey(entry)
+	}
+
+	encoded, err := rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := []PendingDelivery{}
+	for _, v := range encoded {
+		// The delivery may have expired before its entry was pruned from the set
+		raw, ok := v.(string)
+		if !ok {
+			continue
+		}
+
+		delivery := PendingDelivery{}
+		if err := json.Unmarshal([]byte(raw), &delivery); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, nil
+}
+
+// MemoryDeliveryQueue is a DeliveryQueue which is kept in memory. It is not shared between courier
+// nodes and is intended for tests and local development.
+type MemoryDeliveryQueue struct {
+	mu     sync.Mutex
+	queues map[uuid.UUID][]PendingDelivery
+
+	Retention time.Duration
+}
+
+func NewMemoryDeliveryQueue(retention time.Duration) *MemoryDeliveryQueue {
+	return &MemoryDeliveryQueue{
+		queues:    make(map[uuid.UUID][]PendingDelivery),
+		Retention: retention,
+	}
+}
+
+func (q *MemoryDeliveryQueue) Push(_ context.Context, userID uuid.UUID, delivery PendingDelivery) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.queues[userID] = append(q.queues[userID], delivery)
+	return nil
+}
+
+func (q *MemoryDeliveryQueue) Ack(_ context.Context, userID uuid.UUID, cid string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queue := q.queues[userID]
+	for i, delivery := range queue {
+		if delivery.Cid == cid {
+			q.queues[userID] = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (q *MemoryDeliveryQueue) Pending(_ context.Context, userID uuid.UUID) ([]PendingDelivery, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	retention := q.Retention
+	if retention <= 0 {
+		retention = DefaultDeliveryRetention
+	}
+	cutoff := time.Now().Add(-retention)
+
+	// Deliveries are pushed in order, so everything before the first unexpired delivery has expired
+	queue := q.queues[userID]
+	for len(queue) > 0 && queue[0].Timestamp.Before(cutoff) {
+		queue = queue[1:]
+	}
+	if len(queue) == 0 {
+		delete(q.queues, userID)
+	} else {
+		q.queues[userID] = queue
+	}
+
+	deliveries := make([]PendingDelivery, len(queue))
+	copy(deliveries, queue)
+	return deliveries, nil
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"testing"
+	"time"
+)
+
+func TestMemoryDeliveryQueuePendingUntilAcked(t *testing.T) {
+	ctx := context.Background()
+	queue := NewMemoryDeliveryQueue(time.Hour)
+	userID := uuid.New()
+
+	for _, cid := range []string{"a", "b", "c"} {
+		if err := queue.Push(ctx, userID, PendingDelivery{Cid: cid, Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := queue.Ack(ctx, userID, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := queue.Pending(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].Cid != "a" || pending[1].Cid != "c" {
+		t.Fatalf("expected a and c to be pending in order, got %+v", pending)
+	}
+
+	other, _ := queue.Pending(ctx, uuid.New())
+	if len(other) != 0 {
+		t.Fatalf("expected no deliveries for another user, got %+v", other)
+	}
+}
+
+func TestMemoryDeliveryQueueDropsExpired(t *testing.T) {
+	ctx := context.Background()
+	queue := NewMemoryDeliveryQueue(time.Minute)
+	userID := uuid.New()
+
+	_ = queue.Push(ctx, userID, PendingDelivery{Cid: "old", Timestamp: time.Now().Add(-2 * time.Minute)})
+	_ = queue.Push(ctx, userID, PendingDelivery{Cid: "new", Timestamp: time.Now()})
+
+	pending, _ := queue.Pending(ctx, userID)
+	if len(pending) != 1 || pending[0].Cid != "new" {
+		t.Fatalf("expected only the unexpired delivery, got %+v", pending)
+	}
+}
+
+func newTestCourierConns() (*CourierConns, *MemoryDeliveryQueue, *MemoryReplayBuffer) {
+	deliveries := NewMemoryDeliveryQueue(time.Hour)
+	replay := NewMemoryReplayBuffer(16)
+	conns := &CourierConns{pool: NewCourierPool()}
+	conns.SetDeliveryQueue(deliveries, replay)
+	return conns, deliveries, replay
+}
+
+func TestCourierConnsQueuesOncePerUser(t *testing.T) {
+	ctx := context.Background()
+	conns, deliveries, _ := newTestCourierConns()
+	userID := uuid.New()
+
+	// The same content sent twice is two messages, each queued once for the user however many devices
+	// they have
+	first, ok := conns.queue(ctx, userID, "", []byte("ok"))
+	if !ok {
+		t.Fatal("expected the message to be queued")
+	}
+	second, _ := conns.queue(ctx, userID, "", []byte("ok"))
+
+	pending, _ := deliveries.Pending(ctx, userID)
+	if len(pending) != 2 || pending[0].Cid != first.Cid || pending[1].Cid != second.Cid {
+		t.Fatalf("expected both messages pending once each, got %+v", pending)
+	}
+	if first.Cid == second.Cid {
+		t.Fatal("expected each message to have its own cid")
+	}
+}
+
+func TestHubCollectRedeliveries(t *testing.T) {
+	ctx := context.Background()
+	conns, deliveries, replay := newTestCourierConns()
+	hub := NewHub("courier", RegistrationEngine{}, deliveries, replay)
+	userID := uuid.New()
+
+	var queued []PendingDelivery
+	for _, payload := range []string{"one", "two", "three"} {
+		delivery, _ := conns.queue(ctx, userID, "", []byte(payload))
+		queued = append(queued, delivery)
+	}
+
+	// The third message was acknowledged by another device, so it is only buffered for replay
+	_ = deliveries.Ack(ctx, userID, queued[2].Cid)
+
+	// A device which has seen the first message is sent the rest once each
+	redeliveries, err := hub.collectRedeliveries(ctx, userID, queued[0].Seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(redeliveries) != 2 || redeliveries[0].Cid != queued[1].Cid || redeliveries[1].Cid != queued[2].Cid {
+		t.Fatalf("expected the second and third messages, got %+v", redeliveries)
+	}
+
+	// The first message is acknowledged on the device's behalf
+	pending, _ := deliveries.Pending(ctx, userID)
+	if len(pending) != 1 || pending[0].Cid != queued[1].Cid {
+		t.Fatalf("expected only the second message to remain pending, got %+v", pending)
+	}
+
+	// A new session is only sent what is still pending
+	redeliveries, _ = hub.collectRedeliveries(ctx, userID, 0)
+	if len(redeliveries) != 1 || redeliveries[0].Cid != queued[1].Cid {
+		t.Fatalf("expected only the pending message, got %+v", redeliveries)
+	}
+}
@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Email is a plain text email
+type Email struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// EmailSender delivers emails to users
+type EmailSender interface {
+	Send(ctx context.Context, email Email) error
+}
+
+// SMTPSender sends emails through an SMTP server, using STARTTLS if the server supports it
+type SMTPSender struct {
+	// Addr is the host and port of the server
+	Addr string
+	From string
+
+	// Username and Password are used to authenticate if Username is set
+	Username string
+	Password string
+}
+
+func (sender SMTPSender) Send(_ context.Context, email Email) error {
+	// Header values must not contain line breaks, which would let them add headers
+	if strings.ContainsAny(email.To, "\r\n") || strings.ContainsAny(email.Subject, "\r\n") {
+		return fmt.Errorf("invalid email header")
+	}
+
+	var auth smtp.Auth
+	if sender.Username != "" {
+		host, _, err := net.SplitHostPort(sender.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", sender.Username, sender.Password, host)
+	}
+
+	var msg strings.Builder
+	msg.WriteString("From: " + sender.From + "\r\n")
+	msg.WriteString("To: " + email.To + "\r\n")
+	msg.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", email.Subject) + "\r\n")
+	msg.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(email.Body, "\n", "\r\n"))
+
+	return smtp.SendMail(sender.Addr, auth, sender.From, []string{email.To}, []byte(msg.String()))
+}
+
+// MemoryEmailSender keeps sent emails in memory instead of delivering them, for tests and local
+// development
+type MemoryEmailSender struct {
+	mu   sync.Mutex
+	sent []Email
+}
+
+func (sender *MemoryEmailSender) Send(_ context.Context, email Email) error {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	sender.sent = append(sender.sent, email)
+	return nil
+}
+
+// Sent returns every email sent, oldest first
+func (sender *MemoryEmailSender) Sent() []Email {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	return append([]Email{}, sender.sent...)
+}
+
+// Last returns the most recent email sent to the address, or nil if there isn't one
+func (sender *MemoryEmailSender) Last(to string) *Email {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	for i := len(sender.sent) - 1; i >= 0; i-- {
+		if sender.sent[i].To == to {
+			email := sender.sent[i]
+			return &email
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/david-wiles/groupme-clone/pkg"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// frameTimeout is how long a FrameHandler has to handle a frame
+const frameTimeout = 30 * time.Second
+
+var (
+	UnsupportedFrameError = errors.New("unsupported frame type")
+	FrameBacklogError     = errors.New("too many frames waiting to be handled")
+)
+
+// FrameHandler handles frames of a single type sent by clients. If the frame has a Ref, the reply or
+// error returned is sent back to the client
+type FrameHandler func(ctx context.Context, ws *WebsocketConnection, frame *pkg.ClientFrame) (reply []byte, err error)
+
+// HandleFrame registers the handler for frames of frameType, replacing any existing handler. Acks are
+// always handled by the hub and cannot be overridden
+func (hub *Hub) HandleFrame(frameType string, handler FrameHandler) {
+	hub.handlerMu.Lock()
+	hub.handlers[frameType] = handler
+	hub.handlerMu.Unlock()
+}
+
+// dispatchFrame calls the handler registered for the frame's type, and replies to the client if the
+// frame has a Ref
+func (hub *Hub) dispatchFrame(ws *WebsocketConnection, frame *pkg.ClientFrame) {
+	hub.handlerMu.RLock()
+	handler, ok := hub.handlers[frame.Type]
+	hub.handlerMu.RUnlock()
+
+	var (
+		reply []byte
+		err   = UnsupportedFrameError
+	)
+
+	if ok {
+		// Any handled frame other than a presence report means the user is active. Frames without a
+		// handler don't, so that clients can't keep a user online by sending meaningless frames
+		if frame.Type != pkg.FramePresence {
+			hub.updatePresence(ws.userID, presenceActive)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), frameTimeout)
+		reply, err = handler(ctx, ws, frame)
+		cancel()
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"id":   ws.ID,
+			"type": frame.Type,
+		}).Warnln("unable to handle client frame")
+	}
+
+	hub.replyToFrame(ws, frame, reply, err)
+}
+
+// replyToFrame sends the result of handling a frame to the client, if the frame has a Ref
+func (hub *Hub) replyToFrame(ws *WebsocketConnection, frame *pkg.ClientFrame, reply []byte, err error) {
+	if frame.Ref == "" {
+		return
+	}
+
+	msg := &pkg.ClientMessage{
+		Payload: reply,
+		Type:    pkg.MessageReply,
+		Ref:     frame.Ref,
+	}
+	if err != nil {
+		msg.Error = err.Error()
+	}
+
+	if err := hub.UnsafeSendMessage(ws.ID, msg); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+			"id":  ws.ID,
+			"ref": frame.Ref,
+		}).Warnln("unable to reply to client frame")
+	}
+}
+
+// SendMessageFrame is the body of a FrameSendMessage frame
+type SendMessageFrame struct {
+	RoomID  string `json:"roomId"`
+	Message string `json:"message"`
+	ReplyTo string `json:"replyTo,omitempty"`
+
+	// Attachments are the IDs of attachments uploaded through the REST api
+	Attachments []string `json:"attachments,omitempty"`
+}
+
+// SendMessageHandler returns a FrameHandler which posts the message in a FrameSendMessage frame, the
+// same as posting it through the REST api. The reply is the created message, including its ID
+func SendMessageHandler(poster MessagePoster) FrameHandler {
+	return func(ctx context.Context, ws *WebsocketConnection, frame *pkg.ClientFrame) ([]byte, error) {
+		req := &SendMessageFrame{}
+		if err := json.Unmarshal(frame.Data, req); err != nil {
+			return nil, err
+		}
+
+		roomID, err := uuid.Parse(req.RoomID)
+		if err != nil {
+			return nil, err
+		}
+
+		draft := MessageDraft{RoomID: roomID, Content: req.Message}
+		if req.ReplyTo != "" {
+			replyTo, err := uuid.Parse(req.ReplyTo)
+			if err != nil {
+				return nil, err
+			}
+			draft.ReplyTo = &replyTo
+		}
+
+		for _, raw := range req.Attachments {
+			attachmentID, err := uuid.Parse(raw)
+			if err != nil {
+				return nil, err
+			}
+			draft.Attachments = append(draft.Attachments, attachmentID)
+		}
+
+		message, _, err := poster.Post(ctx, ws.userID, draft)
+		if err != nil {
+			return nil, err
+		}
+
+		return message.Encode()
+	}
+}
+
+// ReadReceiptFrame is the body of a FrameReadReceipt frame
+type ReadReceiptFrame struct {
+	RoomID    string `json:"roomId"`
+	MessageID string `json:"messageId"`
+}
+
+// ReadReceiptHandler returns a FrameHandler which marks the room read up to the message in a
+// FrameReadReceipt frame. The reply is the user's read receipt
+func ReadReceiptHandler(poster MessagePoster) FrameHandler {
+	return func(ctx context.Context, ws *WebsocketConnection, frame *pkg.ClientFrame) ([]byte, error) {
+		req := &ReadReceiptFrame{}
+		if err := json.Unmarshal(frame.Data, req); err != nil {
+			return nil, err
+		}
+
+		roomID, err := uuid.Parse(req.RoomID)
+		if err != nil {
+			return nil, err
+		}
+
+		messageID, err := uuid.Parse(req.MessageID)
+		if err != nil {
+			return nil, err
+		}
+
+		receipt, err := poster.MarkRead(ctx, roomID, ws.userID, messageID)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(receipt)
+	}
+}
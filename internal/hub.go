@@ -2,15 +2,25 @@ package internal
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"github.com/david-wiles/groupme-clone/pkg"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var (
+	WebsocketNotFoundError = errors.New("websocket not found")
+	BufferFullError        = errors.New("buffer full")
+
+	UnsupportedPresenceError = errors.New("unsupported presence status")
+)
+
 // Hub maintains a thread-safe map of UUID to WebsocketConnection. connMu guards the conns map,
 // cidMu guards the inFlightCID map
 type Hub struct {
@@ -19,53 +29,206 @@ type Hub struct {
 
 	RegistrationEngine
 
-	// Map of CIDs to its channels used by a SendMessage call. When a client sends a message
-	// with a CID matching one of these CIDs, the goroutine awaiting the acknowledgment will
-	// be notified, ending that SendMessage call
+	// Map of websockets and CIDs to the messages awaiting acknowledgement. When a client sends a message
+	// with a CID matching one of these CIDs, the sender of the message will be notified. Every device of a
+	// user receives a message with the same CID, so messages are also keyed by the websocket
 	cidMu       sync.RWMutex
-	inFlightCID map[uuid.UUID]chan struct{}
+	inFlightCID map[inFlightKey]*inFlightMessage
+
+	// deliveries retains the messages queued for each user until they are acknowledged, so they can be
+	// redelivered when the user connects. Messages are queued by CourierConns before they are sent
+	deliveries DeliveryQueue
+
+	// replay keeps recent messages for resuming sessions
+	replay ReplayBuffer
+
+	// handlers maps frame types to the FrameHandler handling them, guarded by handlerMu
+	handlerMu sync.RWMutex
+	handlers  map[string]FrameHandler
+
+	// presence records the activity of connected users, and presenceChanged is called whenever a user's
+	// status changes. Presence is not tracked unless TrackPresence is called
+	presence        *PresenceEngine
+	presenceChanged func(ctx context.Context, presence *Presence)
 
 	hostname string
 
+	// PingInterval and PongWait configure the heartbeat of new connections. PingInterval must be
+	// shorter than PongWait, otherwise healthy connections will be reaped between pings
+	PingInterval time.Duration
+	PongWait     time.Duration
+
+	// CompressionLevel is the default flate level of new connections which negotiated permessage-deflate.
+	// Messages smaller than CompressionThreshold bytes are not compressed. Both can be changed for each
+	// connection with its ConnectionOptions
+	CompressionLevel     int
+	CompressionThreshold int
+
+	// closedUncompressed and closedWire total the byte counters of connections which have been closed
+	closedUncompressed atomic.Uint64
+	closedWire         atomic.Uint64
+
 	pkg.Serializer
 }
 
-func NewHub(hostname string, engine RegistrationEngine) *Hub {
+const (
+	DefaultPingInterval = 30 * time.Second
+	DefaultPongWait     = 60 * time.Second
+)
+
+func NewHub(hostname string, engine RegistrationEngine, deliveries DeliveryQueue, replay ReplayBuffer) *Hub {
 	return &Hub{
-		connMu:             sync.RWMutex{},
-		conns:              make(map[uuid.UUID]*WebsocketConnection),
-		cidMu:              sync.RWMutex{},
-		inFlightCID:        make(map[uuid.UUID]chan struct{}),
-		hostname:           hostname,
-		Serializer:         pkg.JSONSerializer{},
-		RegistrationEngine: engine,
+		connMu:               sync.RWMutex{},
+		conns:                make(map[uuid.UUID]*WebsocketConnection),
+		cidMu:                sync.RWMutex{},
+		inFlightCID:          make(map[inFlightKey]*inFlightMessage),
+		deliveries:           deliveries,
+		replay:               replay,
+		handlers:             make(map[string]FrameHandler),
+		hostname:             hostname,
+		PingInterval:         DefaultPingInterval,
+		PongWait:             DefaultPongWait,
+		CompressionLevel:     DefaultCompressionLevel,
+		CompressionThreshold: DefaultCompressionThreshold,
+		Serializer:           pkg.JSONSerializer{},
+		RegistrationEngine:   engine,
+	}
+}
+
+// ConnectionOptions returns the hub's default options for new connections
+func (hub *Hub) ConnectionOptions() ConnectionOptions {
+	return ConnectionOptions{
+		Serializer:           hub.Serializer,
+		CompressionLevel:     hub.CompressionLevel,
+		CompressionThreshold: hub.CompressionThreshold,
 	}
 }
 
 // RegisterConnection will create a new WebsocketConnection from an underlying websocket.Conn
-// and add it to the map of managed connections
-func (hub *Hub) RegisterConnection(userID uuid.UUID, conn *websocket.Conn) *WebsocketConnection {
-	ws := NewWebsocketConnection(conn, hub, userID)
+// and add it to the map of managed connections. The connection is configured with opts, see
+// ConnectionOptions for the hub's defaults. lastSeq is the sequence number of the last message the
+// client acknowledged in a previous session, anything newer is replayed to the new connection
+func (hub *Hub) RegisterConnection(userID uuid.UUID, conn *websocket.Conn, opts ConnectionOptions, lastSeq uint64) *WebsocketConnection {
+	ws := NewWebsocketConnection(conn, hub, userID, opts)
 
 	hub.connMu.Lock()
 	hub.conns[ws.ID] = ws
 	hub.connMu.Unlock()
 
-	webhook := hub.hostname + "/" + ws.ID.String()
+	// Messages the user missed while disconnected are queued before the webhook is registered, so
+	// that they are written to the client before any new messages
+	hub.redeliver(ws, lastSeq)
 
+	// Register the client's webhook
+	hub.RefreshConnection(ws)
+	hub.updatePresence(ws.userID, presenceActive)
+
+	return ws
+}
+
+// redeliver writes every message the websocket's user hasn't acknowledged to the websocket, in sequence
+// order. This includes messages pending acknowledgement as well as buffered messages newer than lastSeq.
+// Acknowledgements for these messages are handled by Acknowledge as usual
+func (hub *Hub) redeliver(ws *WebsocketConnection, lastSeq uint64) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	// Register the client's webhook
-	if err := hub.SetUserWebhook(ctx, webhook, userID); err != nil {
+	pending, err := hub.collectRedeliveries(ctx, ws.userID, lastSeq)
+	if err != nil {
 		log.WithFields(log.Fields{
 			"err":    err,
-			"userID": userID,
+			"userID": ws.userID,
+		}).Errorln("unable to read pending deliveries")
+		return
+	}
+
+	for _, delivery := range pending {
+		clientMessage := &pkg.ClientMessage{
+			Payload:     delivery.Payload,
+			Cid:         delivery.Cid,
+			Seq:         delivery.Seq,
+			Acknowledge: true,
+			Type:        delivery.Type,
+		}
+
+		// The write buffer may fill up if many messages are pending, wait for the writeWorker to drain it
+		for {
+			err := hub.UnsafeSendMessage(ws.ID, clientMessage)
+			if err == nil {
+				break
+			}
+
+			if err != BufferFullError {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				log.WithFields(log.Fields{
+					"err":  ctx.Err(),
+					"wsID": ws.ID,
+				}).Warnln("unable to redeliver pending messages")
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+}
+
+// collectRedeliveries merges the user's pending deliveries with the buffered deliveries newer than lastSeq.
+// A message which is both pending and buffered is only sent once, since it has the same sequence number in
+// both. Pending deliveries the client has already seen according to lastSeq are acknowledged
+func (hub *Hub) collectRedeliveries(ctx context.Context, userID uuid.UUID, lastSeq uint64) ([]PendingDelivery, error) {
+	pending, err := hub.deliveries.Pending(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	replayed := []PendingDelivery{}
+	if lastSeq > 0 {
+		if replayed, err = hub.replay.Since(ctx, userID, lastSeq); err != nil {
+			return nil, err
+		}
+	}
+
+	seen := make(map[uint64]bool)
+	deliveries := []PendingDelivery{}
+
+	for _, delivery := range append(pending, replayed...) {
+		if delivery.Seq > 0 {
+			if delivery.Seq <= lastSeq {
+				_ = hub.deliveries.Ack(ctx, userID, delivery.Cid)
+				continue
+			}
+			if seen[delivery.Seq] {
+				continue
+			}
+			seen[delivery.Seq] = true
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	// Deliveries without a sequence number keep their relative order ahead of sequenced ones
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].Seq < deliveries[j].Seq
+	})
+
+	return deliveries, nil
+}
+
+// RefreshConnection registers the websocket's webhook, or extends its expiration if it is already
+// registered. This is called on every successful heartbeat so that the registration reflects liveness
+func (hub *Hub) RefreshConnection(ws *WebsocketConnection) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := hub.AddUserWebhook(ctx, ws.userID, hub.webhook(ws.ID)); err != nil {
+		log.WithFields(log.Fields{
+			"err":    err,
+			"userID": ws.userID,
 			"wsID":   ws.ID,
 		}).Errorln("unable to set client webhook")
 	}
-
-	return ws
 }
 
 // UnregisterConnection removes the WebsocketConnection identified by ID from the managed connections
@@ -85,17 +248,129 @@ func (hub *Hub) UnregisterConnection(wsID uuid.UUID) {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 
-		// Register the client's webhook
-		if err := hub.RemoveUserWebhook(ctx, *userID); err != nil {
+		// Remove only this connection's webhook, the user may still be connected from other devices
+		if err := hub.RemoveUserWebhook(ctx, *userID, hub.webhook(wsID)); err != nil {
 			log.WithFields(log.Fields{
 				"err":    err,
 				"userID": userID,
 				"wsID":   ws.ID,
-			}).Errorln("unable to set client webhook")
+			}).Errorln("unable to remove client webhook")
+		}
+
+		hub.updatePresence(*userID, presenceHeartbeat)
+	}
+}
+
+// recordClosed adds the byte counters of a closed connection to the hub's totals
+func (hub *Hub) recordClosed(stats CompressionStats) {
+	hub.closedUncompressed.Add(stats.Uncompressed)
+	hub.closedWire.Add(stats.Wire)
+}
+
+// Stats returns the compression settings and byte counters of every connected websocket
+func (hub *Hub) Stats() HubStats {
+	hub.connMu.RLock()
+	connections := make([]ConnectionStats, 0, len(hub.conns))
+	for _, ws := range hub.conns {
+		connections = append(connections, ws.Stats())
+	}
+	hub.connMu.RUnlock()
+
+	return HubStats{
+		Connections: connections,
+		Closed: CompressionStats{
+			Uncompressed: hub.closedUncompressed.Load(),
+			Wire:         hub.closedWire.Load(),
+		},
+	}
+}
+
+// TrackPresence records the presence of users connected to this hub with engine. changed is called with
+// the user's new presence whenever their status changes, and may be nil. Every sweepInterval the hub
+// also sweeps the presence of all users, so that users of courier nodes which crashed go offline
+func (hub *Hub) TrackPresence(engine PresenceEngine, sweepInterval time.Duration, changed func(ctx context.Context, presence *Presence)) {
+	hub.presence = &engine
+	hub.presenceChanged = changed
+	hub.HandleFrame(pkg.FramePresence, hub.handlePresenceFrame)
+
+	go hub.sweepPresence(sweepInterval)
+}
+
+// sweepPresence periodically sweeps the presence of every user, notifying presenceChanged of the users
+// whose status changed
+func (hub *Hub) sweepPresence(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		changed, err := hub.presence.Sweep(ctx)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Warnln("unable to sweep presence")
+		}
+
+		if hub.presenceChanged != nil {
+			for _, presence := range changed {
+				hub.presenceChanged(ctx, presence)
+			}
 		}
+		cancel()
 	}
 }
 
+// updatePresence records activity for the user, notifying presenceChanged if their status changed
+func (hub *Hub) updatePresence(userID uuid.UUID, activity string) {
+	if hub.presence == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	presence, changed, err := hub.presence.update(ctx, userID, activity)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":    err,
+			"userID": userID,
+		}).Warnln("unable to update presence")
+		return
+	}
+
+	// Notifying other users may be slow, and must not delay the connection's reads
+	if changed && hub.presenceChanged != nil {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			hub.presenceChanged(ctx, presence)
+		}()
+	}
+}
+
+// handlePresenceFrame records the status reported by a FramePresence frame
+func (hub *Hub) handlePresenceFrame(_ context.Context, ws *WebsocketConnection, frame *pkg.ClientFrame) ([]byte, error) {
+	req := &PresenceFrame{}
+	if err := json.Unmarshal(frame.Data, req); err != nil {
+		return nil, err
+	}
+
+	switch req.Status {
+	case PresenceOnline:
+		hub.updatePresence(ws.userID, presenceActive)
+	case PresenceIdle:
+		hub.updatePresence(ws.userID, presenceIdle)
+	default:
+		return nil, UnsupportedPresenceError
+	}
+	return nil, nil
+}
+
+// webhook returns the address other services use to reach the websocket identified by wsID through this hub
+func (hub *Hub) webhook(wsID uuid.UUID) string {
+	return hub.hostname + "/" + wsID.String()
+}
+
 // UnsafeSendMessage attempts to send the message msg to the connection identified by ID. It will not
 // attempt to verify that the client received the message, to wait for acknowledgement from the client use 'SendMessage'
 func (hub *Hub) UnsafeSendMessage(ID uuid.UUID, msg pkg.Serializable) error {
@@ -110,79 +385,158 @@ func (hub *Hub) UnsafeSendMessage(ID uuid.UUID, msg pkg.Serializable) error {
 		default:
 			// Error, client's write channel is full. The caller must implement retry logic
 			// when using this function or propagate the error to the calling service
-			return errors.New("buffer full")
+			return BufferFullError
 		}
 	} else {
-		return errors.New("websocket not found")
+		return WebsocketNotFoundError
 	}
 }
 
+// SendEvent writes an ephemeral event of eventType to the connection identified by ID. Events are not
+// acknowledged by the client, and are neither queued for redelivery nor sequenced
+func (hub *Hub) SendEvent(ID uuid.UUID, eventType string, payload []byte) error {
+	return hub.UnsafeSendMessage(ID, &pkg.ClientMessage{
+		Payload: payload,
+		Type:    eventType,
+	})
+}
+
+// AckTimeout is how long a client has to acknowledge a message sent with SendMessage or SendMessageAsync
+const AckTimeout = 10 * time.Second
+
+// inFlightKey identifies a message sent to a single websocket
+type inFlightKey struct {
+	wsID uuid.UUID
+	cid  string
+}
+
+// inFlightMessage is a message awaiting acknowledgement. done is called exactly once, with nil when the
+// client acknowledges the message or an error if the acknowledgement times out
+type inFlightMessage struct {
+	done  func(error)
+	timer *time.Timer
+}
+
+// SendMessage sends msg to the connection identified by ID and waits for the client to acknowledge it.
+// The message is neither queued nor sequenced, messages which must survive the client disconnecting are
+// sent through CourierConns, which queues them before sending them with SendQueuedMessageAsync
 func (hub *Hub) SendMessage(ctx context.Context, ID uuid.UUID, msg []byte) error {
-	// Format message using cid to wait for ack from client
-	cid := uuid.New()
+	ack := make(chan error, 1)
+
+	cid, err := hub.SendMessageAsync(ctx, ID, msg, func(err error) {
+		ack <- err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Wait for ack from client
+	select {
+	case err := <-ack:
+		if err == nil {
+			log.WithFields(log.Fields{
+				"cid": cid,
+				"id":  ID,
+			}).Infoln("received ack")
+		}
+		return err
+	case <-ctx.Done():
+		hub.completeInFlight(inFlightKey{ID, cid}, ctx.Err())
+		return ctx.Err()
+	}
+}
+
+// SendMessageAsync sends msg to the connection identified by ID without waiting for the client to
+// acknowledge it. done is called once the client acknowledges the message, or with an error if it isn't
+// acknowledged within AckTimeout. No goroutine is held while waiting, so many messages can be in flight
+// at once. If an error is returned, the message was not sent and done will not be called
+func (hub *Hub) SendMessageAsync(ctx context.Context, ID uuid.UUID, msg []byte, done func(error)) (string, error) {
+	return hub.SendQueuedMessageAsync(ctx, ID, PendingDelivery{Payload: msg}, done)
+}
+
+// SendQueuedMessageAsync is SendMessageAsync for a message which has already been queued for the
+// connection's user, keeping the cid and sequence number it was queued with. The message is sent with a
+// new cid if it doesn't have one. Unlike events sent with SendEvent, queued messages are acknowledged and
+// redelivered until they are
+func (hub *Hub) SendQueuedMessageAsync(_ context.Context, ID uuid.UUID, delivery PendingDelivery, done func(error)) (string, error) {
+	cid := delivery.Cid
+	if cid == "" {
+		cid = uuid.New().String()
+	}
+
 	clientMessage := &pkg.ClientMessage{
-		Payload:     msg,
-		Cid:         cid.String(),
+		Payload:     delivery.Payload,
+		Cid:         cid,
+		Seq:         delivery.Seq,
 		Acknowledge: true,
+		Type:        delivery.Type,
 	}
 
-	// Create channel for notification of ack
-	ack := make(chan struct{})
-
+	// Register the message before sending it so that a fast acknowledgement isn't missed
+	key := inFlightKey{ID, cid}
 	hub.cidMu.Lock()
-	hub.inFlightCID[cid] = ack
+	hub.inFlightCID[key] = &inFlightMessage{
+		done: done,
+		timer: time.AfterFunc(AckTimeout, func() {
+			log.WithFields(log.Fields{
+				"cid": cid,
+				"id":  ID,
+			}).Warnln("error waiting for client to acknowledge message")
+			hub.completeInFlight(key, context.DeadlineExceeded)
+		}),
+	}
 	hub.cidMu.Unlock()
 
-	// We always want to recover resources once this function exits, whether the ack was
-	// successful or if the context expired
-	defer func() {
+	// Send message to client
+	if err := hub.UnsafeSendMessage(ID, clientMessage); err != nil {
 		hub.cidMu.Lock()
-		delete(hub.inFlightCID, cid)
+		if inFlight, ok := hub.inFlightCID[key]; ok {
+			inFlight.timer.Stop()
+			delete(hub.inFlightCID, key)
+		}
 		hub.cidMu.Unlock()
-	}()
+		return "", err
+	}
 
-	// Add timeout for ack
-	timedCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
-	defer cancel()
+	return cid, nil
+}
 
-	// Send message to client
-	if err := hub.UnsafeSendMessage(ID, clientMessage); err != nil {
-		return err
-	}
+// completeInFlight removes the in-flight message identified by key and calls its done function with err.
+// Nothing happens if the message has already been completed
+func (hub *Hub) completeInFlight(key inFlightKey, err error) {
+	hub.cidMu.Lock()
+	inFlight, ok := hub.inFlightCID[key]
+	delete(hub.inFlightCID, key)
+	hub.cidMu.Unlock()
 
-	// Wait for ack from client
-	select {
-	case <-ack:
-		// Success
-		log.WithFields(log.Fields{
-			"cid": cid,
-			"id":  ID,
-		}).Infoln("received ack")
-		return nil
-	case <-timedCtx.Done():
-		log.WithFields(log.Fields{
-			"cid": cid,
-			"err": ctx.Err(),
-		}).
-			Warnln("error waiting for client to acknowledge message")
-		return timedCtx.Err()
+	if ok {
+		inFlight.timer.Stop()
+		inFlight.done(err)
 	}
 }
 
-func (hub *Hub) Acknowledge(cid string) error {
-	parsedCID, err := uuid.Parse(cid)
-	if err != nil {
+// Acknowledge marks the message identified by cid as received by the websocket's user. The message is
+// removed from the user's pending deliveries, and the sender of the message is notified if it is still in
+// flight to the websocket
+func (hub *Hub) Acknowledge(ws *WebsocketConnection, cid string) error {
+	if _, err := uuid.Parse(cid); err != nil {
 		return err
 	}
+	userID := ws.userID
 
-	hub.cidMu.RLock()
-	defer hub.cidMu.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-	if ack, ok := hub.inFlightCID[parsedCID]; ok {
-		ack <- struct{}{}
-	} else {
-		return errors.New("key not found in map")
+	if err := hub.deliveries.Ack(ctx, userID, cid); err != nil {
+		log.WithFields(log.Fields{
+			"err":    err,
+			"cid":    cid,
+			"userID": userID,
+		}).Errorln("unable to remove acknowledged message from pending deliveries")
 	}
 
+	// Redelivered messages are not in flight, so there is no one to notify
+	hub.completeInFlight(inFlightKey{ws.ID, cid}, nil)
+
 	return nil
 }
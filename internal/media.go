@@ -0,0 +1,579 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// ThumbnailVariant is the name of the variant holding an image's thumbnail
+	ThumbnailVariant = "thumbnail"
+
+	// DefaultThumbnailSize is the largest width and height of thumbnails, in pixels
+	DefaultThumbnailSize = 320
+
+	// DefaultMediaWorkers is the number of attachments processed at once by a MediaProcessor
+	DefaultMediaWorkers = 2
+
+	// DefaultMediaAttempts is the number of times processing an attachment is attempted before giving up
+	DefaultMediaAttempts = 3
+
+	// DefaultMediaRetryDelay is how long a failed job waits before its first retry. The delay doubles
+	// for each further attempt, up to maxMediaRetryDelay
+	DefaultMediaRetryDelay = 10 * time.Second
+	maxMediaRetryDelay     = 10 * time.Minute
+
+	// DefaultMediaVisibilityTimeout is how long a worker may hold a job before it is assumed to have
+	// crashed, and the job is queued again
+	DefaultMediaVisibilityTimeout = 5 * time.Minute
+
+	// maxImagePixels is the size of the largest image which will be decoded, so that a small file can't
+	// claim huge dimensions and exhaust the worker's memory
+	maxImagePixels = 50_000_000
+)
+
+var (
+	UnsupportedMediaError = errors.New("media format is not supported")
+	ImageTooLargeError    = errors.New("image dimensions are too large")
+)
+
+// MediaInfo is the metadata extracted from an attachment. Fields which don't apply to the attachment's
+// type are zero
+type MediaInfo struct {
+	Width    int
+	Height   int
+	Duration time.Duration
+}
+
+// MediaJob is an attachment waiting to be processed
+type MediaJob struct {
+	AttachmentID uuid.UUID `json:"attachmentId"`
+	Attempts     int       `json:"attempts,omitempty"`
+
+	// raw is the job as it was read from the queue, which identifies it in the processing list
+	raw string
+}
+
+// MediaQueue is the queue of attachments waiting to be processed, shared by every instance of the service.
+// Jobs taken by a worker are moved to a processing list until they are done, so that the jobs of a worker
+// which crashed are queued again once their visibility timeout passes. Failed jobs wait in a delayed set
+// until they are retried
+type MediaQueue struct {
+	*redis.Client
+
+	// VisibilityTimeout uses DefaultMediaVisibilityTimeout if it isn't set
+	VisibilityTimeout time.Duration
+}
+
+const (
+	mediaQueueKey      = "media:queue"
+	mediaProcessingKey = "media:processing"
+	mediaClaimsKey     = "media:claims"
+	mediaDelayedKey    = "media:delayed"
+)
+
+func (rdb MediaQueue) visibilityTimeout() time.Duration {
+	if rdb.VisibilityTimeout > 0 {
+		return rdb.VisibilityTimeout
+	}
+	return DefaultMediaVisibilityTimeout
+}
+
+func (rdb MediaQueue) Enqueue(ctx context.Context, job MediaJob) error {
+	encoded, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return rdb.LPush(ctx, mediaQueueKey, encoded).Err()
+}
+
+// next waits up to timeout for a job, returning nil if there wasn't one. The job is moved to the
+// processing list, and must be finished with done or retry
+func (rdb MediaQueue) next(ctx context.Context, timeout time.Duration) (*MediaJob, error) {
+	raw, err := rdb.BLMove(ctx, mediaQueueKey, mediaProcessingKey, "RIGHT", "LEFT", timeout).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	deadline := time.Now().Add(rdb.visibilityTimeout()).Unix()
+	if err := rdb.HSet(ctx, mediaClaimsKey, raw, deadline).Err(); err != nil {
+		// The job stays in the processing list, and is reclaimed once it is noticed without a claim
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warnln("unable to claim media job")
+	}
+
+	job := &MediaJob{raw: raw}
+	if err := json.Unmarshal([]byte(raw), job); err != nil {
+		// A job which can't be read would never succeed
+		rdb.done(ctx, job)
+		return nil, err
+	}
+	return job, nil
+}
+
+// done removes a job from the processing list
+func (rdb MediaQueue) done(ctx context.Context, job *MediaJob) {
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LRem(ctx, mediaProcessingKey, 1, job.raw)
+		pipe.HDel(ctx, mediaClaimsKey, job.raw)
+		return nil
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+			"id":  job.AttachmentID,
+		}).Errorln("unable to finish media job")
+	}
+}
+
+// retry moves a failed job from the processing list to the delayed set, to be queued again after delay
+func (rdb MediaQueue) retry(ctx context.Context, job *MediaJob, delay time.Duration) error {
+	encoded, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LRem(ctx, mediaProcessingKey, 1, job.raw)
+		pipe.HDel(ctx, mediaClaimsKey, job.raw)
+		pipe.ZAdd(ctx, mediaDelayedKey, redis.Z{Score: float64(time.Now().Add(delay).Unix()), Member: encoded})
+		return nil
+	})
+	return err
+}
+
+// promoteDelayedScript queues the delayed jobs which are due
+var promoteDelayedScript = redis.NewScript(`
+local due = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, 100)
+for _, job in ipairs(due) do
+	redis.call("ZREM", KEYS[1], job)
+	redis.call("LPUSH", KEYS[2], job)
+end
+return #due
+`)
+
+// reclaimScript queues the jobs in the processing list again once their claim expires, counting the lost
+// attempt so that a job which keeps crashing its worker is eventually given up. Jobs without a claim,
+// whose worker may be about to claim them, are given a claim rather than being queued
+var reclaimScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local reclaimed = 0
+for _, raw in ipairs(redis.call("LRANGE", KEYS[1], 0, -1)) do
+	local deadline = redis.call("HGET", KEYS[2], raw)
+	if not deadline then
+		redis.call("HSET", KEYS[2], raw, ARGV[2])
+	elseif tonumber(deadline) < now then
+		redis.call("LREM", KEYS[1], 1, raw)
+		redis.call("HDEL", KEYS[2], raw)
+		local ok, job = pcall(cjson.decode, raw)
+		if ok then
+			job["attempts"] = (job["attempts"] or 0) + 1
+			redis.call("RPUSH", KEYS[3], cjson.encode(job))
+			reclaimed = reclaimed + 1
+		end
+	end
+end
+return reclaimed
+`)
+
+// maintain queues the delayed jobs which are due and the jobs of workers which crashed
+func (rdb MediaQueue) maintain(ctx context.Context) error {
+	now := time.Now()
+	if err := promoteDelayedScript.Run(ctx, rdb.Client, []string{mediaDelayedKey, mediaQueueKey}, now.Unix()).Err(); err != nil {
+		return err
+	}
+
+	keys := []string{mediaProcessingKey, mediaClaimsKey, mediaQueueKey}
+	reclaimed, err := reclaimScript.Run(ctx, rdb.Client, keys, now.Unix(), now.Add(rdb.visibilityTimeout()).Unix()).Int()
+	if err != nil {
+		return err
+	}
+	if reclaimed > 0 {
+		log.WithFields(log.Fields{
+			"jobs": reclaimed,
+		}).Warnln("requeued media jobs whose worker stopped responding")
+	}
+	return nil
+}
+
+// SetMediaInfo stores the result of processing an attachment, and returns the ID of its message if it is
+// already part of one
+func (db AttachmentQueryEngine) SetMediaInfo(id uuid.UUID, info *MediaInfo, variants []AttachmentVariant, ts time.Time) (*uuid.UUID, error) {
+	var width, height, durationMs interface{}
+	if info.Width > 0 && info.Height > 0 {
+		width, height = info.Width, info.Height
+	}
+	if info.Duration > 0 {
+		durationMs = info.Duration.Milliseconds()
+	}
+
+	var encoded interface{}
+	if len(variants) > 0 {
+		b, err := json.Marshal(variants)
+		if err != nil {
+			return nil, err
+		}
+		encoded = b
+	}
+
+	var messageID uuid.NullUUID
+	stmt := `UPDATE "attachments" SET "width" = $2, "height" = $3, "duration_ms" = $4, "variants" = $5, "processed_at" = $6
+		WHERE "id" = $1 RETURNING "message_id";`
+	if err := db.QueryRow(stmt, id, width, height, durationMs, encoded, ts).Scan(&messageID); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+			"id":  id,
+		}).Errorln("unable to update attachment")
+		return nil, err
+	}
+
+	if messageID.Valid {
+		return &messageID.UUID, nil
+	}
+	return nil, nil
+}
+
+// MediaProcessor processes queued attachments in the background. Images get a thumbnail and their
+// dimensions, and MP4 and WAV files their duration and, for video, dimensions. Once an attachment is
+// processed, a MessageUpdated message is sent to the members of its message's room
+type MediaProcessor struct {
+	Queue  MediaQueue
+	Poster MessagePoster
+	Blobs  BlobStore
+
+	// Workers, ThumbnailSize, MaxAttempts and RetryDelay use their defaults if they aren't set
+	Workers       int
+	ThumbnailSize int
+	MaxAttempts   int
+	RetryDelay    time.Duration
+}
+
+func (processor MediaProcessor) workers() int {
+	if processor.Workers > 0 {
+		return processor.Workers
+	}
+	return DefaultMediaWorkers
+}
+
+func (processor MediaProcessor) thumbnailSize() int {
+	if processor.ThumbnailSize > 0 {
+		return processor.ThumbnailSize
+	}
+	return DefaultThumbnailSize
+}
+
+func (processor MediaProcessor) maxAttempts() int {
+	if processor.MaxAttempts > 0 {
+		return processor.MaxAttempts
+	}
+	return DefaultMediaAttempts
+}
+
+// retryDelay returns how long a job waits before it is retried after failing attempts times
+func (processor MediaProcessor) retryDelay(attempts int) time.Duration {
+	delay := processor.RetryDelay
+	if delay <= 0 {
+		delay = DefaultMediaRetryDelay
+	}
+	for i := 1; i < attempts && delay < maxMediaRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxMediaRetryDelay {
+		delay = maxMediaRetryDelay
+	}
+	return delay
+}
+
+// Run processes queued attachments until ctx is done
+func (processor MediaProcessor) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		processor.maintain(ctx)
+	}()
+
+	for i := 0; i < processor.workers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			processor.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// maintain periodically queues delayed and abandoned jobs until ctx is done
+func (processor MediaProcessor) maintain(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := processor.Queue.maintain(ctx); err != nil && ctx.Err() == nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Errorln("unable to maintain media queue")
+			}
+		}
+	}
+}
+
+func (processor MediaProcessor) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		job, err := processor.Queue.next(ctx, 5*time.Second)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Errorln("unable to read media queue")
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+		if job == nil {
+			continue
+		}
+
+		// Jobs reclaimed from crashed workers may already have used up their attempts
+		if job.Attempts >= processor.maxAttempts() {
+			log.WithFields(log.Fields{
+				"id": job.AttachmentID,
+			}).Errorln("giving up processing attachment")
+			processor.Queue.done(ctx, job)
+			continue
+		}
+
+		// The job must finish before its claim expires, otherwise another worker would also process it
+		processCtx, cancel := context.WithTimeout(ctx, processor.Queue.visibilityTimeout())
+		err = processor.Process(processCtx, job.AttachmentID)
+		cancel()
+		if err == nil {
+			processor.Queue.done(ctx, job)
+			continue
+		}
+
+		job.Attempts++
+		if job.Attempts >= processor.maxAttempts() {
+			log.WithFields(log.Fields{
+				"err": err,
+				"id":  job.AttachmentID,
+			}).Errorln("giving up processing attachment")
+			processor.Queue.done(ctx, job)
+			continue
+		}
+
+		// A job which can't be moved to the delayed set stays in the processing list, and is retried
+		// once its claim expires
+		if err := processor.Queue.retry(ctx, job, processor.retryDelay(job.Attempts)); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+				"id":  job.AttachmentID,
+			}).Errorln("unable to requeue attachment")
+		}
+	}
+}
+
+// Process extracts the metadata of an attachment and stores its variants. Attachments which have
+// already been processed are skipped. An error is only returned if processing should be retried; media
+// which can't be decoded is marked as processed without any metadata
+func (processor MediaProcessor) Process(ctx context.Context, id uuid.UUID) error {
+	attachment, err := processor.Poster.Attachments.GetAttachment(id)
+	if err != nil {
+		if err == NoMatchingAttachmentError {
+			return nil
+		}
+		return err
+	}
+
+	if attachment.ProcessedAt != nil {
+		return nil
+	}
+
+	body, _, err := processor.Blobs.Get(ctx, attachment.BlobKey())
+	if err != nil {
+		if err == NoMatchingBlobError {
+			log.WithFields(log.Fields{
+				"id": id,
+			}).Warnln("attachment has no contents")
+			return nil
+		}
+		return err
+	}
+
+	data, err := io.ReadAll(io.LimitReader(body, attachment.Size+1))
+	body.Close()
+	if err != nil {
+		return err
+	}
+
+	info, thumbnail, err := ProbeMedia(attachment.ContentType, data, processor.thumbnailSize())
+	if err != nil {
+		if err != UnsupportedMediaError {
+			log.WithFields(log.Fields{
+				"err": err,
+				"id":  id,
+			}).Warnln("unable to process media")
+		}
+		info = &MediaInfo{}
+	}
+
+	var variants []AttachmentVariant
+	if thumbnail != nil {
+		if err := processor.Blobs.Put(ctx, attachment.VariantKey(thumbnail.Name), bytes.NewReader(thumbnail.Data), BlobInfo{
+			ContentType: thumbnail.ContentType,
+			Size:        int64(len(thumbnail.Data)),
+		}); err != nil {
+			return err
+		}
+		variants = append(variants, thumbnail.AttachmentVariant)
+	}
+
+	messageID, err := processor.Poster.Attachments.SetMediaInfo(id, info, variants, time.Now())
+	if err != nil {
+		return err
+	}
+
+	// Attachments which aren't part of a message yet are sent with their metadata once they are. The
+	// author's other clients are also waiting for the metadata, so the update is sent to every member
+	if messageID != nil {
+		processor.Poster.notifyUpdated(ctx, *messageID)
+	}
+	return nil
+}
+
+// EncodedVariant is a variant along with its contents
+type EncodedVariant struct {
+	AttachmentVariant
+	Data []byte
+}
+
+// ProbeMedia extracts the metadata of a file of the content type, and creates a thumbnail for images
+// which fits within thumbnailSize. UnsupportedMediaError is returned for types it can't read
+func ProbeMedia(contentType string, data []byte, thumbnailSize int) (*MediaInfo, *EncodedVariant, error) {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return probeImage(data, thumbnailSize)
+	case "video/mp4":
+		info, err := probeMP4(bytes.NewReader(data))
+		return info, nil, err
+	case "audio/wave":
+		info, err := probeWAV(bytes.NewReader(data))
+		return info, nil, err
+	default:
+		return nil, nil, UnsupportedMediaError
+	}
+}
+
+func probeImage(data []byte, thumbnailSize int) (*MediaInfo, *EncodedVariant, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxImagePixels {
+		return nil, nil, ImageTooLargeError
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	thumb := Thumbnail(src, thumbnailSize)
+	bounds := thumb.Bounds()
+
+	// Thumbnails are JPEGs, unless they need to keep the image's transparency
+	var buf bytes.Buffer
+	contentType := "image/jpeg"
+	if thumb.Opaque() {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 80})
+	} else {
+		contentType = "image/png"
+		err = png.Encode(&buf, thumb)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &MediaInfo{Width: config.Width, Height: config.Height}, &EncodedVariant{
+		AttachmentVariant: AttachmentVariant{
+			Name:        ThumbnailVariant,
+			ContentType: contentType,
+			Width:       bounds.Dx(),
+			Height:      bounds.Dy(),
+			Size:        int64(buf.Len()),
+		},
+		Data: buf.Bytes(),
+	}, nil
+}
+
+// Thumbnail scales src down to fit within size by size pixels, keeping its aspect ratio. Each pixel of
+// the thumbnail is the average of the pixels it covers in src. Images which already fit are copied
+func Thumbnail(src image.Image, size int) *image.NRGBA {
+	bounds := src.Bounds()
+	sw, sh := bounds.Dx(), bounds.Dy()
+
+	dw, dh := sw, sh
+	if sw > size || sh > size {
+		if sw >= sh {
+			dw, dh = size, sh*size/sw
+		} else {
+			dw, dh = sw*size/sh, size
+		}
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for dy := 0; dy < dh; dy++ {
+		y0, y1 := bounds.Min.Y+dy*sh/dh, bounds.Min.Y+(dy+1)*sh/dh
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+
+		for dx := 0; dx < dw; dx++ {
+			x0, x1 := bounds.Min.X+dx*sw/dw, bounds.Min.X+(dx+1)*sw/dw
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			// Colors are averaged with premultiplied alpha, so transparent pixels don't darken the result
+			var r, g, b, a, n uint64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					pr, pg, pb, pa := src.At(x, y).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+
+			dst.Set(dx, dy, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)})
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,203 @@
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+var InvalidMediaError = errors.New("media file is malformed")
+
+// maxMP4HeaderBox is the size of the largest mvhd or tkhd box which will be read
+const maxMP4HeaderBox = 4096
+
+// probeMP4 reads the duration of an MP4 file from its movie header, and its dimensions from the header
+// of its first visual track. Boxes are read in order, so the media data is only skipped over when it
+// comes before the movie header
+func probeMP4(r io.Reader) (*MediaInfo, error) {
+	info := &MediaInfo{}
+	found, err := walkMP4(r, -1, info)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, InvalidMediaError
+	}
+	return info, nil
+}
+
+// walkMP4 reads the boxes in the next size bytes of r, or until EOF if size is negative, and returns
+// true if the movie header was read
+func walkMP4(r io.Reader, size int64, info *MediaInfo) (found bool, err error) {
+	header := make([]byte, 8)
+	for size < 0 || size >= 8 {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF && size < 0 {
+				return found, nil
+			}
+			return false, InvalidMediaError
+		}
+
+		boxSize, headerSize := int64(binary.BigEndian.Uint32(header)), int64(8)
+		boxType := string(header[4:])
+
+		switch boxSize {
+		case 0:
+			// The box extends to the end of the file, which only makes sense at the top level
+			if size >= 0 {
+				return false, InvalidMediaError
+			}
+			boxSize = -1
+		case 1:
+			if _, err := io.ReadFull(r, header); err != nil {
+				return false, InvalidMediaError
+			}
+			boxSize, headerSize = int64(binary.BigEndian.Uint64(header)), 16
+			if boxSize < 0 {
+				return false, InvalidMediaError
+			}
+		}
+
+		// payload is negative if the box extends to the end of the file
+		payload := int64(-1)
+		if boxSize >= 0 {
+			payload = boxSize - headerSize
+			if payload < 0 || (size >= 0 && boxSize > size) {
+				return false, InvalidMediaError
+			}
+		}
+		if size >= 0 {
+			size -= boxSize
+		}
+
+		switch boxType {
+		case "moov", "trak":
+			body := r
+			if payload >= 0 {
+				body = io.LimitReader(r, payload)
+			}
+			nested, err := walkMP4(body, payload, info)
+			if err != nil {
+				return false, err
+			}
+			// The rest of the file only holds media data once the movie header has been read
+			if boxType == "moov" {
+				return nested, nil
+			}
+			continue
+		case "mvhd", "tkhd":
+			if payload > maxMP4HeaderBox || payload < 0 {
+				return false, InvalidMediaError
+			}
+			box := make([]byte, payload)
+			if _, err := io.ReadFull(r, box); err != nil {
+				return false, InvalidMediaError
+			}
+			if boxType == "mvhd" {
+				if err := parseMVHD(box, info); err != nil {
+					return false, err
+				}
+				found = true
+			} else {
+				parseTKHD(box, info)
+			}
+			continue
+		}
+
+		if payload < 0 {
+			return found, nil
+		}
+		if _, err := io.CopyN(io.Discard, r, payload); err != nil {
+			return false, InvalidMediaError
+		}
+	}
+
+	return found, nil
+}
+
+func parseMVHD(box []byte, info *MediaInfo) error {
+	var timescale, duration uint64
+	switch {
+	case len(box) >= 32 && box[0] == 1:
+		timescale, duration = uint64(binary.BigEndian.Uint32(box[20:])), binary.BigEndian.Uint64(box[24:])
+	case len(box) >= 20 && box[0] == 0:
+		timescale, duration = uint64(binary.BigEndian.Uint32(box[12:])), uint64(binary.BigEndian.Uint32(box[16:]))
+	default:
+		return InvalidMediaError
+	}
+
+	if timescale == 0 {
+		return InvalidMediaError
+	}
+	info.Duration = time.Duration(duration / timescale * uint64(time.Second))
+	info.Duration += time.Duration(duration % timescale * uint64(time.Second) / timescale)
+	return nil
+}
+
+// parseTKHD sets the dimensions of the first track with any, since audio tracks have none
+func parseTKHD(box []byte, info *MediaInfo) {
+	if info.Width > 0 || len(box) == 0 {
+		return
+	}
+
+	// The width and height are 16.16 fixed point numbers at the end of the box
+	offset := 76
+	if box[0] == 1 {
+		offset = 88
+	}
+	if len(box) < offset+8 {
+		return
+	}
+
+	info.Width = int(binary.BigEndian.Uint32(box[offset:]) >> 16)
+	info.Height = int(binary.BigEndian.Uint32(box[offset+4:]) >> 16)
+}
+
+// maxWAVFormatChunk is the size of the largest fmt chunk which will be read
+const maxWAVFormatChunk = 1024
+
+// probeWAV reads the duration of a WAV file from the size of its data and its byte rate
+func probeWAV(r io.Reader) (*MediaInfo, error) {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:4]) != "RIFF" || string(header[8:]) != "WAVE" {
+		return nil, InvalidMediaError
+	}
+
+	var byteRate uint32
+	chunk := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return nil, InvalidMediaError
+		}
+		chunkSize := int64(binary.LittleEndian.Uint32(chunk[4:]))
+
+		switch string(chunk[:4]) {
+		case "fmt ":
+			if chunkSize < 16 || chunkSize > maxWAVFormatChunk {
+				return nil, InvalidMediaError
+			}
+			format := make([]byte, chunkSize)
+			if _, err := io.ReadFull(r, format); err != nil {
+				return nil, InvalidMediaError
+			}
+			byteRate = binary.LittleEndian.Uint32(format[8:])
+		case "data":
+			if byteRate == 0 {
+				return nil, InvalidMediaError
+			}
+			return &MediaInfo{Duration: time.Duration(chunkSize * int64(time.Second) / int64(byteRate))}, nil
+		default:
+			if _, err := io.CopyN(io.Discard, r, chunkSize); err != nil {
+				return nil, InvalidMediaError
+			}
+		}
+
+		// Chunks are padded to an even size
+		if chunkSize%2 == 1 {
+			if _, err := io.CopyN(io.Discard, r, 1); err != nil {
+				return nil, InvalidMediaError
+			}
+		}
+	}
+}
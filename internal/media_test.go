@@ -0,0 +1,32 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMediaProcessorRetryDelayBacksOff(t *testing.T) {
+	processor := MediaProcessor{RetryDelay: time.Minute}
+
+	tests := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{4, 8 * time.Minute},
+		{5, maxMediaRetryDelay},
+		{50, maxMediaRetryDelay},
+	}
+
+	for _, test := range tests {
+		if delay := processor.retryDelay(test.attempts); delay != test.delay {
+			t.Errorf("retryDelay(%d) = %v, want %v", test.attempts, delay, test.delay)
+		}
+	}
+
+	if delay := (MediaProcessor{}).retryDelay(1); delay != DefaultMediaRetryDelay {
+		t.Errorf("default retryDelay(1) = %v, want %v", delay, DefaultMediaRetryDelay)
+	}
+}
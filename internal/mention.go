@@ -0,0 +1,292 @@
+package internal
+
+import (
+	"context"
+	"github.com/david-wiles/groupme-clone/pkg"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MentionAll is the mention which notifies every member of the room
+const MentionAll = "all"
+
+// mentionPattern matches an @ followed by a username, which is not part of a word or email address
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@(\w[\w.\-]*)`)
+
+// ParseMentions returns the usernames mentioned in content, without duplicates, and whether content
+// mentions @all
+func ParseMentions(content string) (usernames []string, all bool) {
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		// Punctuation ending a sentence is not part of the username
+		username := strings.TrimRight(match[1], ".-")
+		if username == MentionAll {
+			all = true
+			continue
+		}
+		if !seen[username] {
+			seen[username] = true
+			usernames = append(usernames, username)
+		}
+	}
+	return usernames, all
+}
+
+// ResolveMentions returns the IDs of the members of the room with one of the usernames
+func (db MessageQueryEngine) ResolveMentions(roomID uuid.UUID, usernames []string) ([]uuid.UUID, error) {
+	stmt := `SELECT a."id" FROM "accounts" a JOIN "joined_rooms" jr ON a."id" = jr."account_id"
+		WHERE jr."room_id" = $1 AND a."username" = ANY($2);`
+	rows, err := db.Query(stmt, roomID, pq.Array(usernames))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":    err,
+			"roomID": roomID,
+		}).Errorln("unable to resolve mentions")
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userID uuid.UUID
+	users := []uuid.UUID{}
+
+	for rows.Next() {
+		if err := rows.Scan(&userID); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Errorln("unable to scan row")
+			return nil, err
+		}
+		users = append(users, userID)
+	}
+
+	return users, nil
+}
+
+// CreateMentions stores the users mentioned by a message
+func (db MessageQueryEngine) CreateMentions(messageID uuid.UUID, users []uuid.UUID) error {
+	if len(users) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(users))
+	for i, user := range users {
+		ids[i] = user.String()
+	}
+
+	stmt := `INSERT INTO "message_mentions" ("message_id", "account_id") SELECT $1, unnest($2::uuid[]) ON CONFLICT DO NOTHING;`
+	if _, err := db.Exec(stmt, messageID, pq.Array(ids)); err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"messageID": messageID,
+		}).Errorln("unable to insert mentions")
+		return err
+	}
+
+	return nil
+}
+
+// ReplaceMentions replaces the users mentioned by a message, after its content was edited
+func (db MessageQueryEngine) ReplaceMentions(messageID uuid.UUID, users []uuid.UUID) error {
+	ids := make([]string, len(users))
+	for i, user := range users {
+		ids[i] = user.String()
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt := `DELETE FROM "message_mentions" WHERE "message_id" = $1 AND NOT ("account_id" = ANY($2::uuid[]));`
+	_, err = tx.Exec(stmt, messageID, pq.Array(ids))
+	if err == nil {
+		stmt = `INSERT INTO "message_mentions" ("message_id", "account_id") SELECT $1, unnest($2::uuid[]) ON CONFLICT DO NOTHING;`
+		_, err = tx.Exec(stmt, messageID, pq.Array(ids))
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"messageID": messageID,
+		}).Errorln("unable to replace mentions")
+		if err := tx.Rollback(); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Errorln("unable to rollback transaction")
+		}
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Errorln("unable to commit transaction")
+		return err
+	}
+
+	return nil
+}
+
+// AttachMentions sets the users mentioned by each message
+func (db MessageQueryEngine) AttachMentions(messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(messages))
+	byID := make(map[uuid.UUID]*Message, len(messages))
+	for i := range messages {
+		ids[i] = messages[i].ID.String()
+		byID[messages[i].ID] = &messages[i]
+	}
+
+	stmt := `SELECT "message_id", "account_id" FROM "message_mentions" WHERE "message_id" = ANY($1::uuid[]);`
+	rows, err := db.Query(stmt, pq.Array(ids))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Errorln("unable to query mentions")
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID, userID uuid.UUID
+		if err := rows.Scan(&messageID, &userID); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Errorln("unable to scan row")
+			return err
+		}
+
+		if message, ok := byID[messageID]; ok && message.DeletedAt == nil {
+			message.Mentions = append(message.Mentions, userID)
+		}
+	}
+
+	return nil
+}
+
+// QueryMentionPage returns a page of the messages mentioning userID across every room the user is still a
+// member of, newest first
+func (db MessageQueryEngine) QueryMentionPage(userID uuid.UUID, cursor *MessageCursor, limit int) (*MessagePage, error) {
+	filter := `"id" IN (SELECT "message_id" FROM "message_mentions" WHERE "account_id" = $1) AND "deleted_at" IS NULL
+		AND "room" IN (SELECT "room_id" FROM "joined_rooms" WHERE "account_id" = $1)`
+	return db.queryPage(filter, userID, cursor, limit, true)
+}
+
+const (
+	// mentionTimeout is how long delivering a mention to a user may take
+	mentionTimeout = 30 * time.Second
+
+	// mentionWorkers is the most mentions of a single message which are delivered at once, so that mentioning
+	// @all in a large room doesn't flood the delivery queue and courier nodes
+	mentionWorkers = 4
+)
+
+// mentionedUsers returns the members mentioned in the content of a message from userID. Mentioning @all
+// mentions every member, and users never mention themselves
+func (poster MessagePoster) mentionedUsers(roomID, userID uuid.UUID, members []uuid.UUID, content string) ([]uuid.UUID, error) {
+	usernames, all := ParseMentions(content)
+
+	var (
+		mentioned []uuid.UUID
+		err       error
+	)
+	if all {
+		mentioned = append([]uuid.UUID{}, members...)
+	} else if len(usernames) > 0 {
+		if mentioned, err = poster.Messages.ResolveMentions(roomID, usernames); err != nil {
+			return nil, err
+		}
+	}
+
+	return FilterUUID(mentioned, userID), nil
+}
+
+// updateMentions replaces the mentions of an edited message with those in its new content, and notifies
+// the users who weren't already mentioned. The message's Mentions are set to the new mentions
+func (poster MessagePoster) updateMentions(message *Message) error {
+	previous := []Message{{ID: message.ID}}
+	if err := poster.Messages.AttachMentions(previous); err != nil {
+		return err
+	}
+
+	members, err := poster.Rooms.ListRoomMembers(message.RoomID)
+	if err != nil {
+		return err
+	}
+
+	// Mentions are the author's, even if the message was edited by an admin
+	mentioned, err := poster.mentionedUsers(message.RoomID, message.UserID, members, message.Content)
+	if err != nil {
+		return err
+	}
+
+	if err := poster.Messages.ReplaceMentions(message.ID, mentioned); err != nil {
+		return err
+	}
+	message.Mentions = mentioned
+
+	var added []uuid.UUID
+	for _, userID := range mentioned {
+		if !ContainsUUID(previous[0].Mentions, userID) {
+			added = append(added, userID)
+		}
+	}
+
+	if len(added) > 0 {
+		encoded, err := message.Encode()
+		if err != nil {
+			return err
+		}
+		go poster.notifyMentions(message, added, encoded)
+	}
+	return nil
+}
+
+// notifyMentions sends a MessageMention message to each of users, separately from the message itself, so
+// that clients can notify the user even if they have muted the room. Each delivery has its own timeout,
+// since this runs after the request which posted the message has finished
+func (poster MessagePoster) notifyMentions(message *Message, users []uuid.UUID, encoded []byte) {
+	queue := make(chan uuid.UUID, len(users))
+	for _, userID := range users {
+		queue <- userID
+	}
+	close(queue)
+
+	workers := mentionWorkers
+	if len(users) < workers {
+		workers = len(users)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for userID := range queue {
+				poster.notifyMention(message, userID, encoded)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (poster MessagePoster) notifyMention(message *Message, userID uuid.UUID, encoded []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), mentionTimeout)
+	defer cancel()
+
+	err := poster.Conns.UnicastTypedMessage(ctx, userID, pkg.MessageMention, encoded)
+	if err != nil && err != NoActiveWebhookError {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"messageID": message.ID,
+			"userID":    userID,
+		}).Warnln("unable to deliver mention")
+	}
+}
@@ -0,0 +1,35 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	tests := []struct {
+		content   string
+		usernames []string
+		all       bool
+	}{
+		{"no mentions here", nil, false},
+		{"@alice", []string{"alice"}, false},
+		{"hi @alice and @bob_2", []string{"alice", "bob_2"}, false},
+		{"thanks @alice.", []string{"alice"}, false},
+		{"@alice, @bob! @carol? (@dave)", []string{"alice", "bob", "carol", "dave"}, false},
+		{"@first.last-name...", []string{"first.last-name"}, false},
+		{"@alice @alice @bob @alice", []string{"alice", "bob"}, false},
+		{"@all", nil, true},
+		{"heads up @all, @alice", []string{"alice"}, true},
+		{"mail alice@example.com", nil, false},
+		{"@@alice and word@bob", nil, false},
+		{"@ alone", nil, false},
+		{"@Alice", []string{"Alice"}, false},
+	}
+
+	for _, test := range tests {
+		usernames, all := ParseMentions(test.content)
+		if !reflect.DeepEqual(usernames, test.usernames) || all != test.all {
+			t.Errorf("ParseMentions(%q) = %q, %v, want %q, %v", test.content, usernames, all, test.usernames, test.all)
+		}
+	}
+}
@@ -2,19 +2,80 @@ package internal
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"github.com/david-wiles/groupme-clone/pkg"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
 	"time"
 )
 
 type Message struct {
-	ID        uuid.UUID `json:"id,omitempty"`
-	RoomID    uuid.UUID `json:"roomId,omitempty"`
-	UserID    uuid.UUID `json:"userId,omitempty"`
-	Timestamp time.Time `json:"timestamp"`
-	Content   string    `json:"content,omitempty"`
+	ID        uuid.UUID  `json:"id,omitempty"`
+	RoomID    uuid.UUID  `json:"roomId,omitempty"`
+	UserID    uuid.UUID  `json:"userId,omitempty"`
+	Timestamp time.Time  `json:"timestamp"`
+	Content   string     `json:"content,omitempty"`
+	EditedAt  *time.Time `json:"editedAt,omitempty"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+	ReplyTo   *uuid.UUID `json:"replyTo,omitempty"`
+
+	// Quote is a preview of the message being replied to, it is not set for messages read by GetMessage
+	Quote *MessageQuote `json:"quote,omitempty"`
+
+	// Attachments is only set when creating a message and for messages read with AttachAttachments
+	Attachments []Attachment `json:"attachments,omitempty"`
+
+	// Mentions are the users mentioned in the content, it is only set when creating a message and for
+	// messages read with AttachMentions
+	Mentions []uuid.UUID `json:"mentions,omitempty"`
+
+	// Reactions is only set for messages read with AttachReactions
+	Reactions []ReactionCount `json:"reactions,omitempty"`
+
+	// Previews of the links in the content are set by the Unfurler after the message is created
+	Previews []LinkPreview `json:"previews,omitempty"`
+}
+
+// messageColumns are the columns of the messages table read by scanMessage, in order
+const messageColumns = `"id", "room", "content", "account_id", "ts", "edited_at", "deleted_at", "reply_to", "previews"`
+
+// rowScanner is implemented by both sql.Row and sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanMessage reads a message selected with messageColumns. The content of deleted messages is not returned
+func scanMessage(row rowScanner) (*Message, error) {
+	message := &Message{}
+	var editedAt, deletedAt sql.NullTime
+	var replyTo uuid.NullUUID
+	var previews []byte
+	if err := row.Scan(&message.ID, &message.RoomID, &message.Content, &message.UserID, &message.Timestamp, &editedAt, &deletedAt, &replyTo, &previews); err != nil {
+		return nil, err
+	}
+
+	if editedAt.Valid {
+		message.EditedAt = &editedAt.Time
+	}
+	if deletedAt.Valid {
+		message.DeletedAt = &deletedAt.Time
+		message.Content = ""
+	}
+	if replyTo.Valid {
+		message.ReplyTo = &replyTo.UUID
+	}
+	if len(previews) > 0 && message.DeletedAt == nil {
+		if err := json.Unmarshal(previews, &message.Previews); err != nil {
+			return nil, err
+		}
+	}
+
+	return message, nil
 }
 
 func (message *Message) Encode() ([]byte, error) {
@@ -27,14 +88,55 @@ func (message *Message) Encode() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+var (
+	NotRoomMemberError = errors.New("user is not a member of room")
+	InvalidReplyError  = errors.New("replies must be to a message in the same room")
+)
+
+// quoteLength is the maximum length of a quoted message's content in runes
+const quoteLength = 140
+
+// MessageQuote is a compact preview of a message, included in replies to it
+type MessageQuote struct {
+	ID      uuid.UUID `json:"id"`
+	UserID  uuid.UUID `json:"userId"`
+	Content string    `json:"content,omitempty"`
+	Deleted bool      `json:"deleted,omitempty"`
+}
+
+// Preview returns a quote of the message, with its content truncated to quoteLength runes
+func (message *Message) Preview() *MessageQuote {
+	quote := &MessageQuote{
+		ID:      message.ID,
+		UserID:  message.UserID,
+		Content: message.Content,
+		Deleted: message.DeletedAt != nil,
+	}
+
+	if runes := []rune(quote.Content); len(runes) > quoteLength {
+		quote.Content = string(runes[:quoteLength-1]) + "…"
+	}
+	return quote
+}
+
 type MessageQueryEngine struct {
 	*sql.DB
 }
 
-func (db MessageQueryEngine) CreateNewMessage(roomID, userID uuid.UUID, ts time.Time, message string) (id uuid.UUID, err error) {
+// CreateNewMessage inserts a message into the room. replyTo is the message being replied to, or nil
+func (db MessageQueryEngine) CreateNewMessage(roomID, userID uuid.UUID, ts time.Time, message string, replyTo *uuid.UUID) (id uuid.UUID, err error) {
+	return createMessage(db, roomID, userID, ts, message, replyTo)
+}
+
+// execer is implemented by both sql.DB and sql.Tx
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func createMessage(db execer, roomID, userID uuid.UUID, ts time.Time, message string, replyTo *uuid.UUID) (id uuid.UUID, err error) {
 	id = uuid.New()
-	stmt := `INSERT INTO "messages" ("id", "room", "content", "ts", "account_id") VALUES ($1, $2, $3, $4, $5);`
-	if _, err := db.Exec(stmt, id, roomID, message, ts, userID); err != nil {
+	stmt := `INSERT INTO "messages" ("id", "room", "content", "ts", "account_id", "reply_to") VALUES ($1, $2, $3, $4, $5, $6);`
+	if _, err := db.Exec(stmt, id, roomID, message, ts, userID, replyTo); err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
 		}).Errorln("unable to insert message into database")
@@ -45,7 +147,7 @@ func (db MessageQueryEngine) CreateNewMessage(roomID, userID uuid.UUID, ts time.
 }
 
 func (db MessageQueryEngine) QueryMessages(roomID uuid.UUID, from, to time.Time) ([]Message, error) {
-	stmt := `SELECT "id", "room", "content", "account_id", "ts" FROM "messages" WHERE "room" = $1 AND "ts" > $2 AND "ts" < $3 ORDER BY ts DESC;`
+	stmt := `SELECT ` + messageColumns + ` FROM "messages" WHERE "room" = $1 AND "ts" > $2 AND "ts" < $3 ORDER BY ts DESC;`
 	rows, err := db.Query(stmt, roomID, from, to)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -61,14 +163,625 @@ func (db MessageQueryEngine) QueryMessages(roomID uuid.UUID, from, to time.Time)
 
 	defer rows.Close()
 	for rows.Next() {
-		message := Message{}
-		if err := rows.Scan(&message.ID, &message.RoomID, &message.Content, &message.UserID, &message.Timestamp); err != nil {
+		message, err := scanMessage(rows)
+		if err != nil {
 			log.WithFields(log.Fields{
 				"err": err,
 			}).Warnln("unable to scan row")
+			continue
 		}
-		messages = append(messages, message)
+		messages = append(messages, *message)
 	}
 
 	return messages, nil
 }
+
+// MessagePoster creates new messages and broadcasts them to the other members of the room. It is shared
+// by every entrypoint which lets clients post messages
+type MessagePoster struct {
+	Rooms       RoomQueryEngine
+	Messages    MessageQueryEngine
+	Attachments AttachmentQueryEngine
+	Conns       *CourierConns
+
+	// Unfurler creates previews of the links in new and edited messages, if it is set
+	Unfurler *Unfurler
+
+	// RequireVerified only lets users who have verified their email address post or edit, checked with
+	// Accounts
+	RequireVerified bool
+	Accounts        AccountQueryEngine
+}
+
+// MessageDraft is a message a user is posting to a room
+type MessageDraft struct {
+	RoomID  uuid.UUID
+	Content string
+
+	// ReplyTo is the message being replied to, which must be in the same room, or nil
+	ReplyTo *uuid.UUID
+
+	// Attachments are uploaded by the author and not yet part of another message
+	Attachments []uuid.UUID
+}
+
+// Post persists a message from userID to the room and broadcasts it to the room's other members. The
+// result of delivering the message to each member is returned along with the message. An error is
+// only returned if the message could not be created
+func (poster MessagePoster) Post(ctx context.Context, userID uuid.UUID, draft MessageDraft) (*Message, []RecipientResult, error) {
+	if poster.RequireVerified {
+		if err := poster.Accounts.RequireVerified(userID); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	roomID := draft.RoomID
+	members, err := poster.Rooms.ListRoomMembers(roomID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !ContainsUUID(members, userID) {
+		return nil, nil, NotRoomMemberError
+	}
+
+	var quote *MessageQuote
+	if draft.ReplyTo != nil {
+		parent, err := poster.Messages.GetMessage(*draft.ReplyTo)
+		if err == NoMatchingMessageError || (err == nil && parent.RoomID != roomID) {
+			return nil, nil, InvalidReplyError
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		quote = parent.Preview()
+	}
+
+	now := time.Now()
+	var (
+		id          uuid.UUID
+		attachments []Attachment
+	)
+	if len(draft.Attachments) == 0 {
+		id, err = poster.Messages.CreateNewMessage(roomID, userID, now, draft.Content, draft.ReplyTo)
+	} else {
+		id, attachments, err = poster.createWithAttachments(userID, now, draft)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	message := &Message{
+		ID:          id,
+		RoomID:      roomID,
+		UserID:      userID,
+		Timestamp:   now,
+		Content:     draft.Content,
+		ReplyTo:     draft.ReplyTo,
+		Quote:       quote,
+		Attachments: attachments,
+	}
+
+	// A message is still posted if its mentions can't be stored, the mentioned users just aren't notified
+	mentioned, err := poster.mentionedUsers(roomID, userID, members, draft.Content)
+	if err == nil {
+		err = poster.Messages.CreateMentions(id, mentioned)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"messageID": id,
+		}).Warnln("unable to store mentions")
+	} else if len(mentioned) > 0 {
+		message.Mentions = mentioned
+	}
+
+	// Create possibly encrypted message payload
+	encoded, err := message.Encode()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"messageID": id,
+		}).Errorln("unable to encode message")
+		return nil, nil, err
+	}
+
+	if len(message.Mentions) > 0 {
+		go poster.notifyMentions(message, message.Mentions, encoded)
+	}
+
+	if poster.Unfurler != nil {
+		go poster.unfurlLinks(message)
+	}
+
+	deliveries, err := poster.Conns.BroadcastMessage(ctx, FilterUUID(members, userID), encoded)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"messageID": id,
+			"userID":    userID,
+		}).Warnln("unable to broadcast message")
+	}
+
+	return message, deliveries, nil
+}
+
+// MarkRead records that userID has read the room up to messageID, and broadcasts the receipt to the
+// room's other members as an ephemeral MessageReadReceipt event if the receipt moved forward
+func (poster MessagePoster) MarkRead(ctx context.Context, roomID, userID, messageID uuid.UUID) (*ReadReceipt, error) {
+	members, err := poster.Rooms.ListRoomMembers(roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ContainsUUID(members, userID) {
+		return nil, NotRoomMemberError
+	}
+
+	receipt, advanced, err := poster.Rooms.MarkRead(roomID, userID, messageID)
+	if err != nil || !advanced {
+		return receipt, err
+	}
+
+	encoded, err := json.Marshal(receipt)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := poster.Conns.BroadcastEvent(ctx, FilterUUID(members, userID), pkg.MessageReadReceipt, encoded); err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"messageID": messageID,
+			"userID":    userID,
+		}).Warnln("unable to broadcast read receipt")
+	}
+
+	return receipt, nil
+}
+
+const (
+	// DefaultPageSize is the number of messages returned by QueryMessagePage when no limit is given
+	DefaultPageSize = 50
+
+	// MaxPageSize is the largest number of messages returned by a single page
+	MaxPageSize = 200
+)
+
+var InvalidCursorError = errors.New("invalid message cursor")
+
+// MessageCursor is a position in a room's history. Messages are ordered by timestamp, with ties broken
+// by ID, so a cursor is unambiguous even when several messages share a timestamp. Before is true if the
+// page continues towards older messages
+type MessageCursor struct {
+	Timestamp time.Time `json:"ts"`
+	ID        uuid.UUID `json:"id"`
+	Before    bool      `json:"before,omitempty"`
+}
+
+// Encode returns the cursor as an opaque string which can be passed back by clients
+func (cursor *MessageCursor) Encode() string {
+	encoded, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// DecodeMessageCursor parses a cursor returned by MessageCursor.Encode
+func DecodeMessageCursor(raw string) (*MessageCursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, InvalidCursorError
+	}
+
+	cursor := &MessageCursor{}
+	if err := json.Unmarshal(decoded, cursor); err != nil {
+		return nil, InvalidCursorError
+	}
+	return cursor, nil
+}
+
+// MessagePage is a page of a room's history. NextCursor is empty once there are no more messages in the
+// direction of the page
+type MessagePage struct {
+	Messages   []Message `json:"messages"`
+	NextCursor string    `json:"nextCursor,omitempty"`
+}
+
+// CursorAt returns a cursor positioned at the message, which must have been posted in the room
+func (db MessageQueryEngine) CursorAt(roomID, messageID uuid.UUID, before bool) (*MessageCursor, error) {
+	cursor := &MessageCursor{ID: messageID, Before: before}
+
+	stmt := `SELECT "ts" FROM "messages" WHERE "id" = $1 AND "room" = $2;`
+	if err := db.QueryRow(stmt, messageID, roomID).Scan(&cursor.Timestamp); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, NoMatchingMessageError
+		}
+		log.WithFields(log.Fields{
+			"err":       err,
+			"messageID": messageID,
+			"roomID":    roomID,
+		}).Errorln("unable to query message")
+		return nil, err
+	}
+
+	return cursor, nil
+}
+
+// QueryMessagePage returns up to limit messages of the room's history, starting after the cursor. A nil
+// cursor starts from the newest message. Pages continuing towards older messages are ordered newest
+// first, and pages continuing towards newer messages are ordered oldest first
+func (db MessageQueryEngine) QueryMessagePage(roomID uuid.UUID, cursor *MessageCursor, limit int) (*MessagePage, error) {
+	return db.queryPage(`"room" = $1`, roomID, cursor, limit, true)
+}
+
+// QueryReplyPage returns up to limit replies to a message, starting after the cursor. A nil cursor starts
+// from the oldest reply, so that threads read from the top
+func (db MessageQueryEngine) QueryReplyPage(messageID uuid.UUID, cursor *MessageCursor, limit int) (*MessagePage, error) {
+	return db.queryPage(`"reply_to" = $1`, messageID, cursor, limit, false)
+}
+
+// queryPage returns a page of the messages matching filter, a condition on the id given as $1. newestFirst
+// is the direction of pages started without a cursor. filter is never user input
+func (db MessageQueryEngine) queryPage(filter string, id uuid.UUID, cursor *MessageCursor, limit int, newestFirst bool) (*MessagePage, error) {
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+
+	before := newestFirst
+	if cursor != nil {
+		before = cursor.Before
+	}
+
+	query := `SELECT ` + messageColumns + ` FROM "messages" WHERE ` + filter
+	order := ` ORDER BY "ts" ASC, "id" ASC LIMIT $2;`
+	if before {
+		order = ` ORDER BY "ts" DESC, "id" DESC LIMIT $2;`
+	}
+
+	// One extra message is read to tell whether there is another page
+	args := []any{id, limit + 1}
+	if cursor != nil {
+		if before {
+			query += ` AND ("ts", "id") < ($3, $4)`
+		} else {
+			query += ` AND ("ts", "id") > ($3, $4)`
+		}
+		args = append(args, cursor.Timestamp, cursor.ID)
+	}
+
+	rows, err := db.Query(query+order, args...)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":    err,
+			"filter": filter,
+			"id":     id,
+		}).Errorln("unable to query messages")
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &MessagePage{Messages: []Message{}}
+	for rows.Next() {
+		message, err := scanMessage(rows)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Errorln("unable to scan row")
+			return nil, err
+		}
+		page.Messages = append(page.Messages, *message)
+	}
+
+	if len(page.Messages) > limit {
+		page.Messages = page.Messages[:limit]
+		last := page.Messages[limit-1]
+		next := &MessageCursor{
+			Timestamp: last.Timestamp,
+			ID:        last.ID,
+			Before:    before,
+		}
+		page.NextCursor = next.Encode()
+	}
+
+	return page, nil
+}
+
+var (
+	MessageDeletedError   = errors.New("message has been deleted")
+	NotMessageEditorError = errors.New("user is neither the author of the message nor an admin of the room")
+)
+
+// MessageEdit is a previous version of an edited message. EditedAt is when the content was replaced
+type MessageEdit struct {
+	MessageID uuid.UUID `json:"messageId"`
+	Content   string    `json:"content"`
+	EditedAt  time.Time `json:"editedAt"`
+}
+
+// GetMessage returns the message identified by messageID, including deleted messages
+func (db MessageQueryEngine) GetMessage(messageID uuid.UUID) (*Message, error) {
+	stmt := `SELECT ` + messageColumns + ` FROM "messages" WHERE "id" = $1;`
+	message, err := scanMessage(db.QueryRow(stmt, messageID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, NoMatchingMessageError
+		}
+		log.WithFields(log.Fields{
+			"err":       err,
+			"messageID": messageID,
+		}).Errorln("unable to query message")
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// EditMessage replaces the content of a message, keeping the previous content in its edit history
+func (db MessageQueryEngine) EditMessage(messageID uuid.UUID, content string, ts time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt := `INSERT INTO "message_edits" ("message_id", "content", "ts") SELECT "id", "content", $2 FROM "messages" WHERE "id" = $1 AND "deleted_at" IS NULL;`
+	res, err := tx.Exec(stmt, messageID, ts)
+	if err == nil {
+		stmt = `UPDATE "messages" SET "content" = $2, "edited_at" = $3 WHERE "id" = $1 AND "deleted_at" IS NULL;`
+		_, err = tx.Exec(stmt, messageID, content, ts)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"messageID": messageID,
+		}).Errorln("unable to edit message")
+		if err := tx.Rollback(); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Errorln("unable to rollback transaction")
+		}
+		return err
+	}
+
+	// The message was deleted after it was read by the caller
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		_ = tx.Rollback()
+		return MessageDeletedError
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Errorln("unable to commit transaction")
+		return err
+	}
+
+	return nil
+}
+
+// DeleteMessage soft deletes a message. The row is kept so that history and replies stay consistent, but
+// its content is no longer returned. NoMatchingMessageError is returned if there is no such message, or
+// it was already deleted
+func (db MessageQueryEngine) DeleteMessage(messageID uuid.UUID, ts time.Time) error {
+	stmt := `UPDATE "messages" SET "deleted_at" = $2 WHERE "id" = $1 AND "deleted_at" IS NULL;`
+	res, err := db.Exec(stmt, messageID, ts)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"messageID": messageID,
+		}).Errorln("unable to delete message")
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return NoMatchingMessageError
+	}
+
+	return nil
+}
+
+// ListMessageEdits returns the previous versions of a message, oldest first
+func (db MessageQueryEngine) ListMessageEdits(messageID uuid.UUID) ([]MessageEdit, error) {
+	stmt := `SELECT "content", "ts" FROM "message_edits" WHERE "message_id" = $1 ORDER BY "ts" ASC;`
+	rows, err := db.Query(stmt, messageID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"messageID": messageID,
+		}).Errorln("unable to query message edits")
+		return nil, err
+	}
+	defer rows.Close()
+
+	edits := []MessageEdit{}
+	for rows.Next() {
+		edit := MessageEdit{MessageID: messageID}
+		if err := rows.Scan(&edit.Content, &edit.EditedAt); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Errorln("unable to scan row")
+			return nil, err
+		}
+		edits = append(edits, edit)
+	}
+
+	return edits, nil
+}
+
+// authorize returns the message if userID may edit or delete it, which is the case for the message's
+// author and the admins of its room. Authors who have since left the room can no longer change it
+func (poster MessagePoster) authorize(messageID, userID uuid.UUID) (*Message, error) {
+	message, err := poster.Messages.GetMessage(messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	if message.DeletedAt != nil {
+		return nil, MessageDeletedError
+	}
+
+	if message.UserID == userID {
+		members, err := poster.Rooms.ListRoomMembers(message.RoomID)
+		if err != nil {
+			return nil, err
+		}
+		if !ContainsUUID(members, userID) {
+			return nil, NotMessageEditorError
+		}
+		return message, nil
+	}
+
+	isAdmin, err := poster.Rooms.IsAdmin(message.RoomID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !isAdmin {
+		return nil, NotMessageEditorError
+	}
+
+	return message, nil
+}
+
+// Edit replaces the content of a message and broadcasts the edited message to the room's other members.
+// Like posting, editing requires a verified email address if RequireVerified is set. Deleting doesn't,
+// since it can only remove what the user already said
+func (poster MessagePoster) Edit(ctx context.Context, messageID, userID uuid.UUID, content string) (*Message, error) {
+	if poster.RequireVerified {
+		if err := poster.Accounts.RequireVerified(userID); err != nil {
+			return nil, err
+		}
+	}
+
+	message, err := poster.authorize(messageID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if err := poster.Messages.EditMessage(messageID, content, now); err != nil {
+		return nil, err
+	}
+
+	message.Content = content
+	message.EditedAt = &now
+
+	// The edit is kept even if its mentions can't be updated, the mentioned users just aren't notified
+	if err := poster.updateMentions(message); err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"messageID": messageID,
+		}).Warnln("unable to update mentions")
+	}
+
+	poster.broadcastUpdate(ctx, message, userID, pkg.MessageEdited)
+
+	if poster.Unfurler != nil {
+		go poster.unfurlLinks(message)
+	}
+	return message, nil
+}
+
+// Delete soft deletes a message and broadcasts the deletion to the room's other members
+func (poster MessagePoster) Delete(ctx context.Context, messageID, userID uuid.UUID) (*Message, error) {
+	message, err := poster.authorize(messageID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if err := poster.Messages.DeleteMessage(messageID, now); err != nil {
+		return nil, err
+	}
+
+	message.Content = ""
+	message.DeletedAt = &now
+
+	poster.broadcastUpdate(ctx, message, userID, pkg.MessageDeleted)
+	return message, nil
+}
+
+// broadcastUpdate sends the updated message to every member of its room other than userID, as a message
+// of messageType so that clients can update the message in place
+func (poster MessagePoster) broadcastUpdate(ctx context.Context, message *Message, userID uuid.UUID, messageType string) {
+	members, err := poster.Rooms.ListRoomMembers(message.RoomID)
+	if err != nil {
+		return
+	}
+
+	encoded, err := message.Encode()
+	if err != nil {
+		return
+	}
+
+	if _, err := poster.Conns.BroadcastTypedMessage(ctx, FilterUUID(members, userID), messageType, encoded); err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"messageID": message.ID,
+			"type":      messageType,
+		}).Warnln("unable to broadcast message update")
+	}
+}
+
+// notifyUpdated sends a message, with its attachments, to every member of its room as a MessageUpdated
+// message, after details which are added in the background have changed. Deleted messages are skipped
+func (poster MessagePoster) notifyUpdated(ctx context.Context, messageID uuid.UUID) {
+	message, err := poster.Messages.GetMessage(messageID)
+	if err != nil || message.DeletedAt != nil {
+		return
+	}
+
+	messages := []Message{*message}
+	if err := poster.Attachments.AttachAttachments(messages); err != nil {
+		return
+	}
+
+	poster.broadcastUpdate(ctx, &messages[0], uuid.Nil, pkg.MessageUpdated)
+}
+
+// AttachQuotes sets the quote of each message which is a reply
+func (db MessageQueryEngine) AttachQuotes(messages []Message) error {
+	var ids []string
+	for _, message := range messages {
+		if message.ReplyTo != nil {
+			ids = append(ids, message.ReplyTo.String())
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	stmt := `SELECT ` + messageColumns + ` FROM "messages" WHERE "id" = ANY($1::uuid[]);`
+	rows, err := db.Query(stmt, pq.Array(ids))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Errorln("unable to query quoted messages")
+		return err
+	}
+	defer rows.Close()
+
+	quotes := make(map[uuid.UUID]*MessageQuote)
+	for rows.Next() {
+		parent, err := scanMessage(rows)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Errorln("unable to scan row")
+			return err
+		}
+		quotes[parent.ID] = parent.Preview()
+	}
+
+	for i := range messages {
+		if messages[i].ReplyTo != nil {
+			messages[i].Quote = quotes[*messages[i].ReplyTo]
+		}
+	}
+
+	return nil
+}
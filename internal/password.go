@@ -0,0 +1,271 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// MinPasswordLength is the shortest password which can be set, in characters
+	MinPasswordLength = 8
+
+	// maxPasswordLength is the longest password which can be set, in bytes, since bcrypt ignores the rest
+	maxPasswordLength = 72
+
+	// DefaultPasswordResetTTL is how long a password reset token can be used for
+	DefaultPasswordResetTTL = time.Hour
+
+	// DefaultPasswordResetLimit is the number of reset emails which can be requested for an address in
+	// each DefaultPasswordResetWindow
+	DefaultPasswordResetLimit  = 3
+	DefaultPasswordResetWindow = time.Hour
+)
+
+var (
+	WeakPasswordError      = errors.New("passwords must be 8 to 72 bytes long")
+	IncorrectPasswordError = errors.New("incorrect password")
+	InvalidResetTokenError = errors.New("password reset token is invalid, expired or already used")
+)
+
+// ValidatePassword returns WeakPasswordError if the password can't be set
+func ValidatePassword(password string) error {
+	if utf8.RuneCountInString(password) < MinPasswordLength || len(password) > maxPasswordLength {
+		return WeakPasswordError
+	}
+	return nil
+}
+
+// CheckPassword returns true if password is the account's password
+func (db AccountQueryEngine) CheckPassword(userID uuid.UUID, password string) (bool, error) {
+	var hashedPass string
+	stmt := `SELECT "hashed_pass" FROM "accounts" WHERE "id" = $1;`
+	if err := db.QueryRow(stmt, userID).Scan(&hashedPass); err != nil {
+		if err == sql.ErrNoRows {
+			return false, NoMatchingUserError
+		}
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Errorln("unable to scan account row")
+		return false, err
+	}
+
+	return ComparePasswordWithHash(hashedPass, password)
+}
+
+// SetPassword replaces the account's password with an already hashed one
+func (db AccountQueryEngine) SetPassword(userID uuid.UUID, hashedPass string) error {
+	return setPassword(db, userID, hashedPass)
+}
+
+func setPassword(db execer, userID uuid.UUID, hashedPass string) error {
+	stmt := `UPDATE "accounts" SET "hashed_pass" = $2 WHERE "id" = $1;`
+	res, err := db.Exec(stmt, userID, hashedPass)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"accountID": userID,
+		}).Errorln("unable to update password")
+		return err
+	}
+
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return NoMatchingUserError
+	}
+	return nil
+}
+
+func (db AccountQueryEngine) GetAccountByEmail(email string) (*Account, error) {
+	return db.getAccount(`"email" = $1`, email)
+}
+
+// CreatePasswordReset stores the digest of a reset token for the account, which expires at expiresAt
+func (db AccountQueryEngine) CreatePasswordReset(userID uuid.UUID, token string, expiresAt time.Time) error {
+	stmt := `INSERT INTO "password_resets" ("token_hash", "account_id", "expires_at") VALUES ($1, $2, $3);`
+	if _, err := db.Exec(stmt, hashSecretToken(token), userID, expiresAt); err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"accountID": userID,
+		}).Errorln("unable to insert password reset")
+		return err
+	}
+	return nil
+}
+
+// ResetPassword uses a reset token to replace the password of its account. The token, and every other
+// token of the account, can't be used again afterwards
+func (db AccountQueryEngine) ResetPassword(token, hashedPass string, now time.Time) (uuid.UUID, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	rollback := func() {
+		if err := tx.Rollback(); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Errorln("unable to rollback transaction")
+		}
+	}
+
+	// Claiming the token in the update makes it single use, even if it is used twice concurrently
+	var userID uuid.UUID
+	stmt := `UPDATE "password_resets" SET "used_at" = $2 WHERE "token_hash" = $1 AND "used_at" IS NULL AND "expires_at" > $2 RETURNING "account_id";`
+	if err := tx.QueryRow(stmt, hashSecretToken(token), now).Scan(&userID); err != nil {
+		rollback()
+		if err == sql.ErrNoRows {
+			return uuid.Nil, InvalidResetTokenError
+		}
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Errorln("unable to claim password reset")
+		return uuid.Nil, err
+	}
+
+	if err := setPassword(tx, userID, hashedPass); err != nil {
+		rollback()
+		return uuid.Nil, err
+	}
+
+	stmt = `UPDATE "password_resets" SET "used_at" = $2 WHERE "account_id" = $1 AND "used_at" IS NULL;`
+	if _, err := tx.Exec(stmt, userID, now); err != nil {
+		rollback()
+		log.WithFields(log.Fields{
+			"err":       err,
+			"accountID": userID,
+		}).Errorln("unable to expire password resets")
+		return uuid.Nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Errorln("unable to commit transaction")
+		return uuid.Nil, err
+	}
+
+	return userID, nil
+}
+
+// ChangePassword replaces the user's password, which requires the current password
+func (db AccountQueryEngine) ChangePassword(userID uuid.UUID, oldPassword, newPassword string) error {
+	if err := ValidatePassword(newPassword); err != nil {
+		return err
+	}
+
+	ok, err := db.CheckPassword(userID, oldPassword)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return IncorrectPasswordError
+	}
+
+	hashedPass, err := HashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	return db.SetPassword(userID, hashedPass)
+}
+
+// PasswordResetStore stores password reset tokens. It is implemented by AccountQueryEngine
+type PasswordResetStore interface {
+	GetAccountByEmail(email string) (*Account, error)
+	CreatePasswordReset(userID uuid.UUID, token string, expiresAt time.Time) error
+	ResetPassword(token, hashedPass string, now time.Time) (uuid.UUID, error)
+}
+
+// PasswordResetter emails password reset tokens to users and resets their passwords with them
+type PasswordResetter struct {
+	Accounts PasswordResetStore
+	Sender   EmailSender
+
+	// Limiter limits how many reset emails can be requested for each address, so that they can't be used
+	// to flood an inbox. Requests aren't limited if it isn't set
+	Limiter RateLimiter
+
+	// ResetURL is the page of the client which resets passwords. The token is added to it as the token
+	// query parameter. If it isn't set, the email contains only the token
+	ResetURL string
+
+	// TTL uses DefaultPasswordResetTTL if it isn't set
+	TTL time.Duration
+}
+
+func (resetter PasswordResetter) ttl() time.Duration {
+	if resetter.TTL > 0 {
+		return resetter.TTL
+	}
+	return DefaultPasswordResetTTL
+}
+
+// RequestReset emails a reset token to the account with the email. Nothing is sent if there is no such
+// account, but no error is returned either, so that callers can't tell which emails have accounts.
+// RateLimitedError is returned if too many resets were requested for the email, whether or not it has
+// an account. Sending the email takes long enough to tell whether it was sent, so callers should respond
+// without waiting for it
+func (resetter PasswordResetter) RequestReset(ctx context.Context, email string) error {
+	if resetter.Limiter != nil {
+		allowed, err := resetter.Limiter.Allow(ctx, strings.ToLower(strings.TrimSpace(email)))
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return RateLimitedError
+		}
+	}
+
+	account, err := resetter.Accounts.GetAccountByEmail(email)
+	if err != nil {
+		if err == NoMatchingUserError {
+			return nil
+		}
+		return err
+	}
+
+	token, err := newSecretToken()
+	if err != nil {
+		return err
+	}
+
+	ttl := resetter.ttl()
+	if err := resetter.Accounts.CreatePasswordReset(account.ID, token, time.Now().Add(ttl)); err != nil {
+		return err
+	}
+
+	body := "Use this code to reset your password: " + token
+	if link := tokenLink(resetter.ResetURL, token); link != "" {
+		body = "Follow this link to reset your password: " + link
+	}
+	body += "\n\nIt expires in " + strconv.Itoa(int(ttl.Minutes())) + " minutes. If you didn't ask to reset your password, you can ignore this email.\n"
+
+	if err := resetter.Sender.Send(ctx, Email{To: account.Email, Subject: "Reset your password", Body: body}); err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"accountID": account.ID,
+		}).Errorln("unable to send password reset email")
+		return err
+	}
+	return nil
+}
+
+// Reset replaces the password of the account the token was sent to
+func (resetter PasswordResetter) Reset(token, newPassword string) error {
+	if err := ValidatePassword(newPassword); err != nil {
+		return err
+	}
+
+	hashedPass, err := HashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+
+	_, err = resetter.Accounts.ResetPassword(token, hashedPass, time.Now())
+	return err
+}
@@ -0,0 +1,250 @@
+package internal
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingResetStore looks up accounts by email, and records the calls which would store and use reset
+// tokens. Whether tokens are single use or expired is decided in SQL, so it isn't modelled here
+type recordingResetStore struct {
+	accounts map[string]*Account
+
+	created []storedReset
+
+	resetToken string
+	resetHash  string
+	resetErr   error
+}
+
+type storedReset struct {
+	userID    uuid.UUID
+	token     string
+	expiresAt time.Time
+}
+
+func newRecordingResetStore(accounts ...*Account) *recordingResetStore {
+	store := &recordingResetStore{accounts: make(map[string]*Account)}
+	for _, account := range accounts {
+		store.accounts[account.Email] = account
+	}
+	return store
+}
+
+func (store *recordingResetStore) GetAccountByEmail(email string) (*Account, error) {
+	account, ok := store.accounts[email]
+	if !ok {
+		return nil, NoMatchingUserError
+	}
+	return account, nil
+}
+
+func (store *recordingResetStore) CreatePasswordReset(userID uuid.UUID, token string, expiresAt time.Time) error {
+	store.created = append(store.created, storedReset{userID, token, expiresAt})
+	return nil
+}
+
+func (store *recordingResetStore) ResetPassword(token, hashedPass string, _ time.Time) (uuid.UUID, error) {
+	store.resetToken, store.resetHash = token, hashedPass
+	return uuid.Nil, store.resetErr
+}
+
+func TestPasswordResetterEmailsLink(t *testing.T) {
+	account := &Account{ID: uuid.New(), Email: "alice@example.com"}
+	store := newRecordingResetStore(account)
+	sender := &MemoryEmailSender{}
+	resetter := PasswordResetter{
+		Accounts: store,
+		Sender:   sender,
+		ResetURL: "https://app.example.com/reset?lang=en",
+		TTL:      30 * time.Minute,
+	}
+
+	before := time.Now()
+	if err := resetter.RequestReset(context.Background(), account.Email); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(store.created) != 1 {
+		t.Fatalf("stored %d tokens, want 1", len(store.created))
+	}
+	reset := store.created[0]
+	if reset.userID != account.ID {
+		t.Errorf("stored a token for %s, want %s", reset.userID, account.ID)
+	}
+	if reset.expiresAt.Before(before.Add(30*time.Minute)) || reset.expiresAt.After(time.Now().Add(30*time.Minute)) {
+		t.Errorf("token expires at %s, want 30 minutes from now", reset.expiresAt)
+	}
+
+	email := sender.Last(account.Email)
+	if email == nil {
+		t.Fatal("no email was sent")
+	}
+	if email.Subject != "Reset your password" {
+		t.Errorf("got subject %q", email.Subject)
+	}
+	if link := tokenLink(resetter.ResetURL, reset.token); !strings.Contains(email.Body, "Follow this link to reset your password: "+link+"\n") {
+		t.Errorf("the email doesn't link to %s: %q", link, email.Body)
+	}
+	if !strings.Contains(email.Body, "It expires in 30 minutes.") {
+		t.Errorf("the email doesn't say when the link expires: %q", email.Body)
+	}
+}
+
+func TestPasswordResetterEmailsCodeWithoutResetURL(t *testing.T) {
+	account := &Account{ID: uuid.New(), Email: "alice@example.com"}
+	store := newRecordingResetStore(account)
+	sender := &MemoryEmailSender{}
+	resetter := PasswordResetter{Accounts: store, Sender: sender}
+
+	if err := resetter.RequestReset(context.Background(), account.Email); err != nil {
+		t.Fatal(err)
+	}
+
+	body := sender.Last(account.Email).Body
+	if want := "Use this code to reset your password: " + store.created[0].token + "\n"; !strings.HasPrefix(body, want) {
+		t.Errorf("got %q, want it to start with %q", body, want)
+	}
+	if !strings.Contains(body, "It expires in 60 minutes.") {
+		t.Errorf("the email doesn't use the default TTL: %q", body)
+	}
+}
+
+func TestPasswordResetterReset(t *testing.T) {
+	store := newRecordingResetStore()
+	resetter := PasswordResetter{Accounts: store, Sender: &MemoryEmailSender{}}
+
+	if err := resetter.Reset("token", "short"); err != WeakPasswordError {
+		t.Fatalf("got %v, want WeakPasswordError", err)
+	}
+	if store.resetToken != "" {
+		t.Fatalf("a weak password reached the store")
+	}
+
+	if err := resetter.Reset("token", "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	if store.resetToken != "token" {
+		t.Errorf("used token %q, want the one given", store.resetToken)
+	}
+	if ok, err := ComparePasswordWithHash(store.resetHash, "correct horse battery"); err != nil || !ok {
+		t.Errorf("the new password was not hashed")
+	}
+
+	// The store decides whether the token can be used
+	store.resetErr = InvalidResetTokenError
+	if err := resetter.Reset("token", "correct horse battery"); err != InvalidResetTokenError {
+		t.Errorf("got %v, want InvalidResetTokenError", err)
+	}
+}
+
+func TestPasswordResetterIgnoresUnknownEmail(t *testing.T) {
+	sender := &MemoryEmailSender{}
+	resetter := PasswordResetter{Accounts: newRecordingResetStore(), Sender: sender}
+
+	if err := resetter.RequestReset(context.Background(), "nobody@example.com"); err != nil {
+		t.Fatalf("got %v, want no error", err)
+	}
+	if sent := sender.Sent(); len(sent) != 0 {
+		t.Errorf("sent %d emails, want none", len(sent))
+	}
+}
+
+func TestPasswordResetterLimitsRequests(t *testing.T) {
+	account := &Account{ID: uuid.New(), Email: "alice@example.com"}
+	sender := &MemoryEmailSender{}
+	resetter := PasswordResetter{
+		Accounts: newRecordingResetStore(account),
+		Sender:   sender,
+		Limiter:  NewMemoryRateLimiter(2, time.Hour),
+	}
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if err := resetter.RequestReset(ctx, account.Email); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := resetter.RequestReset(ctx, " Alice@Example.com"); err != RateLimitedError {
+		t.Errorf("got %v, want RateLimitedError", err)
+	}
+	if sent := sender.Sent(); len(sent) != 2 {
+		t.Errorf("sent %d emails, want 2", len(sent))
+	}
+
+	// Emails without an account are limited the same way, so the limit doesn't tell them apart
+	for i := 0; i < 2; i++ {
+		_ = resetter.RequestReset(ctx, "nobody@example.com")
+	}
+	if err := resetter.RequestReset(ctx, "nobody@example.com"); err != RateLimitedError {
+		t.Errorf("unknown email: got %v, want RateLimitedError", err)
+	}
+}
+
+func TestMemoryRateLimiterStartsNewWindow(t *testing.T) {
+	limiter := NewMemoryRateLimiter(1, 20*time.Millisecond)
+	ctx := context.Background()
+
+	if ok, _ := limiter.Allow(ctx, "a"); !ok {
+		t.Fatal("first attempt was not allowed")
+	}
+	if ok, _ := limiter.Allow(ctx, "a"); ok {
+		t.Fatal("second attempt was allowed")
+	}
+	if ok, _ := limiter.Allow(ctx, "b"); !ok {
+		t.Fatal("another key was limited")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if ok, _ := limiter.Allow(ctx, "a"); !ok {
+		t.Fatal("attempt in a new window was not allowed")
+	}
+}
+
+func TestSecretTokens(t *testing.T) {
+	first, err := newSecretToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := newSecretToken()
+	if first == second {
+		t.Errorf("tokens are not random")
+	}
+	if len(first) != 43 {
+		t.Errorf("got a token of %d characters, want 43", len(first))
+	}
+	if digest := hashSecretToken("token"); digest != "3c469e9d6c5875d37a43f353d4f88e61fcf812c66eee3457465a40b0da4153e0" {
+		t.Errorf("got digest %s, want the hex SHA-256 of the token", digest)
+	}
+
+	if link := tokenLink("", first); link != "" {
+		t.Errorf("got %q without a page", link)
+	}
+	if link := tokenLink("https://app.example.com/reset?token=old&lang=en", "a+b"); link != "https://app.example.com/reset?lang=en&token=a%2Bb" {
+		t.Errorf("got %q", link)
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	tests := []struct {
+		password string
+		err      error
+	}{
+		{"", WeakPasswordError},
+		{"1234567", WeakPasswordError},
+		{"12345678", nil},
+		{"pässwörd", nil},
+		{strings.Repeat("a", maxPasswordLength), nil},
+		{strings.Repeat("a", maxPasswordLength+1), WeakPasswordError},
+		{strings.Repeat("ü", 37), WeakPasswordError},
+	}
+
+	for _, test := range tests {
+		if err := ValidatePassword(test.password); err != test.err {
+			t.Errorf("ValidatePassword(%q) = %v, want %v", test.password, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/david-wiles/groupme-clone/pkg"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"time"
+)
+
+// Statuses of a user's presence
+const (
+	PresenceOnline  = "online"
+	PresenceIdle    = "idle"
+	PresenceOffline = "offline"
+)
+
+const (
+	// DefaultIdleAfter is how long a connected user may go without any activity before they are idle
+	DefaultIdleAfter = 5 * time.Minute
+
+	// DefaultPresenceRetention is how long a user's last seen time is kept after they go offline
+	DefaultPresenceRetention = 30 * 24 * time.Hour
+
+	// DefaultPresenceSweepInterval is how often users who aren't offline are checked for webhooks which
+	// expired without being removed, for example because their courier node crashed
+	DefaultPresenceSweepInterval = 30 * time.Second
+
+	// presenceConnectedKey is the set of users whose last recorded status isn't offline
+	presenceConnectedKey = "presence:connected"
+)
+
+// Kinds of activity which update a user's presence
+const (
+	// presenceHeartbeat only records that the user is still connected
+	presenceHeartbeat = "heartbeat"
+
+	// presenceActive records that the user did something, such as connecting or sending a frame
+	presenceActive = "active"
+
+	// presenceIdle records that the client reported the user as idle
+	presenceIdle = "idle"
+
+	// presenceSweep only recomputes the user's status, without recording that they were seen
+	presenceSweep = "sweep"
+)
+
+// Presence is the status of a user. LastSeen is the last time any of the user's devices was connected
+type Presence struct {
+	UserID   uuid.UUID  `json:"userId"`
+	Status   string     `json:"status"`
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+}
+
+// PresenceFrame is the body of a FramePresence frame, sent by clients to report the user as idle, for
+// example when the app is sent to the background, or as online again
+type PresenceFrame struct {
+	Status string `json:"status"`
+}
+
+// updatePresenceScript records activity for a user and returns their status, their previous status and
+// the last time they were seen. A user is online if they are connected and were active within the idle
+// window, idle if they are connected but inactive, and offline if none of their webhooks are live. Users
+// who aren't offline are kept in the connected set, so that they can be swept once their webhooks expire
+var updatePresenceScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+if ARGV[3] == "active" then
+	redis.call("HSET", KEYS[1], "active", now)
+elseif ARGV[3] == "idle" then
+	redis.call("HSET", KEYS[1], "active", 0)
+end
+if ARGV[3] ~= "sweep" then
+	redis.call("HSET", KEYS[1], "seen", now)
+end
+
+local status = "offline"
+if redis.call("ZCOUNT", KEYS[2], now, "+inf") > 0 then
+	local active = tonumber(redis.call("HGET", KEYS[1], "active") or "0")
+	if now - active < tonumber(ARGV[2]) then
+		status = "online"
+	else
+		status = "idle"
+	end
+end
+
+local prev = redis.call("HGET", KEYS[1], "status") or "offline"
+redis.call("HSET", KEYS[1], "status", status)
+redis.call("EXPIRE", KEYS[1], ARGV[4])
+if status == "offline" then
+	redis.call("SREM", KEYS[3], ARGV[5])
+else
+	redis.call("SADD", KEYS[3], ARGV[5])
+end
+return {status, prev, redis.call("HGET", KEYS[1], "seen") or tostring(now)}
+`)
+
+// PresenceEngine tracks the presence of users in Redis. Whether a user is connected is read from the
+// webhooks registered by RegistrationEngine, so a user whose courier node disappears goes offline once
+// their webhooks expire. Activity and the last seen time are kept in a hash per user
+type PresenceEngine struct {
+	*redis.Client
+
+	// IdleAfter is how long a connected user may be inactive before they are idle
+	IdleAfter time.Duration
+
+	// Retention is how long a user's last seen time is kept
+	Retention time.Duration
+}
+
+func (rdb PresenceEngine) idleAfter() time.Duration {
+	if rdb.IdleAfter > 0 {
+		return rdb.IdleAfter
+	}
+	return DefaultIdleAfter
+}
+
+func (rdb PresenceEngine) retention() time.Duration {
+	if rdb.Retention > 0 {
+		return rdb.Retention
+	}
+	return DefaultPresenceRetention
+}
+
+func presenceKey(userID uuid.UUID) string {
+	return "presence:" + userID.String()
+}
+
+// update records activity of the given kind for the user, and returns their presence along with whether
+// their status changed
+func (rdb PresenceEngine) update(ctx context.Context, userID uuid.UUID, activity string) (*Presence, bool, error) {
+	now := time.Now()
+	keys := []string{presenceKey(userID), webhooksKey(userID), presenceConnectedKey}
+	args := []interface{}{now.Unix(), int64(rdb.idleAfter().Seconds()), activity, int64(rdb.retention().Seconds()), userID.String()}
+
+	res, err := updatePresenceScript.Run(ctx, rdb.Client, keys, args...).StringSlice()
+	if err != nil {
+		return nil, false, err
+	}
+
+	seen := time.Unix(parseUnix(res[2]), 0)
+	return &Presence{UserID: userID, Status: res[0], LastSeen: &seen}, res[0] != res[1], nil
+}
+
+// Sweep recomputes the status of every user who isn't offline and returns the presence of those whose
+// status changed. This notices users whose webhooks expired without their websockets being closed, such
+// as users of a courier node which crashed, and connected users who became idle. Each change is only
+// returned to one caller, even if several courier nodes sweep at once
+func (rdb PresenceEngine) Sweep(ctx context.Context) ([]*Presence, error) {
+	var (
+		changed []*Presence
+		cursor  uint64
+	)
+	for {
+		members, next, err := rdb.SScan(ctx, presenceConnectedKey, cursor, "", 100).Result()
+		if err != nil {
+			return changed, err
+		}
+
+		for _, member := range members {
+			userID, err := uuid.Parse(member)
+			if err != nil {
+				rdb.SRem(ctx, presenceConnectedKey, member)
+				continue
+			}
+
+			presence, ok, err := rdb.update(ctx, userID, presenceSweep)
+			if err != nil {
+				return changed, err
+			}
+			if ok {
+				changed = append(changed, presence)
+			}
+		}
+
+		if cursor = next; cursor == 0 {
+			return changed, nil
+		}
+	}
+}
+
+// GetPresence returns the presence of each user in users, in the same order
+func (rdb PresenceEngine) GetPresence(ctx context.Context, users []uuid.UUID) ([]Presence, error) {
+	now := time.Now().Unix()
+	min := strconv.FormatInt(now, 10)
+
+	pipe := rdb.Pipeline()
+	counts := make([]*redis.IntCmd, len(users))
+	fields := make([]*redis.SliceCmd, len(users))
+	for i, user := range users {
+		counts[i] = pipe.ZCount(ctx, webhooksKey(user), min, "+inf")
+		fields[i] = pipe.HMGet(ctx, presenceKey(user), "active", "seen")
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	idleAfter := int64(rdb.idleAfter().Seconds())
+	presence := make([]Presence, len(users))
+	for i, user := range users {
+		presence[i] = Presence{UserID: user, Status: PresenceOffline}
+
+		values, _ := fields[i].Result()
+		var active, seen int64
+		if len(values) == 2 {
+			active = parseUnix(values[0])
+			seen = parseUnix(values[1])
+		}
+
+		if seen > 0 {
+			lastSeen := time.Unix(seen, 0)
+			presence[i].LastSeen = &lastSeen
+		}
+
+		if count, _ := counts[i].Result(); count > 0 {
+			presence[i].Status = PresenceIdle
+			if now-active < idleAfter {
+				presence[i].Status = PresenceOnline
+			}
+		}
+	}
+
+	return presence, nil
+}
+
+// parseUnix parses a unix time read from a Redis hash, returning 0 if the field is missing
+func parseUnix(value interface{}) int64 {
+	raw, ok := value.(string)
+	if !ok {
+		return 0
+	}
+	unix, _ := strconv.ParseInt(raw, 10, 64)
+	return unix
+}
+
+// PresenceNotifier pushes presence changes to every user who shares a room with the user whose presence changed
+type PresenceNotifier struct {
+	Rooms RoomQueryEngine
+	Conns *CourierConns
+}
+
+// Notify sends the presence to the user's contacts as an ephemeral MessagePresence event
+func (notifier PresenceNotifier) Notify(ctx context.Context, presence *Presence) {
+	contacts, err := notifier.Rooms.ListContacts(presence.UserID)
+	if err != nil || len(contacts) == 0 {
+		return
+	}
+
+	encoded, err := json.Marshal(presence)
+	if err != nil {
+		return
+	}
+
+	if _, err := notifier.Conns.BroadcastEvent(ctx, contacts, pkg.MessagePresence, encoded); err != nil {
+		log.WithFields(log.Fields{
+			"err":    err,
+			"userID": presence.UserID,
+		}).Warnln("unable to broadcast presence")
+	}
+}
@@ -0,0 +1,233 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/david-wiles/groupme-clone/pkg"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxDisplayNameLength = 64
+	maxBioLength         = 500
+	maxStatusLength      = 140
+	maxAvatarURLLength   = 2048
+)
+
+var (
+	InvalidUsernameError    = errors.New("usernames must be 3 to 32 letters, digits, underscores, dots or dashes")
+	InvalidDisplayNameError = errors.New("invalid display name")
+	InvalidBioError         = errors.New("invalid bio")
+	InvalidStatusError      = errors.New("invalid status")
+	InvalidAvatarError      = errors.New("avatars must be an image uploaded by the user or an http or https URL")
+	UsernameTakenError      = errors.New("username is already taken")
+)
+
+// usernamePattern matches the usernames which can be mentioned in full, see mentionPattern
+var usernamePattern = regexp.MustCompile(`^\w[\w.\-]{1,30}\w$`)
+
+// uniqueViolation is the postgres error code for a unique constraint violation
+const uniqueViolation = "23505"
+
+// ProfileUpdate is a change to a user's profile. Fields which are nil are left unchanged, and empty
+// strings clear the field. Setting either avatar field replaces the other
+type ProfileUpdate struct {
+	Username         *string `json:"username"`
+	DisplayName      *string `json:"displayName"`
+	AvatarAttachment *string `json:"avatarAttachment"`
+	AvatarURL        *string `json:"avatarUrl"`
+	Bio              *string `json:"bio"`
+	Status           *string `json:"status"`
+}
+
+// validProfileText returns false if text is too long or contains control characters. Newlines are only
+// allowed if multiline is set
+func validProfileText(text string, maxLength int, multiline bool) bool {
+	if !utf8.ValidString(text) || utf8.RuneCountInString(text) > maxLength {
+		return false
+	}
+	for _, r := range text {
+		if unicode.IsControl(r) && !(multiline && r == '\n') {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateUsername returns InvalidUsernameError if the username can't be used
+func ValidateUsername(username string) error {
+	if !usernamePattern.MatchString(username) {
+		return InvalidUsernameError
+	}
+	return nil
+}
+
+// ValidateAvatarURL returns InvalidAvatarError unless raw is an absolute http or https URL
+func ValidateAvatarURL(raw string) error {
+	if len(raw) > maxAvatarURLLength {
+		return InvalidAvatarError
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return InvalidAvatarError
+	}
+	return nil
+}
+
+// UpdateProfile stores the profile fields of an account. UsernameTakenError is returned if another
+// account has the username
+func (db AccountQueryEngine) UpdateProfile(account *Account) error {
+	nullable := func(s string) interface{} {
+		if s == "" {
+			return nil
+		}
+		return s
+	}
+
+	stmt := `UPDATE "accounts" SET "username" = $2, "display_name" = $3, "avatar_attachment" = $4, "avatar_url" = $5, "bio" = $6, "status_text" = $7
+		WHERE "id" = $1;`
+	_, err := db.Exec(stmt, account.ID, account.Username, nullable(account.DisplayName), account.AvatarAttachment,
+		nullable(account.AvatarURL), nullable(account.Bio), nullable(account.Status))
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == uniqueViolation {
+			return UsernameTakenError
+		}
+		log.WithFields(log.Fields{
+			"err":       err,
+			"accountID": account.ID,
+		}).Errorln("unable to update account profile")
+		return err
+	}
+
+	return nil
+}
+
+// ProfileUpdater changes users' profiles and notifies the users who share a room with them
+type ProfileUpdater struct {
+	Accounts    AccountQueryEngine
+	Attachments AttachmentQueryEngine
+	Rooms       RoomQueryEngine
+	Conns       *CourierConns
+}
+
+// Update validates and applies a change to the user's profile, returning the updated account. The new
+// profile is sent to the user's contacts and the user's other clients as an ephemeral MessageProfile event
+func (updater ProfileUpdater) Update(ctx context.Context, userID uuid.UUID, update ProfileUpdate) (*Account, error) {
+	account, err := updater.Accounts.GetAccount(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if update.Username != nil {
+		if err := ValidateUsername(*update.Username); err != nil {
+			return nil, err
+		}
+		account.Username = *update.Username
+	}
+
+	if update.DisplayName != nil {
+		displayName := strings.TrimSpace(*update.DisplayName)
+		if !validProfileText(displayName, maxDisplayNameLength, false) {
+			return nil, InvalidDisplayNameError
+		}
+		account.DisplayName = displayName
+	}
+
+	if update.Bio != nil {
+		bio := strings.TrimSpace(*update.Bio)
+		if !validProfileText(bio, maxBioLength, true) {
+			return nil, InvalidBioError
+		}
+		account.Bio = bio
+	}
+
+	if update.Status != nil {
+		status := strings.TrimSpace(*update.Status)
+		if !validProfileText(status, maxStatusLength, false) {
+			return nil, InvalidStatusError
+		}
+		account.Status = status
+	}
+
+	if update.AvatarAttachment != nil && update.AvatarURL != nil && *update.AvatarAttachment != "" && *update.AvatarURL != "" {
+		return nil, InvalidAvatarError
+	}
+
+	if update.AvatarAttachment != nil {
+		account.AvatarAttachment = nil
+		if *update.AvatarAttachment != "" {
+			attachmentID, err := updater.validateAvatar(userID, *update.AvatarAttachment)
+			if err != nil {
+				return nil, err
+			}
+			account.AvatarAttachment = &attachmentID
+			account.AvatarURL = ""
+		}
+	}
+
+	if update.AvatarURL != nil {
+		account.AvatarURL = strings.TrimSpace(*update.AvatarURL)
+		if account.AvatarURL != "" {
+			if err := ValidateAvatarURL(account.AvatarURL); err != nil {
+				return nil, err
+			}
+			account.AvatarAttachment = nil
+		}
+	}
+
+	if err := updater.Accounts.UpdateProfile(account); err != nil {
+		return nil, err
+	}
+
+	updater.notify(ctx, account.Profile())
+	return account, nil
+}
+
+// validateAvatar returns the ID of the attachment to use as the user's avatar, which must be an image
+// uploaded by the user which isn't part of a message
+func (updater ProfileUpdater) validateAvatar(userID uuid.UUID, raw string) (uuid.UUID, error) {
+	attachmentID, err := uuid.Parse(raw)
+	if err != nil {
+		return uuid.Nil, InvalidAvatarError
+	}
+
+	attachment, err := updater.Attachments.GetAttachment(attachmentID)
+	if err == NoMatchingAttachmentError {
+		return uuid.Nil, InvalidAvatarError
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	if attachment.UserID != userID || attachment.MessageID != nil || !strings.HasPrefix(attachment.ContentType, "image/") {
+		return uuid.Nil, InvalidAvatarError
+	}
+	return attachmentID, nil
+}
+
+func (updater ProfileUpdater) notify(ctx context.Context, profile *Profile) {
+	contacts, err := updater.Rooms.ListContacts(profile.ID)
+	if err != nil {
+		return
+	}
+
+	encoded, err := json.Marshal(profile)
+	if err != nil {
+		return
+	}
+
+	if _, err := updater.Conns.BroadcastEvent(ctx, append(contacts, profile.ID), pkg.MessageProfile, encoded); err != nil {
+		log.WithFields(log.Fields{
+			"err":    err,
+			"userID": profile.ID,
+		}).Warnln("unable to broadcast profile")
+	}
+}
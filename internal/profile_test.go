@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateUsername(t *testing.T) {
+	tests := []struct {
+		username string
+		err      error
+	}{
+		{"alice", nil},
+		{"bob_2", nil},
+		{"first.last-name", nil},
+		{"_x_", nil},
+		{"abc", nil},
+		{strings.Repeat("a", 32), nil},
+		{"ab", InvalidUsernameError},
+		{strings.Repeat("a", 33), InvalidUsernameError},
+		{"", InvalidUsernameError},
+		{".alice", InvalidUsernameError},
+		{"alice.", InvalidUsernameError},
+		{"alice-", InvalidUsernameError},
+		{"al ice", InvalidUsernameError},
+		{"alice@example", InvalidUsernameError},
+		{"al\nice", InvalidUsernameError},
+	}
+
+	for _, test := range tests {
+		if err := ValidateUsername(test.username); err != test.err {
+			t.Errorf("ValidateUsername(%q) = %v, want %v", test.username, err, test.err)
+		}
+	}
+}
+
+func TestValidProfileText(t *testing.T) {
+	tests := []struct {
+		text      string
+		maxLength int
+		multiline bool
+		valid     bool
+	}{
+		{"", 10, false, true},
+		{"Alice", 10, false, true},
+		{"Ålice 🙂", 7, false, true},
+		{strings.Repeat("é", 11), 10, false, false},
+		{"two\nlines", 20, false, false},
+		{"two\nlines", 20, true, true},
+		{"tab\there", 20, true, false},
+		{"bell\a", 20, false, false},
+		{"\xff", 20, false, false},
+	}
+
+	for _, test := range tests {
+		if valid := validProfileText(test.text, test.maxLength, test.multiline); valid != test.valid {
+			t.Errorf("validProfileText(%q, %d, %v) = %v, want %v", test.text, test.maxLength, test.multiline, valid, test.valid)
+		}
+	}
+}
+
+func TestValidateAvatarURL(t *testing.T) {
+	tests := []struct {
+		raw string
+		err error
+	}{
+		{"https://example.com/avatar.png", nil},
+		{"http://example.com/a?size=64", nil},
+		{"ftp://example.com/avatar.png", InvalidAvatarError},
+		{"javascript:alert(1)", InvalidAvatarError},
+		{"/avatar.png", InvalidAvatarError},
+		{"https://", InvalidAvatarError},
+		{"https://example.com/" + strings.Repeat("a", maxAvatarURLLength), InvalidAvatarError},
+	}
+
+	for _, test := range tests {
+		if err := ValidateAvatarURL(test.raw); err != test.err {
+			t.Errorf("ValidateAvatarURL(%q) = %v, want %v", test.raw, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"sync"
+	"time"
+)
+
+var RateLimitedError = errors.New("too many attempts, try again later")
+
+// RateLimiter counts attempts at an action for each key, such as an email address, and allows at most a
+// limited number of attempts in each window of time
+type RateLimiter interface {
+	// Allow records an attempt for the key, and returns false if the key has used up its attempts
+	Allow(ctx context.Context, key string) (bool, error)
+}
+
+// RedisRateLimiter counts attempts in keys which expire at the end of their window, so that the limit is
+// shared by every instance of the service
+type RedisRateLimiter struct {
+	*redis.Client
+
+	// Prefix separates the keys of limiters for different actions
+	Prefix string
+	Limit  int
+	Window time.Duration
+}
+
+// rateLimitScript counts an attempt, starting the window with the first attempt
+var rateLimitScript = redis.NewScript(`
+local attempts = redis.call("INCR", KEYS[1])
+if attempts == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return attempts
+`)
+
+func (rdb RedisRateLimiter) Allow(ctx context.Context, key string) (bool, error) {
+	attempts, err := rateLimitScript.Run(ctx, rdb.Client, []string{"ratelimit:" + rdb.Prefix + ":" + key}, rdb.Window.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	return attempts <= rdb.Limit, nil
+}
+
+// MemoryRateLimiter is a RateLimiter which is kept in memory. It is not shared between instances and is
+// intended for tests and local development
+type MemoryRateLimiter struct {
+	mu      sync.Mutex
+	windows map[string]*rateWindow
+
+	Limit  int
+	Window time.Duration
+}
+
+type rateWindow struct {
+	attempts int
+	end      time.Time
+}
+
+func NewMemoryRateLimiter(limit int, window time.Duration) *MemoryRateLimiter {
+	return &MemoryRateLimiter{
+		windows: make(map[string]*rateWindow),
+		Limit:   limit,
+		Window:  window,
+	}
+}
+
+func (limiter *MemoryRateLimiter) Allow(_ context.Context, key string) (bool, error) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := time.Now()
+	window, ok := limiter.windows[key]
+	if !ok || !now.Before(window.end) {
+		// Expired windows are dropped whenever a window starts, so that keys which aren't used again
+		// don't stay in memory
+		for k, w := range limiter.windows {
+			if !now.Before(w.end) {
+				delete(limiter.windows, k)
+			}
+		}
+		window = &rateWindow{end: now.Add(limiter.Window)}
+		limiter.windows[key] = window
+	}
+
+	window.attempts++
+	return window.attempts <= limiter.Limit, nil
+}
@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/david-wiles/groupme-clone/pkg"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Like is the reaction used when none is given, the equivalent of GroupMe's heart
+const Like = "like"
+
+// maxReactionLength is the maximum length of a reaction in runes, long enough for any emoji sequence
+const maxReactionLength = 16
+
+var InvalidReactionError = errors.New("invalid reaction")
+
+// ReactionCount is the number of users who reacted to a message with a single reaction. ReactedByMe is
+// true if the user reading the message is one of them
+type ReactionCount struct {
+	Reaction    string `json:"reaction"`
+	Count       int    `json:"count"`
+	ReactedByMe bool   `json:"reactedByMe,omitempty"`
+}
+
+// ReactionEvent is the payload of a MessageReaction message, sent to room members when a reaction is
+// added or removed. Count is the number of users with the reaction after the change
+type ReactionEvent struct {
+	MessageID uuid.UUID `json:"messageId"`
+	RoomID    uuid.UUID `json:"roomId"`
+	UserID    uuid.UUID `json:"userId"`
+	Reaction  string    `json:"reaction"`
+	Added     bool      `json:"added"`
+	Count     int       `json:"count"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// NormalizeReaction returns the reaction to store for the requested one, or InvalidReactionError if it
+// can't be used. An empty reaction is a Like
+func NormalizeReaction(reaction string) (string, error) {
+	reaction = strings.TrimSpace(reaction)
+	if reaction == "" {
+		return Like, nil
+	}
+
+	if !utf8.ValidString(reaction) || utf8.RuneCountInString(reaction) > maxReactionLength || strings.ContainsAny(reaction, " \t\r\n") {
+		return "", InvalidReactionError
+	}
+	return reaction, nil
+}
+
+// AddReaction records the user's reaction to a message. added is false if the user had already reacted
+// with the same reaction
+func (db MessageQueryEngine) AddReaction(messageID, userID uuid.UUID, reaction string, ts time.Time) (added bool, err error) {
+	stmt := `INSERT INTO "message_reactions" ("message_id", "account_id", "reaction", "ts") VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING;`
+	res, err := db.Exec(stmt, messageID, userID, reaction, ts)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"messageID": messageID,
+			"userID":    userID,
+		}).Errorln("unable to add reaction")
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// RemoveReaction removes the user's reaction from a message. removed is false if the user hadn't reacted
+// with the reaction
+func (db MessageQueryEngine) RemoveReaction(messageID, userID uuid.UUID, reaction string) (removed bool, err error) {
+	stmt := `DELETE FROM "message_reactions" WHERE "message_id" = $1 AND "account_id" = $2 AND "reaction" = $3;`
+	res, err := db.Exec(stmt, messageID, userID, reaction)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"messageID": messageID,
+			"userID":    userID,
+		}).Errorln("unable to remove reaction")
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// CountReaction returns the number of users who reacted to a message with the reaction
+func (db MessageQueryEngine) CountReaction(messageID uuid.UUID, reaction string) (int, error) {
+	var count int
+	stmt := `SELECT COUNT(*) FROM "message_reactions" WHERE "message_id" = $1 AND "reaction" = $2;`
+	if err := db.QueryRow(stmt, messageID, reaction).Scan(&count); err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"messageID": messageID,
+		}).Errorln("unable to count reactions")
+		return 0, err
+	}
+	return count, nil
+}
+
+// AttachReactions sets the aggregated reactions of each message, as seen by viewerID. Reactions are
+// ordered by when they were first used on the message
+func (db MessageQueryEngine) AttachReactions(messages []Message, viewerID uuid.UUID) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(messages))
+	byID := make(map[uuid.UUID]*Message, len(messages))
+	for i := range messages {
+		ids[i] = messages[i].ID.String()
+		byID[messages[i].ID] = &messages[i]
+	}
+
+	stmt := `SELECT "message_id", "reaction", COUNT(*), BOOL_OR("account_id" = $2) FROM "message_reactions"
+		WHERE "message_id" = ANY($1::uuid[]) GROUP BY "message_id", "reaction" ORDER BY MIN("ts");`
+	rows, err := db.Query(stmt, pq.Array(ids), viewerID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Errorln("unable to query reactions")
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID uuid.UUID
+		count := ReactionCount{}
+		if err := rows.Scan(&messageID, &count.Reaction, &count.Count, &count.ReactedByMe); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Errorln("unable to scan row")
+			return err
+		}
+
+		// Reactions to deleted messages are not returned along with their content
+		if message, ok := byID[messageID]; ok && message.DeletedAt == nil {
+			message.Reactions = append(message.Reactions, count)
+		}
+	}
+
+	return nil
+}
+
+// React adds or removes the user's reaction to a message, and broadcasts the change to the room's other
+// members. The user must be a member of the message's room
+func (poster MessagePoster) React(ctx context.Context, messageID, userID uuid.UUID, reaction string, add bool) (*ReactionEvent, error) {
+	message, err := poster.Messages.GetMessage(messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	if message.DeletedAt != nil {
+		return nil, MessageDeletedError
+	}
+
+	members, err := poster.Rooms.ListRoomMembers(message.RoomID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ContainsUUID(members, userID) {
+		return nil, NotRoomMemberError
+	}
+
+	event := &ReactionEvent{
+		MessageID: messageID,
+		RoomID:    message.RoomID,
+		UserID:    userID,
+		Reaction:  reaction,
+		Added:     add,
+		Timestamp: time.Now(),
+	}
+
+	var changed bool
+	if add {
+		changed, err = poster.Messages.AddReaction(messageID, userID, reaction, event.Timestamp)
+	} else {
+		changed, err = poster.Messages.RemoveReaction(messageID, userID, reaction)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if event.Count, err = poster.Messages.CountReaction(messageID, reaction); err != nil {
+		return nil, err
+	}
+
+	// Reacting twice, or removing a reaction which doesn't exist, changes nothing
+	if !changed {
+		return event, nil
+	}
+
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := poster.Conns.BroadcastTypedMessage(ctx, FilterUUID(members, userID), pkg.MessageReaction, encoded); err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"messageID": messageID,
+			"userID":    userID,
+		}).Warnln("unable to broadcast reaction")
+	}
+
+	return event, nil
+}
@@ -4,51 +4,101 @@ import (
 	"context"
 	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
+	"strconv"
 	"time"
 )
 
+// DefaultWebhookTTL is how long a registered webhook is considered live without being refreshed
+// when RegistrationEngine.TTL is not set
+const DefaultWebhookTTL = time.Hour * 168
+
+// RegistrationEngine keeps track of the webhooks of every websocket a user has open. Each user
+// has a sorted set of webhooks, one per WebsocketConnection, scored by the time the entry expires.
+// This allows a single user to be connected from many devices across many courier nodes.
 type RegistrationEngine struct {
 	*redis.Client
+
+	// TTL is how long a webhook stays registered unless it is refreshed with AddUserWebhook
+	TTL time.Duration
+}
+
+func (rdb RegistrationEngine) ttl() time.Duration {
+	if rdb.TTL > 0 {
+		return rdb.TTL
+	}
+	return DefaultWebhookTTL
+}
+
+func webhooksKey(userID uuid.UUID) string {
+	return "webhooks:" + userID.String()
 }
 
-func (rdb RegistrationEngine) SetUserWebhook(ctx context.Context, webhook string, userID uuid.UUID) error {
-	if _, err := rdb.Set(ctx, userID.String(), webhook, time.Hour*168).Result(); err != nil {
+// AddUserWebhook adds webhook to the user's set of webhooks, or refreshes its expiration if it
+// is already registered
+func (rdb RegistrationEngine) AddUserWebhook(ctx context.Context, userID uuid.UUID, webhook string) error {
+	key := webhooksKey(userID)
+	now := time.Now()
+	ttl := rdb.ttl()
+	expires := now.Add(ttl)
+
+	keyTTL := DefaultWebhookTTL
+	if ttl > keyTTL {
+		keyTTL = ttl
+	}
+
+	// Expired webhooks are pruned whenever a new one is added so the set doesn't grow unbounded
+	pipe := rdb.TxPipeline()
+	pipe.ZRemRangeByScore(ctx, key, "-inf", "("+strconv.FormatInt(now.Unix(), 10))
+	pipe.ZAdd(ctx, key, redis.Z{Score: float64(expires.Unix()), Member: webhook})
+	// The key itself outlives any single entry so that a short TTL used by one courier node doesn't
+	// expire webhooks registered by nodes using a longer one
+	pipe.Expire(ctx, key, keyTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (rdb RegistrationEngine) GetUserWebhook(ctx context.Context, userID uuid.UUID) (string, error) {
-	w, err := rdb.Get(ctx, userID.String()).Result()
+// GetUserWebhooks returns every unexpired webhook registered to the user
+func (rdb RegistrationEngine) GetUserWebhooks(ctx context.Context, userID uuid.UUID) ([]string, error) {
+	webhooks, err := rdb.ZRangeByScore(ctx, webhooksKey(userID), &redis.ZRangeBy{
+		Min: strconv.FormatInt(time.Now().Unix(), 10),
+		Max: "+inf",
+	}).Result()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return w, nil
+	return webhooks, nil
 }
 
-func (rdb RegistrationEngine) ListUsersWebhook(ctx context.Context, users []uuid.UUID) ([]string, error) {
-	var usersList []string
-	for _, user := range users {
-		usersList = append(usersList, user.String())
+// ListUsersWebhooks returns the unexpired webhooks of each user in users. Users without any
+// registered webhooks are omitted from the result
+func (rdb RegistrationEngine) ListUsersWebhooks(ctx context.Context, users []uuid.UUID) (map[uuid.UUID][]string, error) {
+	min := strconv.FormatInt(time.Now().Unix(), 10)
+
+	pipe := rdb.Pipeline()
+	cmds := make([]*redis.StringSliceCmd, len(users))
+	for i, user := range users {
+		cmds[i] = pipe.ZRangeByScore(ctx, webhooksKey(user), &redis.ZRangeBy{Min: min, Max: "+inf"})
 	}
 
-	list, err := rdb.MGet(ctx, usersList...).Result()
-	if err != nil {
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
 		return nil, err
 	}
 
-	var webhooks []string
-	for _, v := range list {
-		if webhook, ok := v.(string); ok {
-			webhooks = append(webhooks, webhook)
+	webhooks := make(map[uuid.UUID][]string)
+	for i, cmd := range cmds {
+		if list, err := cmd.Result(); err == nil && len(list) > 0 {
+			webhooks[users[i]] = list
 		}
 	}
 
 	return webhooks, nil
 }
 
-func (rdb RegistrationEngine) RemoveUserWebhook(ctx context.Context, userID uuid.UUID) error {
-	if _, err := rdb.Del(ctx, userID.String(), userID.String()).Result(); err != nil {
+// RemoveUserWebhook removes a single webhook from the user's set, leaving any other devices registered
+func (rdb RegistrationEngine) RemoveUserWebhook(ctx context.Context, userID uuid.UUID, webhook string) error {
+	if _, err := rdb.ZRem(ctx, webhooksKey(userID), webhook).Result(); err != nil {
 		return err
 	}
 	return nil
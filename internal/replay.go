@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultReplayBufferSize is the number of recent messages kept per user for session resumption when
+// no size is configured
+const DefaultReplayBufferSize = 256
+
+// ReplayBuffer assigns per-user sequence numbers to outbound messages and keeps a bounded buffer of the
+// most recent messages sent to each user, so that a client resuming its session can be sent everything
+// newer than the last sequence number it acknowledged.
+type ReplayBuffer interface {
+	// Next returns the user's next sequence number. It is called once for each delivery to the user, so
+	// every device receiving the delivery sees the same sequence number
+	Next(ctx context.Context, userID uuid.UUID) (uint64, error)
+
+	// Append adds a sequenced delivery to the user's buffer, dropping the oldest entries if the buffer is full
+	Append(ctx context.Context, userID uuid.UUID, delivery PendingDelivery) error
+
+	// Since returns the buffered deliveries with a sequence number greater than seq, in sequence order
+	Since(ctx context.Context, userID uuid.UUID, seq uint64) ([]PendingDelivery, error)
+}
+
+// RedisReplayBuffer keeps each user's sequence counter in Redis, along with a sorted set of recent
+// deliveries scored by sequence number
+type RedisReplayBuffer struct {
+	*redis.Client
+
+	// Size is the maximum number of deliveries kept per user
+	Size int64
+
+	// Retention is how long buffered deliveries are kept after the user's last message
+	Retention time.Duration
+}
+
+func (rdb RedisReplayBuffer) size() int64 {
+	if rdb.Size > 0 {
+		return rdb.Size
+	}
+	return DefaultReplayBufferSize
+}
+
+func (rdb RedisReplayBuffer) retention() time.Duration {
+	if rdb.Retention > 0 {
+		return rdb.Retention
+	}
+	return DefaultDeliveryRetention
+}
+
+func sequenceKey(userID uuid.UUID) string {
+	return "seq:" + userID.String()
+}
+
+func replayKey(userID uuid.UUID) string {
+	return "replay:" + userID.String()
+}
+
+func (rdb RedisReplayBuffer) Next(ctx context.Context, userID uuid.UUID) (uint64, error) {
+	seq, err := rdb.Incr(ctx, sequenceKey(userID)).Uint64()
+	if err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+func (rdb RedisReplayBuffer) Append(ctx context.Context, userID uuid.UUID, delivery PendingDelivery) error {
+	encoded, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	key := replayKey(userID)
+
+	pipe := rdb.TxPipeline()
+	pipe.ZAdd(ctx, key, redis.Z{Score: float64(delivery.Seq), Member: encoded})
+	pipe.ZRemRangeByRank(ctx, key, 0, -rdb.size()-1)
+	pipe.Expire(ctx, key, rdb.retention())
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (rdb RedisReplayBuffer) Since(ctx context.Context, userID uuid.UUID, seq uint64) ([]PendingDelivery, error) {
+	members, err := rdb.ZRangeByScore(ctx, replayKey(userID), &redis.ZRangeBy{
+		Min: "(" + strconv.FormatUint(seq, 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := []PendingDelivery{}
+	for _, member := range members {
+		delivery := PendingDelivery{}
+		if err := json.Unmarshal([]byte(member), &delivery); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, nil
+}
+
+// MemoryReplayBuffer is a ReplayBuffer kept in memory. It is not shared between courier nodes and is
+// intended for tests and local development.
+type MemoryReplayBuffer struct {
+	mu       sync.Mutex
+	counters map[uuid.UUID]uint64
+	buffers  map[uuid.UUID][]PendingDelivery
+
+	Size int
+}
+
+func NewMemoryReplayBuffer(size int) *MemoryReplayBuffer {
+	return &MemoryReplayBuffer{
+		counters: make(map[uuid.UUID]uint64),
+		buffers:  make(map[uuid.UUID][]PendingDelivery),
+		Size:     size,
+	}
+}
+
+func (b *MemoryReplayBuffer) Next(_ context.Context, userID uuid.UUID) (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.counters[userID]++
+	return b.counters[userID], nil
+}
+
+func (b *MemoryReplayBuffer) Append(_ context.Context, userID uuid.UUID, delivery PendingDelivery) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	size := b.Size
+	if size <= 0 {
+		size = DefaultReplayBufferSize
+	}
+
+	buffer := append(b.buffers[userID], delivery)
+	if len(buffer) > size {
+		buffer = buffer[len(buffer)-size:]
+	}
+	b.buffers[userID] = buffer
+
+	return nil
+}
+
+func (b *MemoryReplayBuffer) Since(_ context.Context, userID uuid.UUID, seq uint64) ([]PendingDelivery, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	deliveries := []PendingDelivery{}
+	for _, delivery := range b.buffers[userID] {
+		if delivery.Seq > seq {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+
+	return deliveries, nil
+}
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"testing"
+)
+
+func TestMemoryReplayBufferSequencesPerUser(t *testing.T) {
+	ctx := context.Background()
+	buffer := NewMemoryReplayBuffer(4)
+	alice, bob := uuid.New(), uuid.New()
+
+	for want := uint64(1); want <= 3; want++ {
+		if seq, _ := buffer.Next(ctx, alice); seq != want {
+			t.Fatalf("expected seq %d, got %d", want, seq)
+		}
+	}
+	if seq, _ := buffer.Next(ctx, bob); seq != 1 {
+		t.Fatalf("expected each user to have their own sequence, got %d", seq)
+	}
+}
+
+func TestMemoryReplayBufferKeepsMostRecent(t *testing.T) {
+	ctx := context.Background()
+	buffer := NewMemoryReplayBuffer(3)
+	userID := uuid.New()
+
+	for i := 0; i < 5; i++ {
+		seq, _ := buffer.Next(ctx, userID)
+		_ = buffer.Append(ctx, userID, PendingDelivery{Seq: seq, Payload: []byte("ok")})
+	}
+
+	since, _ := buffer.Since(ctx, userID, 0)
+	if len(since) != 3 || since[0].Seq != 3 || since[2].Seq != 5 {
+		t.Fatalf("expected the last three deliveries, got %+v", since)
+	}
+
+	since, _ = buffer.Since(ctx, userID, 4)
+	if len(since) != 1 || since[0].Seq != 5 {
+		t.Fatalf("expected only the delivery after seq 4, got %+v", since)
+	}
+}
+
+func TestCourierConnsSequencesIdenticalMessages(t *testing.T) {
+	ctx := context.Background()
+	conns, _, replay := newTestCourierConns()
+	userID := uuid.New()
+
+	first, _ := conns.queue(ctx, userID, "", []byte("ok"))
+	second, _ := conns.queue(ctx, userID, "", []byte("ok"))
+	if first.Seq == 0 || second.Seq != first.Seq+1 {
+		t.Fatalf("expected identical messages to get consecutive sequence numbers, got %d and %d", first.Seq, second.Seq)
+	}
+
+	// Both are buffered, so a device resuming before either is replayed both
+	since, _ := replay.Since(ctx, userID, first.Seq-1)
+	if len(since) != 2 {
+		t.Fatalf("expected both messages to be replayed, got %+v", since)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
+	"time"
 )
 
 type Room struct {
@@ -19,6 +20,8 @@ type RoomQueryEngine struct {
 var (
 	NoMatchingRoomError = errors.New("no matching room found")
 	AlreadyJoinedError  = errors.New("user is already a member of room")
+
+	NoMatchingMessageError = errors.New("no matching message found in room")
 )
 
 func (db RoomQueryEngine) CreateRoom(name string, userID uuid.UUID) (*Room, error) {
@@ -197,6 +200,7 @@ func (db RoomQueryEngine) ListRoomMembers(roomID uuid.UUID) ([]uuid.UUID, error)
 			"err":    err,
 			"roomID": roomID,
 		}).Errorln("unable to query joined rooms")
+		return nil, err
 	}
 
 	var userID uuid.UUID
@@ -287,3 +291,175 @@ func (db RoomQueryEngine) GetJoinedRooms(userID uuid.UUID) ([]Room, error) {
 
 	return rooms, nil
 }
+
+// ListContacts returns every other user who shares at least one room with userID
+func (db RoomQueryEngine) ListContacts(userID uuid.UUID) ([]uuid.UUID, error) {
+	stmt := `SELECT DISTINCT "account_id" FROM "joined_rooms" WHERE "account_id" <> $1 AND "room_id" IN (SELECT "room_id" FROM "joined_rooms" WHERE "account_id" = $1);`
+	rows, err := db.Query(stmt, userID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":    err,
+			"userID": userID,
+		}).Errorln("unable to query contacts")
+		return nil, err
+	}
+	defer rows.Close()
+
+	var contactID uuid.UUID
+	contacts := []uuid.UUID{}
+
+	for rows.Next() {
+		if err := rows.Scan(&contactID); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Errorln("unable to scan row")
+			return nil, err
+		}
+		contacts = append(contacts, contactID)
+	}
+
+	return contacts, nil
+}
+
+// JoinedRoom is a room the user is a member of, along with the number of messages from other members
+// posted since the last message the user read
+type JoinedRoom struct {
+	Room
+	Unread   int        `json:"unread"`
+	LastRead *uuid.UUID `json:"lastRead,omitempty"`
+}
+
+// ReadReceipt is the last message a member of a room has read
+type ReadReceipt struct {
+	RoomID    uuid.UUID `json:"roomId"`
+	UserID    uuid.UUID `json:"userId"`
+	MessageID uuid.UUID `json:"messageId"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// GetJoinedRoomsWithUnread returns the rooms the user has joined along with their unread counts. Messages
+// are ordered by timestamp and then by ID, so messages sharing a timestamp with the last read message
+// are only unread if they come after it. Deleted messages are never unread
+func (db RoomQueryEngine) GetJoinedRoomsWithUnread(userID uuid.UUID) ([]JoinedRoom, error) {
+	stmt := `SELECT r."id", r."name", jr."last_read_message", (
+		SELECT COUNT(*) FROM "messages" m
+		WHERE m."room" = r."id" AND m."account_id" <> $1 AND m."deleted_at" IS NULL
+			AND (jr."last_read_ts" IS NULL OR (m."ts", m."id") > (jr."last_read_ts", jr."last_read_message"))
+	) FROM "rooms" r JOIN "joined_rooms" jr ON r."id" = jr."room_id" WHERE jr."account_id" = $1;`
+	rows, err := db.Query(stmt, userID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":    err,
+			"userID": userID,
+		}).Errorln("unable to query joined rooms")
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := []JoinedRoom{}
+
+	for rows.Next() {
+		room := JoinedRoom{}
+		var lastRead uuid.NullUUID
+		if err := rows.Scan(&room.ID, &room.Name, &lastRead, &room.Unread); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Warnln("unable to scan row")
+			continue
+		}
+		if lastRead.Valid {
+			room.LastRead = &lastRead.UUID
+		}
+		rooms = append(rooms, room)
+	}
+
+	return rooms, nil
+}
+
+// MarkRead records messageID as the last message the user has read in the room. The receipt only moves
+// forward in the order of (timestamp, ID), so advanced is false if the user had already read the message
+// or a newer one. NoMatchingMessageError is returned if the message was not posted in the room
+func (db RoomQueryEngine) MarkRead(roomID, userID, messageID uuid.UUID) (receipt *ReadReceipt, advanced bool, err error) {
+	receipt = &ReadReceipt{RoomID: roomID, UserID: userID, MessageID: messageID}
+
+	stmt := `SELECT "ts" FROM "messages" WHERE "id" = $1 AND "room" = $2;`
+	if err := db.QueryRow(stmt, messageID, roomID).Scan(&receipt.Timestamp); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, false, NoMatchingMessageError
+		}
+		log.WithFields(log.Fields{
+			"err":       err,
+			"messageID": messageID,
+			"roomID":    roomID,
+		}).Errorln("unable to query message")
+		return nil, false, err
+	}
+
+	stmt = `UPDATE "joined_rooms" SET "last_read_message" = $3, "last_read_ts" = $4
+		WHERE "account_id" = $1 AND "room_id" = $2 AND ("last_read_ts" IS NULL OR ("last_read_ts", "last_read_message") < ($4, $3));`
+	res, err := db.Exec(stmt, userID, roomID, messageID, receipt.Timestamp)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"messageID": messageID,
+			"roomID":    roomID,
+			"userID":    userID,
+		}).Errorln("unable to update read receipt")
+		return nil, false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return nil, false, err
+	}
+
+	return receipt, affected > 0, nil
+}
+
+// ListReadReceipts returns the read receipt of every member of the room who has read any message
+func (db RoomQueryEngine) ListReadReceipts(roomID uuid.UUID) ([]ReadReceipt, error) {
+	stmt := `SELECT "account_id", "last_read_message", "last_read_ts" FROM "joined_rooms" WHERE "room_id" = $1 AND "last_read_message" IS NOT NULL;`
+	rows, err := db.Query(stmt, roomID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":    err,
+			"roomID": roomID,
+		}).Errorln("unable to query read receipts")
+		return nil, err
+	}
+	defer rows.Close()
+
+	receipts := []ReadReceipt{}
+
+	for rows.Next() {
+		receipt := ReadReceipt{RoomID: roomID}
+		if err := rows.Scan(&receipt.UserID, &receipt.MessageID, &receipt.Timestamp); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Errorln("unable to scan row")
+			return nil, err
+		}
+		receipts = append(receipts, receipt)
+	}
+
+	return receipts, nil
+}
+
+// IsAdmin returns true if the user is an admin of the room
+func (db RoomQueryEngine) IsAdmin(roomID, userID uuid.UUID) (bool, error) {
+	var isAdmin bool
+	stmt := `SELECT "is_admin" FROM "joined_rooms" WHERE "account_id" = $1 AND "room_id" = $2;`
+	if err := db.QueryRow(stmt, userID, roomID).Scan(&isAdmin); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		log.WithFields(log.Fields{
+			"err":    err,
+			"roomID": roomID,
+			"userID": userID,
+		}).Errorln("unable to query admin")
+		return false, err
+	}
+
+	return isAdmin, nil
+}
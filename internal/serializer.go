@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"errors"
+	"github.com/david-wiles/groupme-clone/pkg"
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+)
+
+var UnsupportedMessageError = errors.New("message type is not supported by serializer")
+
+// Websocket subprotocols supported by the courier. The version is bumped whenever a change to the wire
+// protocol would break existing clients, so that old and new versions can be served side by side
+const (
+	JSONSubprotocolV1     = "courier.v1.json"
+	ProtobufSubprotocolV1 = "courier.v1.protobuf"
+)
+
+// SupportedSubprotocols lists the subprotocols which can be negotiated with the courier
+var SupportedSubprotocols = []string{JSONSubprotocolV1, ProtobufSubprotocolV1}
+
+// NegotiateSubprotocol returns the first of the subprotocols requested by the client which is supported,
+// or false if none of them are
+func NegotiateSubprotocol(requested []string) (string, bool) {
+	for _, subprotocol := range requested {
+		if _, ok := SerializerForSubprotocol(subprotocol); ok {
+			return subprotocol, true
+		}
+	}
+	return "", false
+}
+
+// SerializerForSubprotocol returns the serializer used by the subprotocol, or false if the subprotocol
+// is not supported
+func SerializerForSubprotocol(subprotocol string) (pkg.Serializer, bool) {
+	switch subprotocol {
+	case JSONSubprotocolV1:
+		return pkg.JSONSerializer{}, true
+	case ProtobufSubprotocolV1:
+		return ProtobufSerializer{}, true
+	default:
+		return nil, false
+	}
+}
+
+// ProtobufSerializer encodes the websocket wire protocol using the messages defined in courier.proto.
+// Messages are sent as binary frames, and payloads are sent as raw bytes rather than base64 encoded
+type ProtobufSerializer struct{}
+
+func (ProtobufSerializer) Serialize(s pkg.Serializable) (int, []byte, error) {
+	var msg proto.Message
+
+	switch v := s.(type) {
+	case *pkg.ClientMessage:
+		msg = &ClientMessage{
+			Payload:     v.Payload,
+			Cid:         v.Cid,
+			Seq:         v.Seq,
+			Acknowledge: v.Acknowledge,
+			Type:        v.Type,
+			Ref:         v.Ref,
+			Error:       v.Error,
+		}
+	case *pkg.ClientAck:
+		msg = &ClientAck{Cid: v.Cid}
+	case *pkg.ClientFrame:
+		msg = &ClientFrame{Cid: v.Cid, Type: v.Type, Ref: v.Ref, Data: v.Data}
+	case *pkg.ClientResume:
+		msg = &ClientResume{LastSeq: v.LastSeq}
+	default:
+		return 0, nil, UnsupportedMessageError
+	}
+
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		return 0, nil, err
+	}
+	return websocket.BinaryMessage, b, nil
+}
+
+func (ProtobufSerializer) Deserialize(b []byte, s pkg.Serializable) error {
+	switch v := s.(type) {
+	case *pkg.ClientMessage:
+		msg := &ClientMessage{}
+		if err := proto.Unmarshal(b, msg); err != nil {
+			return err
+		}
+		v.Payload = msg.Payload
+		v.Cid = msg.Cid
+		v.Seq = msg.Seq
+		v.Acknowledge = msg.Acknowledge
+		v.Type = msg.Type
+		v.Ref = msg.Ref
+		v.Error = msg.Error
+	case *pkg.ClientAck:
+		msg := &ClientAck{}
+		if err := proto.Unmarshal(b, msg); err != nil {
+			return err
+		}
+		v.Cid = msg.Cid
+	case *pkg.ClientFrame:
+		// ClientFrame shares its field numbers with ClientAck, so acks from older clients decode as ack frames
+		msg := &ClientFrame{}
+		if err := proto.Unmarshal(b, msg); err != nil {
+			return err
+		}
+		v.Cid = msg.Cid
+		v.Type = msg.Type
+		v.Ref = msg.Ref
+		v.Data = msg.Data
+	case *pkg.ClientResume:
+		msg := &ClientResume{}
+		if err := proto.Unmarshal(b, msg); err != nil {
+			return err
+		}
+		v.LastSeq = msg.LastSeq
+	default:
+		return UnsupportedMessageError
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package internal
+
+import (
+	"testing"
+)
+
+func TestNegotiateSubprotocol(t *testing.T) {
+	tests := []struct {
+		requested []string
+		want      string
+		ok        bool
+	}{
+		{[]string{ProtobufSubprotocolV1, JSONSubprotocolV1}, ProtobufSubprotocolV1, true},
+		{[]string{JSONSubprotocolV1, ProtobufSubprotocolV1}, JSONSubprotocolV1, true},
+		{[]string{"courier.v2.json", ProtobufSubprotocolV1}, ProtobufSubprotocolV1, true},
+		{[]string{"courier.v2.json"}, "", false},
+		{nil, "", false},
+	}
+
+	for _, test := range tests {
+		got, ok := NegotiateSubprotocol(test.requested)
+		if got != test.want || ok != test.ok {
+			t.Errorf("NegotiateSubprotocol(%v) = %q, %v, want %q, %v", test.requested, got, ok, test.want, test.ok)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/david-wiles/groupme-clone/pkg"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultTypingInterval is the minimum time between typing events forwarded for a user in a room.
+	// Frames received more often only extend the indicator's expiry
+	DefaultTypingInterval = 3 * time.Second
+
+	// DefaultTypingTimeout is how long a typing indicator lasts without being refreshed by the client
+	DefaultTypingTimeout = 6 * time.Second
+)
+
+// TypingFrame is the body of a FrameTyping frame. Clients send it while the user is typing, and may send
+// it with Stopped set once the user stops typing without sending a message
+type TypingFrame struct {
+	RoomID  string `json:"roomId"`
+	Stopped bool   `json:"stopped,omitempty"`
+}
+
+// TypingEvent is the payload of a MessageTyping message sent to the other members of a room. Clients
+// should stop showing the indicator at ExpiresAt even if no event with Typing unset is received
+type TypingEvent struct {
+	RoomID    uuid.UUID  `json:"roomId"`
+	UserID    uuid.UUID  `json:"userId"`
+	Typing    bool       `json:"typing"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+type typingKey struct {
+	roomID uuid.UUID
+	userID uuid.UUID
+}
+
+// typingState is an active indicator. generation changes whenever the indicator is refreshed, so that
+// a timer which fired before being replaced can tell that it is stale
+type typingState struct {
+	lastSent   time.Time
+	timer      *time.Timer
+	generation uint64
+}
+
+// TypingIndicators forwards typing events to the other members of a room as ephemeral events. Events
+// are rate limited per user and room, and an event with Typing unset is sent once the user stops
+// refreshing the indicator. It is safe for concurrent use
+type TypingIndicators struct {
+	Rooms RoomQueryEngine
+	Conns *CourierConns
+
+	// Interval is the minimum time between forwarded events for a user in a room
+	Interval time.Duration
+
+	// Timeout is how long an indicator lasts without being refreshed
+	Timeout time.Duration
+
+	mu     sync.Mutex
+	active map[typingKey]*typingState
+}
+
+func NewTypingIndicators(rooms RoomQueryEngine, conns *CourierConns) *TypingIndicators {
+	return &TypingIndicators{
+		Rooms:    rooms,
+		Conns:    conns,
+		Interval: DefaultTypingInterval,
+		Timeout:  DefaultTypingTimeout,
+		active:   make(map[typingKey]*typingState),
+	}
+}
+
+// Start marks userID as typing in the room. The event is only forwarded if none was forwarded for the
+// user in the room within the last Interval, otherwise the existing indicator is extended
+func (t *TypingIndicators) Start(ctx context.Context, roomID, userID uuid.UUID) error {
+	key := typingKey{roomID, userID}
+	now := time.Now()
+
+	t.mu.Lock()
+	state, ok := t.active[key]
+	if !ok {
+		state = &typingState{}
+		t.active[key] = state
+	}
+	t.arm(key, state)
+	if ok && now.Sub(state.lastSent) < t.Interval {
+		t.mu.Unlock()
+		return nil
+	}
+	state.lastSent = now
+	t.mu.Unlock()
+
+	expiresAt := now.Add(t.Timeout)
+	err := t.broadcast(ctx, &TypingEvent{RoomID: roomID, UserID: userID, Typing: true, ExpiresAt: &expiresAt})
+	if err == NotRoomMemberError {
+		t.remove(key, state)
+	}
+	return err
+}
+
+// Stop clears the user's typing indicator in the room, if there is one
+func (t *TypingIndicators) Stop(ctx context.Context, roomID, userID uuid.UUID) error {
+	key := typingKey{roomID, userID}
+
+	t.mu.Lock()
+	state, ok := t.active[key]
+	t.mu.Unlock()
+
+	if !ok || !t.remove(key, state) {
+		return nil
+	}
+
+	return t.broadcast(ctx, &TypingEvent{RoomID: roomID, UserID: userID})
+}
+
+// remove stops and removes the indicator if it is still the active one for key, returning true if it was
+func (t *TypingIndicators) remove(key typingKey, state *typingState) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.active[key] != state {
+		return false
+	}
+
+	state.timer.Stop()
+	delete(t.active, key)
+	return true
+}
+
+// arm starts a new generation of the indicator, which expires after Timeout unless it is armed again.
+// It must be called with mu held
+func (t *TypingIndicators) arm(key typingKey, state *typingState) {
+	if state.timer != nil {
+		state.timer.Stop()
+	}
+	state.generation++
+	generation := state.generation
+	state.timer = time.AfterFunc(t.Timeout, func() { t.expire(key, state, generation) })
+}
+
+// expire clears an indicator which was not refreshed within Timeout. The timer of an indicator which was
+// refreshed may already have fired, in which case generation is stale and the indicator is kept
+func (t *TypingIndicators) expire(key typingKey, state *typingState, generation uint64) {
+	t.mu.Lock()
+	if t.active[key] != state || state.generation != generation {
+		t.mu.Unlock()
+		return
+	}
+	delete(t.active, key)
+	t.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.Timeout)
+	defer cancel()
+
+	if err := t.broadcast(ctx, &TypingEvent{RoomID: key.roomID, UserID: key.userID}); err != nil {
+		log.WithFields(log.Fields{
+			"err":    err,
+			"roomID": key.roomID,
+			"userID": key.userID,
+		}).Warnln("unable to expire typing indicator")
+	}
+}
+
+// broadcast sends the event to every member of the room other than the user who is typing
+func (t *TypingIndicators) broadcast(ctx context.Context, event *TypingEvent) error {
+	members, err := t.Rooms.ListRoomMembers(event.RoomID)
+	if err != nil {
+		return err
+	}
+
+	if !ContainsUUID(members, event.UserID) {
+		return NotRoomMemberError
+	}
+
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if _, err := t.Conns.BroadcastEvent(ctx, FilterUUID(members, event.UserID), pkg.MessageTyping, encoded); err != nil {
+		return err
+	}
+	return nil
+}
+
+// TypingHandler returns a FrameHandler which forwards FrameTyping frames to the other members of the room
+func TypingHandler(typing *TypingIndicators) FrameHandler {
+	return func(ctx context.Context, ws *WebsocketConnection, frame *pkg.ClientFrame) ([]byte, error) {
+		req := &TypingFrame{}
+		if err := json.Unmarshal(frame.Data, req); err != nil {
+			return nil, err
+		}
+
+		roomID, err := uuid.Parse(req.RoomID)
+		if err != nil {
+			return nil, err
+		}
+
+		if req.Stopped {
+			return nil, typing.Stop(ctx, roomID, ws.userID)
+		}
+		return nil, typing.Start(ctx, roomID, ws.userID)
+	}
+}
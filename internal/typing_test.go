@@ -0,0 +1,33 @@
+package internal
+
+import (
+	"github.com/google/uuid"
+	"testing"
+	"time"
+)
+
+func TestTypingIndicatorsIgnoreStaleExpiry(t *testing.T) {
+	typing := NewTypingIndicators(RoomQueryEngine{}, nil)
+	typing.Timeout = time.Hour
+
+	key := typingKey{uuid.New(), uuid.New()}
+	state := &typingState{}
+
+	typing.mu.Lock()
+	typing.active[key] = state
+	typing.arm(key, state)
+	stale := state.generation
+
+	// The indicator is refreshed after its first timer fired, but before that timer's expire ran
+	typing.arm(key, state)
+	typing.mu.Unlock()
+	defer state.timer.Stop()
+
+	typing.expire(key, state, stale)
+
+	typing.mu.Lock()
+	defer typing.mu.Unlock()
+	if typing.active[key] != state {
+		t.Fatalf("refreshed indicator was expired by a stale timer")
+	}
+}
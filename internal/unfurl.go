@@ -0,0 +1,452 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/html"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultUnfurlTimeout is how long fetching a single link may take, including redirects
+	DefaultUnfurlTimeout = 5 * time.Second
+
+	// DefaultUnfurlMaxBytes is the most of a page which is read looking for its metadata
+	DefaultUnfurlMaxBytes = 512 << 10
+
+	// DefaultUnfurlCacheTTL is how long a preview is cached. Links without a preview are cached for a
+	// tenth of the time, so that pages which were briefly unavailable get another chance
+	DefaultUnfurlCacheTTL = 24 * time.Hour
+
+	// MaxLinkPreviews is the number of links in a message which are previewed
+	MaxLinkPreviews = 3
+
+	// unfurlDeadline is how long previewing every link of a message may take
+	unfurlDeadline = 30 * time.Second
+
+	// maxUnfurlRedirects is the number of redirects followed when fetching a link
+	maxUnfurlRedirects = 3
+
+	maxPreviewTitle       = 300
+	maxPreviewDescription = 1000
+)
+
+var (
+	InvalidLinkError   = errors.New("only http and https links can be previewed")
+	ForbiddenAddrError = errors.New("link resolves to a forbidden address")
+)
+
+// LinkPreview is the metadata of a page linked in a message, read from its OpenGraph and Twitter card
+// tags, falling back to the page's title and description
+type LinkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Image       string `json:"image,omitempty"`
+	SiteName    string `json:"siteName,omitempty"`
+	Type        string `json:"type,omitempty"`
+}
+
+// linkPattern matches http and https URLs, up to the next whitespace or character which can't appear in
+// a URL
+var linkPattern = regexp.MustCompile(`https?://[^\s<>"'` + "`" + `]+`)
+
+// ParseLinks returns the distinct links in content, in order, up to max links
+func ParseLinks(content string, max int) []string {
+	var links []string
+	seen := make(map[string]bool)
+	for _, link := range linkPattern.FindAllString(content, -1) {
+		// Punctuation ending a sentence, or closing parentheses around the link, are not part of it
+		link = strings.TrimRight(link, ".,;:!?")
+		if strings.HasSuffix(link, ")") && !strings.Contains(link, "(") {
+			link = strings.TrimRight(link, ")")
+		}
+
+		if _, err := url.Parse(link); err != nil || seen[link] {
+			continue
+		}
+		seen[link] = true
+		links = append(links, link)
+		if len(links) == max {
+			break
+		}
+	}
+	return links
+}
+
+// reservedNets are the special purpose ranges which aren't covered by the net.IP predicates used by
+// PublicAddr. IPv4 ranges also match IPv4-mapped IPv6 addresses
+var reservedNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",     // "this" network
+		"100.64.0.0/10", // shared address space of carrier grade NAT
+		"192.0.0.0/24",  // IETF protocol assignments
+		"198.18.0.0/15", // benchmarking
+		"240.0.0.0/4",   // reserved, including the limited broadcast address
+		"64:ff9b::/96",  // NAT64, which would reach any IPv4 address through the translator
+	} {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}()
+
+// PublicAddr returns false for addresses which aren't reachable on the public internet, such as
+// loopback, private and link local addresses, which links must never be allowed to reach
+func PublicAddr(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, ipNet := range reservedNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+// NewPublicHTTPClient returns a client which only connects to public addresses on the standard http
+// and https ports. Addresses are checked after they are resolved, for every connection including those
+// made for redirects, so that a hostname can't be pointed at an internal address
+func NewPublicHTTPClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !PublicAddr(ip) || (port != "80" && port != "443") {
+				return ForbiddenAddrError
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			// Requests must never go through a proxy, which would be dialed instead of the link's host
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       30 * time.Second,
+		},
+		CheckRedirect: checkUnfurlRedirect,
+	}
+}
+
+// checkUnfurlRedirect follows at most maxUnfurlRedirects redirects, and only to http and https links.
+// The response to the last redirect followed is returned as is
+func checkUnfurlRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > maxUnfurlRedirects {
+		return http.ErrUseLastResponse
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return InvalidLinkError
+	}
+	return nil
+}
+
+// Unfurler fetches previews of links, caching them in Redis
+type Unfurler struct {
+	// Client fetches pages. It should only be able to reach public addresses, see NewPublicHTTPClient
+	Client *http.Client
+
+	// Cache stores previews, if it is set
+	Cache *redis.Client
+
+	// MaxBytes and CacheTTL use their defaults if they aren't set
+	MaxBytes int64
+	CacheTTL time.Duration
+}
+
+// NewUnfurler returns an Unfurler which only fetches pages from public addresses, caching previews in rdb
+func NewUnfurler(rdb *redis.Client) *Unfurler {
+	return &Unfurler{
+		Client: NewPublicHTTPClient(DefaultUnfurlTimeout),
+		Cache:  rdb,
+	}
+}
+
+func (unfurler *Unfurler) maxBytes() int64 {
+	if unfurler.MaxBytes > 0 {
+		return unfurler.MaxBytes
+	}
+	return DefaultUnfurlMaxBytes
+}
+
+func (unfurler *Unfurler) cacheTTL() time.Duration {
+	if unfurler.CacheTTL > 0 {
+		return unfurler.CacheTTL
+	}
+	return DefaultUnfurlCacheTTL
+}
+
+func unfurlCacheKey(link string) string {
+	digest := sha256.Sum256([]byte(link))
+	return "unfurl:" + hex.EncodeToString(digest[:])
+}
+
+// Unfurl returns the preview of a link, or nil if the page has no metadata worth showing. Failing to
+// fetch the page is cached the same as a page without metadata
+func (unfurler *Unfurler) Unfurl(ctx context.Context, link string) (*LinkPreview, error) {
+	if unfurler.Cache != nil {
+		if cached, err := unfurler.Cache.Get(ctx, unfurlCacheKey(link)).Bytes(); err == nil {
+			var preview *LinkPreview
+			if err := json.Unmarshal(cached, &preview); err == nil {
+				return preview, nil
+			}
+		}
+	}
+
+	preview, err := unfurler.Fetch(ctx, link)
+	if err != nil {
+		// The message's deadline passing says nothing about the page
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		log.WithFields(log.Fields{
+			"err":  err,
+			"link": link,
+		}).Warnln("unable to unfurl link")
+	}
+
+	if unfurler.Cache != nil {
+		ttl := unfurler.cacheTTL()
+		if preview == nil {
+			ttl /= 10
+		}
+		if encoded, err := json.Marshal(preview); err == nil {
+			unfurler.Cache.Set(ctx, unfurlCacheKey(link), encoded, ttl)
+		}
+	}
+
+	return preview, nil
+}
+
+// UnfurlAll returns the previews of the links which have one, in the order of the links
+func (unfurler *Unfurler) UnfurlAll(ctx context.Context, links []string) []LinkPreview {
+	results := make([]*LinkPreview, len(links))
+
+	var wg sync.WaitGroup
+	for i, link := range links {
+		wg.Add(1)
+		go func(i int, link string) {
+			defer wg.Done()
+			results[i], _ = unfurler.Unfurl(ctx, link)
+		}(i, link)
+	}
+	wg.Wait()
+
+	previews := []LinkPreview{}
+	for _, preview := range results {
+		if preview != nil {
+			previews = append(previews, *preview)
+		}
+	}
+	return previews
+}
+
+// Fetch requests a page and reads its preview, without using the cache
+func (unfurler *Unfurler) Fetch(ctx context.Context, link string) (*LinkPreview, error) {
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, InvalidLinkError
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	req.Header.Set("User-Agent", "groupme-clone-unfurler/1.0")
+
+	res, err := unfurler.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type")); mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, nil
+	}
+
+	preview := parsePreview(io.LimitReader(res.Body, unfurler.maxBytes()), res.Request.URL)
+	if preview == nil {
+		return nil, nil
+	}
+	preview.URL = link
+	return preview, nil
+}
+
+// parsePreview reads the metadata in the head of a page. base is the URL of the page, used to resolve
+// relative image links
+func parsePreview(r io.Reader, base *url.URL) *LinkPreview {
+	meta := make(map[string]string)
+	var title string
+
+	tokenizer := html.NewTokenizer(r)
+	inTitle := false
+parse:
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			break parse
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := tokenizer.TagName()
+			switch string(name) {
+			case "body":
+				break parse
+			case "title":
+				inTitle = true
+			case "meta":
+				var key, content string
+				for hasAttr {
+					var attr, value []byte
+					attr, value, hasAttr = tokenizer.TagAttr()
+					switch string(attr) {
+					case "property", "name":
+						key = strings.ToLower(strings.TrimSpace(string(value)))
+					case "content":
+						content = strings.TrimSpace(string(value))
+					}
+				}
+				// The first value of each tag is used
+				if _, ok := meta[key]; key != "" && content != "" && !ok {
+					meta[key] = content
+				}
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "head":
+				break parse
+			case "title":
+				inTitle = false
+			}
+		case html.TextToken:
+			if inTitle && title == "" {
+				title = strings.TrimSpace(string(tokenizer.Text()))
+			}
+		}
+	}
+
+	first := func(keys ...string) string {
+		for _, key := range keys {
+			if value := meta[key]; value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+
+	preview := &LinkPreview{
+		Title:       truncateRunes(first("og:title", "twitter:title"), maxPreviewTitle),
+		Description: truncateRunes(first("og:description", "twitter:description", "description"), maxPreviewDescription),
+		SiteName:    truncateRunes(first("og:site_name"), maxPreviewTitle),
+		Type:        truncateRunes(first("og:type"), maxPreviewTitle),
+	}
+	if preview.Title == "" {
+		preview.Title = truncateRunes(title, maxPreviewTitle)
+	}
+
+	if image := first("og:image", "og:image:url", "og:image:secure_url", "twitter:image", "twitter:image:src"); image != "" {
+		if u, err := base.Parse(image); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			preview.Image = u.String()
+		}
+	}
+
+	if preview.Title == "" && preview.Description == "" {
+		return nil
+	}
+	return preview
+}
+
+// truncateRunes returns s shortened to at most n runes, dropping any invalid UTF-8
+func truncateRunes(s string, n int) string {
+	s = strings.ToValidUTF8(s, "")
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+// SetLinkPreviews stores the previews of a message's links, unless its content has changed since it was
+// unfurled or it was deleted. updated is false if the previews weren't stored
+func (db MessageQueryEngine) SetLinkPreviews(messageID uuid.UUID, content string, previews []LinkPreview) (updated bool, err error) {
+	var encoded interface{}
+	if len(previews) > 0 {
+		if encoded, err = json.Marshal(previews); err != nil {
+			return false, err
+		}
+	}
+
+	stmt := `UPDATE "messages" SET "previews" = $3 WHERE "id" = $1 AND "content" = $2 AND "deleted_at" IS NULL;`
+	res, err := db.Exec(stmt, messageID, content, encoded)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"messageID": messageID,
+		}).Errorln("unable to update link previews")
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// unfurlLinks previews the links in a new or edited message, and sends the message with its previews to
+// the members of its room. Nothing is sent if the message has no links and had no previews
+func (poster MessagePoster) unfurlLinks(message *Message) {
+	links := ParseLinks(message.Content, MaxLinkPreviews)
+	if len(links) == 0 && len(message.Previews) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), unfurlDeadline)
+	defer cancel()
+
+	previews := poster.Unfurler.UnfurlAll(ctx, links)
+	if len(previews) == 0 && len(message.Previews) == 0 {
+		return
+	}
+
+	updated, err := poster.Messages.SetLinkPreviews(message.ID, message.Content, previews)
+	if err != nil || !updated {
+		return
+	}
+
+	poster.notifyUpdated(ctx, message.ID)
+}
@@ -0,0 +1,266 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLinks(t *testing.T) {
+	tests := []struct {
+		content string
+		max     int
+		links   []string
+	}{
+		{"no links here", 3, nil},
+		{"see https://example.com.", 3, []string{"https://example.com"}},
+		{"(http://example.com/page)", 3, []string{"http://example.com/page"}},
+		{"https://en.wikipedia.org/wiki/Go_(programming_language)", 3, []string{"https://en.wikipedia.org/wiki/Go_(programming_language)"}},
+		{"https://a.com https://a.com, https://b.com", 3, []string{"https://a.com", "https://b.com"}},
+		{"https://a.com https://b.com https://c.com https://d.com", 3, []string{"https://a.com", "https://b.com", "https://c.com"}},
+		{"ftp://example.com and mailto:me@example.com", 3, nil},
+		{`<a href="https://example.com/x">`, 3, []string{"https://example.com/x"}},
+	}
+
+	for _, test := range tests {
+		if links := ParseLinks(test.content, test.max); !reflect.DeepEqual(links, test.links) {
+			t.Errorf("ParseLinks(%q) = %q, want %q", test.content, links, test.links)
+		}
+	}
+}
+
+func TestPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr   string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"8.8.8.8", true},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"127.0.0.1", false},
+		{"10.0.0.1", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"100.127.255.255", false},
+		{"100.128.0.1", true},
+		{"192.0.0.8", false},
+		{"198.18.0.1", false},
+		{"198.19.255.255", false},
+		{"198.20.0.1", true},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		{"224.0.0.1", false},
+		{"::1", false},
+		{"::", false},
+		{"fe80::1", false},
+		{"fc00::1", false},
+		{"ff02::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:100.64.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"::ffff:93.184.216.34", true},
+		{"64:ff9b::7f00:1", false},
+		{"64:ff9b::5db8:d822", false},
+	}
+
+	for _, test := range tests {
+		ip := net.ParseIP(test.addr)
+		if ip == nil {
+			t.Fatalf("invalid test address %q", test.addr)
+		}
+		if public := PublicAddr(ip); public != test.public {
+			t.Errorf("PublicAddr(%s) = %v, want %v", test.addr, public, test.public)
+		}
+	}
+}
+
+func TestParsePreview(t *testing.T) {
+	base, _ := url.Parse("https://example.com/articles/1")
+
+	tests := []struct {
+		name    string
+		page    string
+		preview *LinkPreview
+	}{
+		{
+			name: "opengraph",
+			page: `<html><head><title>Fallback</title>
+				<meta property="og:title" content="OG Title">
+				<meta property="og:description" content="OG Description">
+				<meta property="og:image" content="/images/cover.png">
+				<meta property="og:site_name" content="Example">
+				<meta property="og:type" content="article">
+				</head><body></body></html>`,
+			preview: &LinkPreview{
+				Title:       "OG Title",
+				Description: "OG Description",
+				Image:       "https://example.com/images/cover.png",
+				SiteName:    "Example",
+				Type:        "article",
+			},
+		},
+		{
+			name: "twitter card and first value wins",
+			page: `<head><meta name="twitter:title" content="Card"><meta name="twitter:title" content="Second">
+				<meta name="description" content="Plain description"></head>`,
+			preview: &LinkPreview{Title: "Card", Description: "Plain description"},
+		},
+		{
+			name:    "title fallback",
+			page:    `<html><head><title> Just a title </title></head></html>`,
+			preview: &LinkPreview{Title: "Just a title"},
+		},
+		{
+			name:    "images must be http",
+			page:    `<head><title>T</title><meta property="og:image" content="javascript:alert(1)"></head>`,
+			preview: &LinkPreview{Title: "T"},
+		},
+		{
+			name:    "metadata in the body is ignored",
+			page:    `<html><head></head><body><title>Not this</title><meta property="og:title" content="Nor this"></body></html>`,
+			preview: nil,
+		},
+		{
+			name:    "no metadata",
+			page:    `<html><head></head></html>`,
+			preview: nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			preview := parsePreview(strings.NewReader(test.page), base)
+			if !reflect.DeepEqual(preview, test.preview) {
+				t.Errorf("got %+v, want %+v", preview, test.preview)
+			}
+		})
+	}
+}
+
+func TestParsePreviewTruncates(t *testing.T) {
+	base, _ := url.Parse("https://example.com")
+	page := `<head><title>` + strings.Repeat("é", maxPreviewTitle+10) + `</title></head>`
+
+	preview := parsePreview(strings.NewReader(page), base)
+	if preview == nil || len([]rune(preview.Title)) != maxPreviewTitle {
+		t.Fatalf("title was not truncated to %d runes: %+v", maxPreviewTitle, preview)
+	}
+}
+
+// newTestUnfurler returns an Unfurler whose client can reach the test server, but follows redirects the
+// same as the public client
+func newTestUnfurler(server *httptest.Server) *Unfurler {
+	client := server.Client()
+	client.CheckRedirect = checkUnfurlRedirect
+	return &Unfurler{Client: client}
+}
+
+func TestUnfurlerFetch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/page":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, `<head><meta property="og:title" content="Page"><meta property="og:image" content="img.png"></head>`)
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			fmt.Fprint(w, "\x89PNG")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	unfurler := newTestUnfurler(server)
+	ctx := context.Background()
+
+	preview, err := unfurler.Fetch(ctx, server.URL+"/page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &LinkPreview{URL: server.URL + "/page", Title: "Page", Image: server.URL + "/img.png"}
+	if !reflect.DeepEqual(preview, want) {
+		t.Errorf("got %+v, want %+v", preview, want)
+	}
+
+	if preview, err := unfurler.Fetch(ctx, server.URL+"/image"); err != nil || preview != nil {
+		t.Errorf("non html page: got %+v, %v", preview, err)
+	}
+
+	if _, err := unfurler.Fetch(ctx, server.URL+"/missing"); err == nil {
+		t.Errorf("missing page: expected an error")
+	}
+
+	if _, err := unfurler.Fetch(ctx, "file:///etc/passwd"); err != InvalidLinkError {
+		t.Errorf("file link: got %v, want InvalidLinkError", err)
+	}
+}
+
+func TestUnfurlerFetchLimitsRedirects(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var hops int
+		if _, err := fmt.Sscanf(r.URL.Path, "/redirect/%d", &hops); err == nil && hops > 0 {
+			http.Redirect(w, r, fmt.Sprintf("/redirect/%d", hops-1), http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<head><title>Landed</title></head>`)
+	}))
+	defer server.Close()
+
+	unfurler := newTestUnfurler(server)
+
+	preview, err := unfurler.Fetch(context.Background(), fmt.Sprintf("%s/redirect/%d", server.URL, maxUnfurlRedirects))
+	if err != nil || preview == nil || preview.Title != "Landed" {
+		t.Errorf("%d redirects: got %+v, %v", maxUnfurlRedirects, preview, err)
+	}
+
+	preview, err = unfurler.Fetch(context.Background(), fmt.Sprintf("%s/redirect/%d", server.URL, maxUnfurlRedirects+1))
+	if err == nil || preview != nil {
+		t.Errorf("%d redirects: got %+v, expected an error", maxUnfurlRedirects+1, preview)
+	}
+}
+
+func TestUnfurlerFetchReadsAtMostMaxBytes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<head><!--`+strings.Repeat("x", 1024)+`--><title>Too far</title></head>`)
+	}))
+	defer server.Close()
+
+	unfurler := newTestUnfurler(server)
+	unfurler.MaxBytes = 512
+
+	preview, err := unfurler.Fetch(context.Background(), server.URL)
+	if err != nil || preview != nil {
+		t.Errorf("got %+v, %v, want no preview", preview, err)
+	}
+
+	unfurler.MaxBytes = 0
+	if preview, err := unfurler.Fetch(context.Background(), server.URL); err != nil || preview == nil {
+		t.Errorf("default limit: got %+v, %v", preview, err)
+	}
+}
+
+func TestPublicHTTPClientRefusesPrivateAddrs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request reached a loopback server")
+	}))
+	defer server.Close()
+
+	unfurler := &Unfurler{Client: NewPublicHTTPClient(DefaultUnfurlTimeout)}
+	if _, err := unfurler.Fetch(context.Background(), server.URL); !errors.Is(err, ForbiddenAddrError) {
+		t.Errorf("got %v, want ForbiddenAddrError", err)
+	}
+}
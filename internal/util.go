@@ -35,3 +35,12 @@ func FilterUUID(list []uuid.UUID, toRemove uuid.UUID) []uuid.UUID {
 	}
 	return list
 }
+
+func ContainsUUID(list []uuid.UUID, id uuid.UUID) bool {
+	for _, item := range list {
+		if item == id {
+			return true
+		}
+	}
+	return false
+}
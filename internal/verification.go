@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"time"
+)
+
+// DefaultVerificationTTL is how long an email verification link can be used for
+const DefaultVerificationTTL = 24 * time.Hour
+
+var (
+	UnverifiedAccountError        = errors.New("the account's email address must be verified first")
+	AlreadyVerifiedError          = errors.New("the account's email address is already verified")
+	InvalidVerificationTokenError = errors.New("email verification token is invalid, expired or already used")
+)
+
+// IsVerified returns true if the user has verified their email address
+func (db AccountQueryEngine) IsVerified(userID uuid.UUID) (bool, error) {
+	var verified bool
+	stmt := `SELECT "email_verified_at" IS NOT NULL FROM "accounts" WHERE "id" = $1;`
+	if err := db.QueryRow(stmt, userID).Scan(&verified); err != nil {
+		if err == sql.ErrNoRows {
+			return false, NoMatchingUserError
+		}
+		log.WithFields(log.Fields{
+			"err":       err,
+			"accountID": userID,
+		}).Errorln("unable to query account verification")
+		return false, err
+	}
+	return verified, nil
+}
+
+// RequireVerified returns UnverifiedAccountError if the user hasn't verified their email address
+func (db AccountQueryEngine) RequireVerified(userID uuid.UUID) error {
+	verified, err := db.IsVerified(userID)
+	if err != nil {
+		return err
+	}
+	if !verified {
+		return UnverifiedAccountError
+	}
+	return nil
+}
+
+// CreateEmailVerification stores the digest of a verification token for the account, which expires at
+// expiresAt
+func (db AccountQueryEngine) CreateEmailVerification(userID uuid.UUID, token string, expiresAt time.Time) error {
+	stmt := `INSERT INTO "email_verifications" ("token_hash", "account_id", "expires_at") VALUES ($1, $2, $3);`
+	if _, err := db.Exec(stmt, hashSecretToken(token), userID, expiresAt); err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"accountID": userID,
+		}).Errorln("unable to insert email verification")
+		return err
+	}
+	return nil
+}
+
+// VerifyEmail uses a verification token to mark its account as verified. Each token can only be used once
+func (db AccountQueryEngine) VerifyEmail(token string, now time.Time) (uuid.UUID, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	var userID uuid.UUID
+	stmt := `UPDATE "email_verifications" SET "used_at" = $2 WHERE "token_hash" = $1 AND "used_at" IS NULL AND "expires_at" > $2 RETURNING "account_id";`
+	err = tx.QueryRow(stmt, hashSecretToken(token), now).Scan(&userID)
+	if err == nil {
+		// Verifying an account again keeps the time it was first verified
+		stmt = `UPDATE "accounts" SET "email_verified_at" = $2 WHERE "id" = $1 AND "email_verified_at" IS NULL;`
+		_, err = tx.Exec(stmt, userID, now)
+	}
+	if err != nil {
+		if err := tx.Rollback(); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Errorln("unable to rollback transaction")
+		}
+		if err == sql.ErrNoRows {
+			return uuid.Nil, InvalidVerificationTokenError
+		}
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Errorln("unable to verify email")
+		return uuid.Nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Errorln("unable to commit transaction")
+		return uuid.Nil, err
+	}
+
+	return userID, nil
+}
+
+// EmailVerificationStore stores email verification tokens. It is implemented by AccountQueryEngine
+type EmailVerificationStore interface {
+	CreateEmailVerification(userID uuid.UUID, token string, expiresAt time.Time) error
+	VerifyEmail(token string, now time.Time) (uuid.UUID, error)
+}
+
+// EmailVerifier emails verification links to users and verifies their accounts once they follow them
+type EmailVerifier struct {
+	Accounts EmailVerificationStore
+	Sender   EmailSender
+
+	// VerifyURL is the page of the client which verifies accounts. The token is added to it as the token
+	// query parameter. If it isn't set, the email contains only the token
+	VerifyURL string
+
+	// TTL uses DefaultVerificationTTL if it isn't set
+	TTL time.Duration
+}
+
+func (verifier EmailVerifier) ttl() time.Duration {
+	if verifier.TTL > 0 {
+		return verifier.TTL
+	}
+	return DefaultVerificationTTL
+}
+
+// SendVerification emails a verification token to the account's email address. AlreadyVerifiedError is
+// returned if the account is already verified
+func (verifier EmailVerifier) SendVerification(ctx context.Context, account *Account) error {
+	if account.Verified {
+		return AlreadyVerifiedError
+	}
+
+	token, err := newSecretToken()
+	if err != nil {
+		return err
+	}
+
+	ttl := verifier.ttl()
+	if err := verifier.Accounts.CreateEmailVerification(account.ID, token, time.Now().Add(ttl)); err != nil {
+		return err
+	}
+
+	body := "Use this code to verify your email address: " + token
+	if link := tokenLink(verifier.VerifyURL, token); link != "" {
+		body = "Follow this link to verify your email address: " + link
+	}
+	body += "\n\nIt expires in " + strconv.Itoa(int(ttl.Hours())) + " hours. If you didn't create an account, you can ignore this email.\n"
+
+	if err := verifier.Sender.Send(ctx, Email{To: account.Email, Subject: "Verify your email address", Body: body}); err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"accountID": account.ID,
+		}).Errorln("unable to send verification email")
+		return err
+	}
+	return nil
+}
+
+// Verify marks the account the token was sent to as verified
+func (verifier EmailVerifier) Verify(token string) (uuid.UUID, error) {
+	return verifier.Accounts.VerifyEmail(token, time.Now())
+}
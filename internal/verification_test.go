@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingVerificationStore records the calls which would store and use verification tokens. Whether
+// tokens are single use or expired is decided in SQL, so it isn't modelled here
+type recordingVerificationStore struct {
+	created []storedVerification
+
+	verifiedToken string
+	verifiedUser  uuid.UUID
+	verifyErr     error
+}
+
+type storedVerification struct {
+	userID    uuid.UUID
+	token     string
+	expiresAt time.Time
+}
+
+func (store *recordingVerificationStore) CreateEmailVerification(userID uuid.UUID, token string, expiresAt time.Time) error {
+	store.created = append(store.created, storedVerification{userID, token, expiresAt})
+	return nil
+}
+
+func (store *recordingVerificationStore) VerifyEmail(token string, _ time.Time) (uuid.UUID, error) {
+	store.verifiedToken = token
+	return store.verifiedUser, store.verifyErr
+}
+
+func TestEmailVerifierEmailsLink(t *testing.T) {
+	account := &Account{ID: uuid.New(), Email: "alice@example.com"}
+	store := &recordingVerificationStore{}
+	sender := &MemoryEmailSender{}
+	verifier := EmailVerifier{Accounts: store, Sender: sender, VerifyURL: "https://app.example.com/verify"}
+
+	before := time.Now()
+	if err := verifier.SendVerification(context.Background(), account); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(store.created) != 1 {
+		t.Fatalf("stored %d tokens, want 1", len(store.created))
+	}
+	verification := store.created[0]
+	if verification.userID != account.ID {
+		t.Errorf("stored a token for %s, want %s", verification.userID, account.ID)
+	}
+	if verification.expiresAt.Before(before.Add(DefaultVerificationTTL)) || verification.expiresAt.After(time.Now().Add(DefaultVerificationTTL)) {
+		t.Errorf("token expires at %s, want %s from now", verification.expiresAt, DefaultVerificationTTL)
+	}
+
+	email := sender.Last(account.Email)
+	if email == nil {
+		t.Fatal("no email was sent")
+	}
+	if email.Subject != "Verify your email address" {
+		t.Errorf("got subject %q", email.Subject)
+	}
+	if link := tokenLink(verifier.VerifyURL, verification.token); !strings.Contains(email.Body, "Follow this link to verify your email address: "+link+"\n") {
+		t.Errorf("the email doesn't link to %s: %q", link, email.Body)
+	}
+	if !strings.Contains(email.Body, "It expires in 24 hours.") {
+		t.Errorf("the email doesn't say when the link expires: %q", email.Body)
+	}
+}
+
+func TestEmailVerifierEmailsCodeWithoutVerifyURL(t *testing.T) {
+	account := &Account{ID: uuid.New(), Email: "alice@example.com"}
+	store := &recordingVerificationStore{}
+	sender := &MemoryEmailSender{}
+	verifier := EmailVerifier{Accounts: store, Sender: sender, TTL: 2 * time.Hour}
+
+	if err := verifier.SendVerification(context.Background(), account); err != nil {
+		t.Fatal(err)
+	}
+
+	body := sender.Last(account.Email).Body
+	if want := "Use this code to verify your email address: " + store.created[0].token + "\n"; !strings.HasPrefix(body, want) {
+		t.Errorf("got %q, want it to start with %q", body, want)
+	}
+	if !strings.Contains(body, "It expires in 2 hours.") {
+		t.Errorf("the email doesn't use the TTL: %q", body)
+	}
+}
+
+func TestEmailVerifierSkipsVerifiedAccounts(t *testing.T) {
+	store := &recordingVerificationStore{}
+	sender := &MemoryEmailSender{}
+	verifier := EmailVerifier{Accounts: store, Sender: sender}
+
+	account := &Account{ID: uuid.New(), Email: "alice@example.com", Verified: true}
+	if err := verifier.SendVerification(context.Background(), account); err != AlreadyVerifiedError {
+		t.Errorf("got %v, want AlreadyVerifiedError", err)
+	}
+	if len(store.created) != 0 {
+		t.Errorf("stored a token for a verified account")
+	}
+	if sent := sender.Sent(); len(sent) != 0 {
+		t.Errorf("sent %d emails, want none", len(sent))
+	}
+}
+
+func TestEmailVerifierVerify(t *testing.T) {
+	store := &recordingVerificationStore{verifiedUser: uuid.New()}
+	verifier := EmailVerifier{Accounts: store, Sender: &MemoryEmailSender{}}
+
+	userID, err := verifier.Verify("token")
+	if err != nil || userID != store.verifiedUser || store.verifiedToken != "token" {
+		t.Errorf("got %s, %v after verifying %q", userID, err, store.verifiedToken)
+	}
+
+	// The store decides whether the token can be used
+	store.verifyErr = InvalidVerificationTokenError
+	if _, err := verifier.Verify("token"); err != InvalidVerificationTokenError {
+		t.Errorf("got %v, want InvalidVerificationTokenError", err)
+	}
+}
@@ -5,6 +5,16 @@ import (
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// writeWait is the time allowed to write a single message or ping to the websocket
+	writeWait = 10 * time.Second
+
+	// maxPendingFrames is how many frames from a client may wait to be handled before more are dropped
+	maxPendingFrames = 16
 )
 
 // WebsocketConnection represents an active websocket that is registered with the courier's hub.
@@ -27,27 +37,100 @@ type WebsocketConnection struct {
 
 	// hub is a back reference to the Hub managing this websocket connection
 	hub *Hub
+
+	// pingInterval is how often a ping is sent to the client. pongWait is how long the connection
+	// may go without receiving a pong (or any other message) before it is considered dead
+	pingInterval time.Duration
+	pongWait     time.Duration
+
+	// heartbeats is signalled by readWorker whenever a pong is received, so that heartbeatWorker can
+	// record the heartbeat without blocking reads on Redis
+	heartbeats chan struct{}
+
+	// frames holds the frames read by readWorker until frameWorker handles them, one at a time
+	frames chan *pkg.ClientFrame
+
+	// compressionLevel is the flate level of compressed messages, and compressionThreshold the minimum
+	// size of a serialized message for it to be compressed, if compression was negotiated with the client
+	compressionLevel     int
+	compressionThreshold int
+
+	// uncompressedBytes counts the bytes of serialized messages. The bytes actually written are counted
+	// by the underlying connection, if it supports it, starting from wireBase
+	uncompressedBytes atomic.Uint64
+	wireBase          uint64
+}
+
+// ConnectionOptions configure a single websocket. A Serializer of nil uses the hub's serializer
+type ConnectionOptions struct {
+	Serializer           pkg.Serializer
+	CompressionLevel     int
+	CompressionThreshold int
 }
 
 // NewWebsocketConnection will create a new websocket and generate a UUID
-func NewWebsocketConnection(conn *websocket.Conn, hub *Hub, userID uuid.UUID) *WebsocketConnection {
+func NewWebsocketConnection(conn *websocket.Conn, hub *Hub, userID uuid.UUID, opts ConnectionOptions) *WebsocketConnection {
+	if opts.Serializer == nil {
+		opts.Serializer = hub.Serializer
+	}
+
 	ws := &WebsocketConnection{
-		Writes:     make(chan pkg.Serializable, 64),
-		Serializer: hub.Serializer,
-		ID:         uuid.New(),
-		userID:     userID,
-		conn:       conn,
-		hub:        hub,
+		Writes:               make(chan pkg.Serializable, 64),
+		Serializer:           opts.Serializer,
+		ID:                   uuid.New(),
+		userID:               userID,
+		conn:                 conn,
+		hub:                  hub,
+		pingInterval:         hub.PingInterval,
+		pongWait:             hub.PongWait,
+		heartbeats:           make(chan struct{}, 1),
+		frames:               make(chan *pkg.ClientFrame, maxPendingFrames),
+		compressionLevel:     opts.CompressionLevel,
+		compressionThreshold: opts.CompressionThreshold,
+	}
+
+	if counter, ok := conn.UnderlyingConn().(*countingConn); ok {
+		ws.wireBase = counter.bytesWritten()
+	}
+
+	if err := conn.SetCompressionLevel(opts.CompressionLevel); err != nil {
+		log.WithFields(log.Fields{
+			"err":   err,
+			"id":    ws.ID,
+			"level": opts.CompressionLevel,
+		}).Warnln("unable to set compression level")
 	}
 
 	go ws.readWorker()
 	go ws.writeWorker()
+	go ws.heartbeatWorker()
+	go ws.frameWorker()
 
 	return ws
 }
 
-// readWorker continually reads messages from the websocket until closed
+// UserID returns the ID of the user listening to this websocket
+func (ws *WebsocketConnection) UserID() uuid.UUID {
+	return ws.userID
+}
+
+// readWorker continually reads messages from the websocket until closed. The read deadline is extended
+// each time a pong or any other message is received, so a connection that stops responding to pings
+// will fail to read and be unregistered
 func (ws *WebsocketConnection) readWorker() {
+	_ = ws.conn.SetReadDeadline(time.Now().Add(ws.pongWait))
+	ws.conn.SetPongHandler(func(string) error {
+		if err := ws.conn.SetReadDeadline(time.Now().Add(ws.pongWait)); err != nil {
+			return err
+		}
+		// A heartbeat which is already waiting to be recorded covers this one too
+		select {
+		case ws.heartbeats <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+
 	for {
 		_, bytes, err := ws.conn.ReadMessage()
 		if err != nil {
@@ -55,50 +138,135 @@ func (ws *WebsocketConnection) readWorker() {
 			ws.unregister()
 			return
 		}
+		_ = ws.conn.SetReadDeadline(time.Now().Add(ws.pongWait))
 
-		msg := &pkg.ClientAck{}
-		if err := ws.Deserialize(bytes, msg); err != nil {
+		frame := &pkg.ClientFrame{}
+		if err := ws.Deserialize(bytes, frame); err != nil {
 			log.WithFields(log.Fields{
 				"id":  ws.ID,
 				"err": err,
 			}).Warnln("unable to decode client message")
+			continue
 		}
 
-		if err := ws.hub.Acknowledge(msg.Cid); err != nil {
+		// Acks are handled inline since they are cheap, any other frame may block on other services and
+		// must not delay reading acks and pongs
+		if frame.Type == "" || frame.Type == pkg.FrameAck {
+			if err := ws.hub.Acknowledge(ws, frame.Cid); err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Warnln("failed to acknowledge message")
+			}
+			continue
+		}
+
+		// A client sending frames faster than they can be handled has the excess dropped, rather than
+		// growing the backlog without bound or blocking reads
+		select {
+		case ws.frames <- frame:
+		default:
 			log.WithFields(log.Fields{
-				"err": err,
-			}).Warnln("failed to acknowledge message")
+				"id":   ws.ID,
+				"type": frame.Type,
+			}).Warnln("dropping client frame")
+			ws.hub.replyToFrame(ws, frame, nil, FrameBacklogError)
 		}
 	}
 }
 
-// writeWorker continually writes messages from the Writes channel until closed
+// frameWorker handles the frames read by readWorker in the order they were received, until the
+// connection is unregistered
+func (ws *WebsocketConnection) frameWorker() {
+	for frame := range ws.frames {
+		ws.hub.dispatchFrame(ws, frame)
+	}
+}
+
+// heartbeatWorker refreshes the connection's registration and records the user's presence for each
+// heartbeat, until the connection is unregistered
+func (ws *WebsocketConnection) heartbeatWorker() {
+	for range ws.heartbeats {
+		ws.hub.RefreshConnection(ws)
+		ws.hub.updatePresence(ws.userID, presenceHeartbeat)
+	}
+}
+
+// writeWorker continually writes messages from the Writes channel until closed, and pings the client
+// every pingInterval
 func (ws *WebsocketConnection) writeWorker() {
-	for msg := range ws.Writes {
-		t, b, err := ws.Serialize(msg)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"err": err,
-				"id":  ws.ID,
-			}).Warnln("unable to serialize message er")
-			continue
-		}
+	ticker := time.NewTicker(ws.pingInterval)
+	defer ticker.Stop()
 
-		if err := ws.conn.WriteMessage(t, b); err != nil {
-			log.WithFields(log.Fields{
-				"err": err,
-				"id":  ws.ID,
-			}).Warnln("error writing message")
+	for {
+		select {
+		case msg, ok := <-ws.Writes:
+			if !ok {
+				return
+			}
+
+			t, b, err := ws.Serialize(msg)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+					"id":  ws.ID,
+				}).Warnln("unable to serialize message er")
+				continue
+			}
+
+			ws.writeMessage(t, b)
+		case <-ticker.C:
+			// A failed ping is not handled here, readWorker will unregister the connection once
+			// the pong deadline passes
+			if err := ws.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+					"id":  ws.ID,
+				}).Debugln("unable to ping websocket")
+			}
 		}
 	}
 }
 
+// writeMessage writes a serialized message to the websocket, compressing it if it is larger than
+// the compression threshold, and counts its uncompressed size
+func (ws *WebsocketConnection) writeMessage(t int, b []byte) {
+	ws.conn.EnableWriteCompression(len(b) >= ws.compressionThreshold)
+
+	_ = ws.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := ws.conn.WriteMessage(t, b); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+			"id":  ws.ID,
+		}).Warnln("error writing message")
+		return
+	}
+
+	ws.uncompressedBytes.Add(uint64(len(b)))
+}
+
+// CompressionStats returns the number of bytes written to the websocket before and after compression.
+// Every write to the underlying connection is counted, so control frames are included in the wire bytes
+func (ws *WebsocketConnection) CompressionStats() CompressionStats {
+	stats := CompressionStats{Uncompressed: ws.uncompressedBytes.Load()}
+	if counter, ok := ws.conn.UnderlyingConn().(*countingConn); ok {
+		stats.Wire = counter.bytesWritten() - ws.wireBase
+	}
+	return stats
+}
+
+// Stats returns the websocket's compression settings and byte counters
+func (ws *WebsocketConnection) Stats() ConnectionStats {
+	return ConnectionStats{
+		ID:                   ws.ID,
+		UserID:               ws.userID,
+		CompressionLevel:     ws.compressionLevel,
+		CompressionThreshold: ws.compressionThreshold,
+		CompressionStats:     ws.CompressionStats(),
+	}
+}
+
 // unregister removes itself from the hub and closes the underlying connection
 func (ws *WebsocketConnection) unregister() {
-	log.WithFields(log.Fields{
-		"id": ws.ID,
-	}).Infoln("removing websocket")
-
 	// Remove the connection from the hub first to prevent other goroutines from writing to
 	// the websocket while resources are being cleaned up
 	ws.hub.UnregisterConnection(ws.ID)
@@ -106,6 +274,19 @@ func (ws *WebsocketConnection) unregister() {
 	// Closing the connection will cause readWorker to exit
 	_ = ws.conn.Close()
 
+	// The counters are final once the connection is closed
+	stats := ws.CompressionStats()
+	ws.hub.recordClosed(stats)
+	log.WithFields(log.Fields{
+		"id":                ws.ID,
+		"uncompressedBytes": stats.Uncompressed,
+		"wireBytes":         stats.Wire,
+	}).Infoln("removed websocket")
+
 	// Closing the writes channel will cause writeWorker to exit
 	close(ws.Writes)
+
+	// unregister is only called by readWorker, so no more heartbeats will be signalled or frames queued
+	close(ws.heartbeats)
+	close(ws.frames)
 }
@@ -14,10 +14,60 @@ type ClientAck struct {
 	Serializable `json:"serializable,omitempty"`
 }
 
+// Types of frames sent by the client. A frame without a type is an ack, so that clients which only
+// send ClientAck keep working
+const (
+	FrameAck         = "ack"
+	FrameSendMessage = "send-message"
+	FrameTyping      = "typing"
+	FrameReadReceipt = "read-receipt"
+	FramePresence    = "presence"
+)
+
+// ClientFrame is the envelope of every frame sent by the client after the session is resumed. Cid is
+// the cid of the message being acknowledged by an ack frame. Any other frame may set Ref, which is
+// echoed in the server's reply. Data holds the frame's type-specific body
+type ClientFrame struct {
+	Cid          string          `json:"cid,omitempty"`
+	Type         string          `json:"type,omitempty"`
+	Ref          string          `json:"ref,omitempty"`
+	Data         json.RawMessage `json:"data,omitempty"`
+	Serializable `json:"serializable,omitempty"`
+}
+
+// Types of messages sent to the client. A message without a type is a new chat message. Messages with
+// Acknowledge set must be acknowledged whatever their type, while typing, presence, read receipt and
+// profile events are ephemeral and are never acknowledged
+const (
+	MessageReply       = "reply"
+	MessageTyping      = "typing"
+	MessagePresence    = "presence"
+	MessageReadReceipt = "read-receipt"
+	MessageEdited      = "message-edited"
+	MessageDeleted     = "message-deleted"
+	MessageReaction    = "message-reaction"
+	MessageMention     = "mention"
+	MessageUpdated     = "message-updated"
+	MessageProfile     = "profile"
+)
+
+// ClientMessage is the envelope of every message sent to the client. Replies to a ClientFrame have the
+// type MessageReply, the Ref of the frame, and either a Payload or an Error
 type ClientMessage struct {
 	Payload      []byte `json:"payload"`
 	Cid          string `json:"cid,omitempty"`
+	Seq          uint64 `json:"seq,omitempty"`
 	Acknowledge  bool   `json:"acknowledge,omitempty"`
+	Type         string `json:"type,omitempty"`
+	Ref          string `json:"ref,omitempty"`
+	Error        string `json:"error,omitempty"`
+	Serializable `json:"serializable,omitempty"`
+}
+
+// ClientResume is sent by the client after authenticating. LastSeq is the sequence number of the last
+// message the client acknowledged, or 0 if the client is starting a new session
+type ClientResume struct {
+	LastSeq      uint64 `json:"lastSeq"`
 	Serializable `json:"serializable,omitempty"`
 }
 